@@ -0,0 +1,239 @@
+/**
+ * Copyright (c) 2020 Ameya Lokare
+ */
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/juggernaut/webhook-sentry/proxy"
+)
+
+const dlqUsage = `Usage: whsentry dlq <command> [flags] [id]
+
+Commands:
+  list      List dead letters matching the filter
+  show      Show a dead letter in full, including its headers and body
+  purge     Purge a dead letter, or the ones matching the filter
+  replay    Replay a dead letter, or the ones matching the filter
+
+Run whsentry dlq <command> -h for the flags of a command.
+`
+
+// runDLQ runs the dlq subcommand against the admin listener, and returns the exit status
+func runDLQ(args []string, stdout io.Writer, stderr io.Writer) int {
+	if len(args) == 0 {
+		fmt.Fprint(stderr, dlqUsage)
+		return 2
+	}
+	command := args[0]
+	flags := flag.NewFlagSet("dlq "+command, flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	admin := flags.String("admin", "127.0.0.1:2113", "Address of the admin listener")
+	host := flags.String("host", "", "Only dead letters to this destination host pattern, like *.example.com")
+	tenant := flags.String("tenant", "", "Only dead letters belonging to this tenant")
+	since := flags.String("since", "", "Only dead letters that failed at or after this RFC 3339 time, or this long ago, like 24h")
+	until := flags.String("until", "", "Only dead letters that failed at or before this RFC 3339 time, or this long ago")
+	all := flags.Bool("all", false, "Purge or replay every dead letter when no filter is given")
+	ids, err := parseInterspersed(flags, args[1:])
+	if err != nil {
+		return 2
+	}
+	filtered := false
+	flags.Visit(func(f *flag.Flag) {
+		if f.Name != "admin" {
+			filtered = true
+		}
+	})
+
+	client := &dlqClient{baseURL: "http://" + *admin, out: stdout}
+	switch command {
+	case "list", "purge", "replay":
+		var filter proxy.DeadLetterFilter
+		filter, err = parseFilterFlags(*host, *tenant, *since, *until)
+		if err != nil {
+			break
+		}
+		if len(ids) > 1 || (len(ids) == 1 && command == "list") {
+			err = fmt.Errorf("unexpected arguments %s", strings.Join(ids, " "))
+			break
+		}
+		if len(ids) == 1 {
+			if filtered {
+				err = fmt.Errorf("-host, -tenant, -since, -until and -all can't be combined with an ID")
+				break
+			}
+			err = client.byID(command, ids[0])
+			break
+		}
+		query := filter.Values()
+		if *all {
+			query.Set("all", "true")
+		}
+		err = client.byFilter(command, query)
+	case "show":
+		if len(ids) != 1 || filtered {
+			err = fmt.Errorf("show takes the ID of a dead letter, and no filter")
+			break
+		}
+		err = client.byID(command, ids[0])
+	default:
+		fmt.Fprint(stderr, dlqUsage)
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "dlq %s: %s\n", command, err)
+		return 1
+	}
+	return 0
+}
+
+// parseInterspersed parses flags given before or after the positional arguments, which
+// flag.Parse alone stops at, and returns the positional arguments
+func parseInterspersed(flags *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := flags.Parse(args); err != nil {
+			return nil, err
+		}
+		rest := flags.Args()
+		if len(rest) == 0 {
+			return positional, nil
+		}
+		if n := len(args) - len(rest); n > 0 && args[n-1] == "--" {
+			return append(positional, rest...), nil
+		}
+		positional = append(positional, rest[0])
+		args = rest[1:]
+	}
+}
+
+func parseFilterFlags(host, tenant, since, until string) (proxy.DeadLetterFilter, error) {
+	filter := proxy.DeadLetterFilter{Host: host, Tenant: tenant}
+	var err error
+	if filter.Since, err = parseTimeFlag(since, time.Now()); err != nil {
+		return filter, fmt.Errorf("invalid -since: %s", err)
+	}
+	if filter.Until, err = parseTimeFlag(until, time.Now()); err != nil {
+		return filter, fmt.Errorf("invalid -until: %s", err)
+	}
+	return filter, nil
+}
+
+// parseTimeFlag accepts an RFC 3339 time or a duration before now
+func parseTimeFlag(value string, now time.Time) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if ago, err := time.ParseDuration(value); err == nil {
+		return now.Add(-ago), nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+type dlqClient struct {
+	baseURL string
+	out     io.Writer
+}
+
+func (c *dlqClient) byFilter(command string, query url.Values) error {
+	switch command {
+	case "list":
+		var deadLetters []*proxy.Delivery
+		if err := c.do(http.MethodGet, "/dead-letters", query, &deadLetters); err != nil {
+			return err
+		}
+		printDeadLetters(c.out, deadLetters)
+		return nil
+	case "purge":
+		return c.printCount(http.MethodDelete, "/dead-letters", query)
+	default:
+		return c.printCount(http.MethodPost, "/dead-letters/replay", query)
+	}
+}
+
+func (c *dlqClient) byID(command string, id string) error {
+	path := "/dead-letters/" + url.PathEscape(id)
+	switch command {
+	case "show":
+		var d proxy.Delivery
+		if err := c.do(http.MethodGet, path, nil, &d); err != nil {
+			return err
+		}
+		out, err := json.MarshalIndent(&d, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(c.out, "%s\n", out)
+		return nil
+	case "purge":
+		return c.printCount(http.MethodDelete, path, nil)
+	default:
+		return c.printCount(http.MethodPost, path+"/replay", nil)
+	}
+}
+
+func (c *dlqClient) printCount(method string, path string, query url.Values) error {
+	var counts map[string]int
+	if err := c.do(method, path, query, &counts); err != nil {
+		return err
+	}
+	for action, count := range counts {
+		fmt.Fprintf(c.out, "%s %d dead letters\n", action, count)
+	}
+	return nil
+}
+
+func (c *dlqClient) do(method string, path string, query url.Values, v interface{}) error {
+	u := c.baseURL + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequest(method, u, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(body))
+	}
+	return json.Unmarshal(body, v)
+}
+
+func printDeadLetters(out io.Writer, deadLetters []*proxy.Delivery) {
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tTENANT\tMETHOD\tURL\tATTEMPTS\tSTATUS CODE\tREASON CODE\tFAILED AT")
+	for _, d := range deadLetters {
+		var failedAt string
+		if d.FinishedAt != nil {
+			failedAt = d.FinishedAt.Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%d\t%d\t%s\n", d.ID, orDash(d.Tenant), d.Method, d.URL, d.Attempts, d.LastStatusCode, d.LastErrorCode, failedAt)
+	}
+	w.Flush()
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,203 @@
+/**
+ * Copyright (c) 2020 Ameya Lokare
+ */
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDLQCommand(t *testing.T) {
+	var requests []string
+	admin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Method+" "+r.URL.RequestURI())
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.URL.Path == "/dead-letters/missing":
+			http.Error(w, "No such dead letter", http.StatusNotFound)
+		case r.Method == http.MethodGet && r.URL.Path == "/dead-letters":
+			w.Write([]byte(`[{"id":"abc","tenant":"acme","method":"POST","url":"https://example.com/hook","attempts":3}]`))
+		case r.Method == http.MethodGet:
+			w.Write([]byte(`{"id":"abc","method":"POST","url":"https://example.com/hook"}`))
+		case r.Method == http.MethodDelete:
+			w.Write([]byte(`{"purged":1}`))
+		default:
+			w.Write([]byte(`{"replayed":1}`))
+		}
+	}))
+	defer admin.Close()
+	adminAddr := strings.TrimPrefix(admin.URL, "http://")
+
+	tests := []struct {
+		name     string
+		args     []string
+		status   int
+		requests []string
+		stdout   string
+		stderr   string
+	}{
+		{
+			name:     "List",
+			args:     []string{"list", "-admin", adminAddr},
+			requests: []string{"GET /dead-letters"},
+			stdout:   "https://example.com/hook",
+		},
+		{
+			name:     "List with filters",
+			args:     []string{"list", "-admin", adminAddr, "-host", "*.example.com", "-tenant", "acme", "-since", "2020-06-01T00:00:00Z"},
+			requests: []string{"GET /dead-letters?host=%2A.example.com&since=2020-06-01T00%3A00%3A00Z&tenant=acme"},
+			stdout:   "acme",
+		},
+		{
+			name:     "Show",
+			args:     []string{"show", "-admin", adminAddr, "abc"},
+			requests: []string{"GET /dead-letters/abc"},
+			stdout:   `"id": "abc"`,
+		},
+		{
+			name:     "Purge by ID",
+			args:     []string{"purge", "-admin", adminAddr, "abc"},
+			requests: []string{"DELETE /dead-letters/abc"},
+			stdout:   "purged 1 dead letters",
+		},
+		{
+			name:     "Purge by filter",
+			args:     []string{"purge", "-admin", adminAddr, "-tenant", "acme"},
+			requests: []string{"DELETE /dead-letters?tenant=acme"},
+			stdout:   "purged 1 dead letters",
+		},
+		{
+			name:     "Replay everything",
+			args:     []string{"replay", "-admin", adminAddr, "-all"},
+			requests: []string{"POST /dead-letters/replay?all=true"},
+			stdout:   "replayed 1 dead letters",
+		},
+		{
+			name:     "Replay by ID with flags after the ID",
+			args:     []string{"replay", "abc", "-admin", adminAddr},
+			requests: []string{"POST /dead-letters/abc/replay"},
+			stdout:   "replayed 1 dead letters",
+		},
+		{
+			name:     "ID after the flag terminator",
+			args:     []string{"show", "-admin", adminAddr, "--", "-abc"},
+			requests: []string{"GET /dead-letters/-abc"},
+			stdout:   `"id": "abc"`,
+		},
+		{
+			name:   "Filter combined with an ID",
+			args:   []string{"replay", "abc", "-admin", adminAddr, "-since", "24h"},
+			status: 1,
+			stderr: "can't be combined with an ID",
+		},
+		{
+			name:   "All combined with an ID",
+			args:   []string{"purge", "-all", "abc", "-admin", adminAddr},
+			status: 1,
+			stderr: "can't be combined with an ID",
+		},
+		{
+			name:   "Show with a filter",
+			args:   []string{"show", "abc", "-admin", adminAddr, "-tenant", "acme"},
+			status: 1,
+			stderr: "show takes the ID of a dead letter, and no filter",
+		},
+		{
+			name:   "Show without an ID",
+			args:   []string{"show", "-admin", adminAddr},
+			status: 1,
+			stderr: "show takes the ID of a dead letter",
+		},
+		{
+			name:   "List with an ID",
+			args:   []string{"list", "abc", "-admin", adminAddr},
+			status: 1,
+			stderr: "unexpected arguments abc",
+		},
+		{
+			name:   "More than one ID",
+			args:   []string{"replay", "abc", "def", "-admin", adminAddr},
+			status: 1,
+			stderr: "unexpected arguments abc def",
+		},
+		{
+			name:   "Invalid time",
+			args:   []string{"list", "-admin", adminAddr, "-until", "yesterday"},
+			status: 1,
+			stderr: "invalid -until",
+		},
+		{
+			name:     "Admin error",
+			args:     []string{"show", "missing", "-admin", adminAddr},
+			status:   1,
+			requests: []string{"GET /dead-letters/missing"},
+			stderr:   "404 Not Found: No such dead letter",
+		},
+		{
+			name:   "Unknown flag",
+			args:   []string{"replay", "abc", "-bogus"},
+			status: 2,
+			stderr: "flag provided but not defined: -bogus",
+		},
+		{
+			name:   "Unknown command",
+			args:   []string{"resend"},
+			status: 2,
+			stderr: "Usage: whsentry dlq",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			requests = nil
+			var stdout, stderr bytes.Buffer
+			status := runDLQ(test.args, &stdout, &stderr)
+			if status != test.status {
+				t.Errorf("Expected exit status %d, but got %d: %s", test.status, status, stderr.String())
+			}
+			if strings.Join(requests, ", ") != strings.Join(test.requests, ", ") {
+				t.Errorf("Expected requests %v, but got %v", test.requests, requests)
+			}
+			if !strings.Contains(stdout.String(), test.stdout) {
+				t.Errorf("Expected output containing %q, but got %q", test.stdout, stdout.String())
+			}
+			if !strings.Contains(stderr.String(), test.stderr) {
+				t.Errorf("Expected errors containing %q, but got %q", test.stderr, stderr.String())
+			}
+		})
+	}
+}
+
+func TestParseTimeFlag(t *testing.T) {
+	now := time.Date(2020, 6, 2, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		value    string
+		expected time.Time
+		err      bool
+	}{
+		{value: "", expected: time.Time{}},
+		{value: "24h", expected: time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)},
+		{value: "90m", expected: time.Date(2020, 6, 2, 10, 30, 0, 0, time.UTC)},
+		{value: "2020-05-01T08:00:00Z", expected: time.Date(2020, 5, 1, 8, 0, 0, 0, time.UTC)},
+		{value: "2020-05-01", err: true},
+		{value: "yesterday", err: true},
+	}
+	for _, test := range tests {
+		actual, err := parseTimeFlag(test.value, now)
+		if test.err {
+			if err == nil {
+				t.Errorf("Expected an error parsing %q, but got %s", test.value, actual)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Unexpected error parsing %q: %s", test.value, err)
+		} else if !actual.Equal(test.expected) {
+			t.Errorf("Expected %q to parse as %s, but got %s", test.value, test.expected, actual)
+		}
+	}
+}
@@ -6,5 +6,8 @@ require (
 	github.com/google/uuid v1.1.2
 	github.com/prometheus/client_golang v1.7.1
 	github.com/sirupsen/logrus v1.6.0
+	go.etcd.io/bbolt v1.3.5
+	golang.org/x/crypto v0.10.0
+	golang.org/x/net v0.11.0
 	gopkg.in/yaml.v2 v2.3.0
 )
@@ -6,16 +6,22 @@ package main
 import (
 	"bufio"
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
 	"fmt"
 	"github.com/juggernaut/webhook-sentry/certutil"
 	"github.com/juggernaut/webhook-sentry/proxy"
+	"golang.org/x/crypto/bcrypt"
 	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
 	"net/url"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"testing"
@@ -28,6 +34,7 @@ const (
 	httpTargetServerPort                     = "12080"
 	httpsTargetServerPort                    = "12081"
 	httpsTargetServerWithClientCertCheckPort = "12089"
+	targetSigningSecret                      = "It's a Secret to Everybody"
 )
 
 type testFixture struct {
@@ -45,6 +52,8 @@ func (f *testFixture) setUp(t *testing.T) *http.Client {
 		f.certificates = certutil.NewCertificateFixtures(t)
 	}
 	proxyConfig := proxy.NewDefaultConfig()
+	// Target servers listen on ports that aren't allowed by default
+	proxyConfig.AllowedPorts = nil
 	if f.configSetup != nil {
 		f.configSetup(proxyConfig, f.certificates)
 	}
@@ -132,6 +141,53 @@ func TestPrivateNetworkForbidden(t *testing.T) {
 	fixture.tearDown(t)
 }
 
+func TestPortNotAllowed(t *testing.T) {
+	fixture := &testFixture{
+		configSetup: func(config *proxy.ProxyConfig, c *certutil.CertificateFixtures) {
+			config.InsecureSkipCidrDenyList = true
+			config.InsecureSkipCertVerification = true
+			config.MitmIssuerCert = c.RootCACert
+			config.AllowedPorts = []proxy.PortRange{{From: 443, To: 443}}
+		},
+		serversSetup: func(c *certutil.CertificateFixtures) []*http.Server {
+			return []*http.Server{startTargetServer(t), startTargetHTTPSServerWithInMemoryCert(t, c.ServerCert)}
+		},
+		transportSetup: func(tr *http.Transport, c *certutil.CertificateFixtures) {
+			tr.TLSClientConfig = &tls.Config{
+				RootCAs: c.RootCAs,
+			}
+		},
+	}
+
+	client := fixture.setUp(t)
+
+	t.Run("HTTP request to port not allowed", func(t *testing.T) {
+		resp, err := client.Get(fmt.Sprintf("http://localhost:%s/target", httpTargetServerPort))
+		if err != nil {
+			t.Fatalf("Error in GET request to target server via proxy: %s\n", err)
+		}
+		if resp.StatusCode != 403 {
+			t.Errorf("Expected status code 403, got %d\n", resp.StatusCode)
+		}
+		errorCode := resp.Header.Get(proxy.ReasonCodeHeader)
+		if errorCode != strconv.Itoa(int(proxy.PortNotAllowed)) {
+			t.Errorf("Expected errorCode %d, but found %s", proxy.PortNotAllowed, errorCode)
+		}
+	})
+
+	t.Run("CONNECT to port not allowed", func(t *testing.T) {
+		_, err := client.Get(fmt.Sprintf("https://localhost:%s/target", httpsTargetServerPort))
+		if err == nil {
+			t.Fatal("Expected CONNECT to fail because the port is not allowed, instead got no error")
+		}
+		if !strings.Contains(err.Error(), "Forbidden") {
+			t.Errorf("Expected error '%s' to contain string 'Forbidden'", err.Error())
+		}
+	})
+
+	fixture.tearDown(t)
+}
+
 func TestProxy(t *testing.T) {
 	fixture := &testFixture{
 		configSetup: func(config *proxy.ProxyConfig, c *certutil.CertificateFixtures) {
@@ -230,6 +286,58 @@ func TestHTTPSTargets(t *testing.T) {
 		}
 	})
 
+	t.Run("TLS metadata headers", func(t *testing.T) {
+		req, err := http.NewRequest("GET", fmt.Sprintf("http://localhost:%s/target", httpsTargetServerPort), nil)
+		if err != nil {
+			t.Fatalf("Failed to create new request: %s\n", err)
+		}
+		req.Header.Add("X-WHSentry-TLS", "true")
+		req.Header.Add("X-WHSentry-Metadata", "true")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("Error in GET request to target server via proxy: %s\n", err)
+		}
+		if resp.StatusCode != 200 {
+			t.Errorf("Expected status code 200, got %d\n", resp.StatusCode)
+		}
+		if upstreamIP := resp.Header.Get(proxy.UpstreamIPHeader); upstreamIP != "127.0.0.1" {
+			t.Errorf("Expected upstream IP 127.0.0.1, got %s\n", upstreamIP)
+		}
+		if tlsVersion := resp.Header.Get(proxy.TLSVersionHeader); !strings.HasPrefix(tlsVersion, "TLS 1.") {
+			t.Errorf("Unexpected TLS version %s\n", tlsVersion)
+		}
+		if resp.Header.Get(proxy.TLSCipherHeader) == "" {
+			t.Errorf("TLS cipher header not present")
+		}
+		serverCert, err := x509.ParseCertificate(fixture.certificates.ServerCert.Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if subject := resp.Header.Get(proxy.PeerCertSubjectHeader); subject != serverCert.Subject.String() {
+			t.Errorf("Expected peer cert subject %s, got %s\n", serverCert.Subject, subject)
+		}
+		if expiry := resp.Header.Get(proxy.PeerCertExpiryHeader); expiry != serverCert.NotAfter.UTC().Format(time.RFC3339) {
+			t.Errorf("Unexpected peer cert expiry %s\n", expiry)
+		}
+	})
+
+	t.Run("No TLS metadata headers unless requested", func(t *testing.T) {
+		req, err := http.NewRequest("GET", fmt.Sprintf("http://localhost:%s/target", httpsTargetServerPort), nil)
+		if err != nil {
+			t.Fatalf("Failed to create new request: %s\n", err)
+		}
+		req.Header.Add("X-WHSentry-TLS", "true")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("Error in GET request to target server via proxy: %s\n", err)
+		}
+		for _, header := range []string{proxy.UpstreamIPHeader, proxy.TLSVersionHeader, proxy.TLSCipherHeader, proxy.PeerCertSubjectHeader, proxy.PeerCertExpiryHeader} {
+			if resp.Header.Get(header) != "" {
+				t.Errorf("Did not expect header %s in response\n", header)
+			}
+		}
+	})
+
 	t.Run("Unknown client cert", func(t *testing.T) {
 		req, err := http.NewRequest("GET", fmt.Sprintf("http://localhost:%s/target", httpsTargetServerWithClientCertCheckPort), nil)
 		if err != nil {
@@ -308,6 +416,300 @@ func TestHTTPSTargets(t *testing.T) {
 
 }
 
+func TestProxyAuthentication(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("s3cret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var receivedProxyAuthorization string
+	fixture := &testFixture{
+		configSetup: func(config *proxy.ProxyConfig, c *certutil.CertificateFixtures) {
+			config.InsecureSkipCidrDenyList = true
+			config.MitmIssuerCert = c.RootCACert
+			config.ProxyAuth.Credentials = map[string][]byte{"alice": hash}
+			config.ProxyAuth.BearerTokens = map[string]string{"ci": "token-1"}
+		},
+		serversSetup: func(c *certutil.CertificateFixtures) []*http.Server {
+			serveMux := http.NewServeMux()
+			serveMux.HandleFunc("/target", func(w http.ResponseWriter, r *http.Request) {
+				receivedProxyAuthorization = r.Header.Get("Proxy-Authorization")
+				fmt.Fprint(w, "Hello from target")
+			})
+			server := &http.Server{Addr: "127.0.0.1:" + httpTargetServerPort, Handler: serveMux}
+			go server.ListenAndServe()
+			return []*http.Server{server}
+		},
+	}
+
+	client := fixture.setUp(t)
+
+	t.Run("No credentials", func(t *testing.T) {
+		resp, err := client.Get(fmt.Sprintf("http://localhost:%s/target", httpTargetServerPort))
+		if err != nil {
+			t.Fatalf("Error in GET request to target server via proxy: %s\n", err)
+		}
+		if resp.StatusCode != http.StatusProxyAuthRequired {
+			t.Errorf("Expected status code 407, got %d\n", resp.StatusCode)
+		}
+		if challenge := resp.Header.Get("Proxy-Authenticate"); challenge != `Basic realm="Webhook Sentry"` {
+			t.Errorf("Unexpected Proxy-Authenticate header %s\n", challenge)
+		}
+	})
+
+	t.Run("Basic credentials", func(t *testing.T) {
+		basicClient := &http.Client{Transport: &http.Transport{
+			Proxy: func(r *http.Request) (*url.URL, error) {
+				return url.Parse("http://alice:s3cret@" + proxyHttpAddress)
+			},
+		}}
+		resp, err := basicClient.Get(fmt.Sprintf("http://localhost:%s/target", httpTargetServerPort))
+		if err != nil {
+			t.Fatalf("Error in GET request to target server via proxy: %s\n", err)
+		}
+		if resp.StatusCode != 200 {
+			t.Errorf("Expected status code 200, got %d\n", resp.StatusCode)
+		}
+		if receivedProxyAuthorization != "" {
+			t.Errorf("Expected Proxy-Authorization to be stripped, but target received %s\n", receivedProxyAuthorization)
+		}
+	})
+
+	t.Run("Bearer token", func(t *testing.T) {
+		req, err := http.NewRequest("GET", fmt.Sprintf("http://localhost:%s/target", httpTargetServerPort), nil)
+		if err != nil {
+			t.Fatalf("Failed to create new request: %s\n", err)
+		}
+		req.Header.Add("Proxy-Authorization", "Bearer token-1")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("Error in GET request to target server via proxy: %s\n", err)
+		}
+		if resp.StatusCode != 200 {
+			t.Errorf("Expected status code 200, got %d\n", resp.StatusCode)
+		}
+	})
+
+	t.Run("CONNECT without credentials", func(t *testing.T) {
+		_, err := client.Get("https://localhost:" + httpsTargetServerPort)
+		if err == nil {
+			t.Fatal("Expected CONNECT to fail without credentials, instead got no error")
+		}
+		if !strings.Contains(err.Error(), "Proxy Authentication Required") {
+			t.Errorf("Expected error '%s' to contain string 'Proxy Authentication Required'", err.Error())
+		}
+	})
+
+	fixture.tearDown(t)
+}
+
+func TestTenants(t *testing.T) {
+	fixture := &testFixture{
+		configSetup: func(config *proxy.ProxyConfig, c *certutil.CertificateFixtures) {
+			config.InsecureSkipCidrDenyList = true
+			config.ProxyAuth.BearerTokens = map[string]string{"billing": "token-billing", "search": "token-search"}
+			config.Tenants = map[string]proxy.TenantConfig{
+				"search": {
+					Principals:   []string{"search"},
+					HostDenyList: []string{"localhost"},
+				},
+			}
+		},
+		serversSetup: func(c *certutil.CertificateFixtures) []*http.Server {
+			return []*http.Server{startTargetServer(t)}
+		},
+	}
+
+	client := fixture.setUp(t)
+
+	get := func(token string) *http.Response {
+		req, err := http.NewRequest("GET", fmt.Sprintf("http://localhost:%s/target", httpTargetServerPort), nil)
+		if err != nil {
+			t.Fatalf("Failed to create new request: %s\n", err)
+		}
+		req.Header.Add("Proxy-Authorization", "Bearer "+token)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("Error in GET request to target server via proxy: %s\n", err)
+		}
+		return resp
+	}
+
+	t.Run("Request without a tenant uses the top level settings", func(t *testing.T) {
+		resp := get("token-billing")
+		if resp.StatusCode != 200 {
+			t.Errorf("Expected status code 200, got %d\n", resp.StatusCode)
+		}
+	})
+
+	t.Run("Request from a tenant uses the tenant's settings", func(t *testing.T) {
+		resp := get("token-search")
+		if resp.StatusCode != 403 {
+			t.Errorf("Expected status code 403, got %d\n", resp.StatusCode)
+		}
+		errorCode := resp.Header.Get(proxy.ReasonCodeHeader)
+		if errorCode != strconv.Itoa(int(proxy.BlockedHostname)) {
+			t.Errorf("Expected errorCode %d, but found %s", proxy.BlockedHostname, errorCode)
+		}
+	})
+
+	fixture.tearDown(t)
+}
+
+func TestRateLimits(t *testing.T) {
+	fixture := &testFixture{
+		configSetup: func(config *proxy.ProxyConfig, c *certutil.CertificateFixtures) {
+			config.InsecureSkipCidrDenyList = true
+			config.RateLimits = proxy.RateLimitConfig{RequestsPerSecond: 0.01, Burst: 2}
+		},
+		serversSetup: func(c *certutil.CertificateFixtures) []*http.Server {
+			return []*http.Server{startTargetServer(t)}
+		},
+	}
+
+	client := fixture.setUp(t)
+
+	t.Run("Requests within the burst are proxied", func(t *testing.T) {
+		for i := 0; i < 2; i++ {
+			resp, err := client.Get(fmt.Sprintf("http://localhost:%s/target", httpTargetServerPort))
+			if err != nil {
+				t.Fatalf("Error in GET request to target server via proxy: %s\n", err)
+			}
+			if resp.StatusCode != 200 {
+				t.Errorf("Expected status code 200, got %d\n", resp.StatusCode)
+			}
+		}
+	})
+
+	t.Run("Request over the limit is rejected", func(t *testing.T) {
+		resp, err := client.Get(fmt.Sprintf("http://localhost:%s/target", httpTargetServerPort))
+		if err != nil {
+			t.Fatalf("Error in GET request to target server via proxy: %s\n", err)
+		}
+		if resp.StatusCode != 429 {
+			t.Errorf("Expected status code 429, got %d\n", resp.StatusCode)
+		}
+		errorCode := resp.Header.Get(proxy.ReasonCodeHeader)
+		if errorCode != strconv.Itoa(int(proxy.RateLimited)) {
+			t.Errorf("Expected errorCode %d, but found %s", proxy.RateLimited, errorCode)
+		}
+		if resp.Header.Get("Retry-After") != "100" {
+			t.Errorf("Expected Retry-After 100, but found %s", resp.Header.Get("Retry-After"))
+		}
+	})
+
+	fixture.tearDown(t)
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	fixture := &testFixture{
+		configSetup: func(config *proxy.ProxyConfig, c *certutil.CertificateFixtures) {
+			config.InsecureSkipCidrDenyList = true
+			config.CircuitBreaker = proxy.CircuitBreakerConfig{FailureThreshold: 2, Cooldown: time.Minute}
+		},
+		serversSetup: func(c *certutil.CertificateFixtures) []*http.Server {
+			return nil
+		},
+	}
+
+	client := fixture.setUp(t)
+
+	// Nothing listens on this port, so connections to it are refused
+	deadTarget := "http://localhost:12099/target"
+
+	t.Run("Connection failures are passed through until the breaker opens", func(t *testing.T) {
+		for i := 0; i < 2; i++ {
+			resp, err := client.Get(deadTarget)
+			if err != nil {
+				t.Fatalf("Error in GET request to target server via proxy: %s\n", err)
+			}
+			errorCode := resp.Header.Get(proxy.ReasonCodeHeader)
+			if errorCode != strconv.Itoa(int(proxy.TCPConnectionError)) {
+				t.Errorf("Expected errorCode %d, but found %s", proxy.TCPConnectionError, errorCode)
+			}
+		}
+	})
+
+	t.Run("Requests fail fast while the breaker is open", func(t *testing.T) {
+		resp, err := client.Get(deadTarget)
+		if err != nil {
+			t.Fatalf("Error in GET request to target server via proxy: %s\n", err)
+		}
+		if resp.StatusCode != 503 {
+			t.Errorf("Expected status code 503, got %d\n", resp.StatusCode)
+		}
+		errorCode := resp.Header.Get(proxy.ReasonCodeHeader)
+		if errorCode != strconv.Itoa(int(proxy.CircuitOpen)) {
+			t.Errorf("Expected errorCode %d, but found %s", proxy.CircuitOpen, errorCode)
+		}
+		if resp.Header.Get("Retry-After") == "" {
+			t.Errorf("Expected a Retry-After header")
+		}
+	})
+
+	fixture.tearDown(t)
+}
+
+func TestSigning(t *testing.T) {
+	fixture := &testFixture{
+		configSetup: func(config *proxy.ProxyConfig, c *certutil.CertificateFixtures) {
+			config.InsecureSkipCidrDenyList = true
+			config.SigningKeys = map[string]proxy.SigningKeyConfig{
+				"github": {Scheme: proxy.SigningSchemeHubSignature256, Secrets: []proxy.Secret{targetSigningSecret}},
+			}
+			config.MaxRequestBodySize = 64
+		},
+		serversSetup: func(c *certutil.CertificateFixtures) []*http.Server {
+			return []*http.Server{startTargetServer(t)}
+		},
+	}
+
+	client := fixture.setUp(t)
+
+	post := func(signingKey string, body string) *http.Response {
+		req, err := http.NewRequest("POST", fmt.Sprintf("http://localhost:%s/verify-signature", httpTargetServerPort), strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("Failed to create new request: %s\n", err)
+		}
+		req.Header.Add(proxy.SigningKeyHeader, signingKey)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("Error in POST request to target server via proxy: %s\n", err)
+		}
+		return resp
+	}
+
+	t.Run("Body is signed with the selected key", func(t *testing.T) {
+		resp := post("github", `{"event": "push"}`)
+		if resp.StatusCode != 200 {
+			t.Errorf("Expected status code 200, got %d\n", resp.StatusCode)
+		}
+	})
+
+	t.Run("Unknown signing key", func(t *testing.T) {
+		resp := post("gitlab", `{"event": "push"}`)
+		if resp.StatusCode != 400 {
+			t.Errorf("Expected status code 400, got %d\n", resp.StatusCode)
+		}
+		errorCode := resp.Header.Get(proxy.ReasonCodeHeader)
+		if errorCode != strconv.Itoa(int(proxy.SigningKeyNotFound)) {
+			t.Errorf("Expected errorCode %d, but found %s", proxy.SigningKeyNotFound, errorCode)
+		}
+	})
+
+	t.Run("Body longer than maxRequestBodySize", func(t *testing.T) {
+		resp := post("github", `{"event": "push", "padding": "`+strings.Repeat("x", 64)+`"}`)
+		if resp.StatusCode != 413 {
+			t.Errorf("Expected status code 413, got %d\n", resp.StatusCode)
+		}
+		errorCode := resp.Header.Get(proxy.ReasonCodeHeader)
+		if errorCode != strconv.Itoa(int(proxy.RequestTooLarge)) {
+			t.Errorf("Expected errorCode %d, but found %s", proxy.RequestTooLarge, errorCode)
+		}
+	})
+
+	fixture.tearDown(t)
+}
+
 func TestHttpConnectNotAllowedByDefault(t *testing.T) {
 	fixture := &testFixture{
 		configSetup: func(config *proxy.ProxyConfig, c *certutil.CertificateFixtures) {
@@ -531,6 +933,66 @@ func TestHTTPSProxyListener(t *testing.T) {
 	fixture.tearDown(t)
 }
 
+func TestHTTPSProxyListenerClientAuth(t *testing.T) {
+	certificates := certutil.NewCertificateFixtures(t)
+	caFile := filepath.Join(t.TempDir(), "client-ca.pem")
+	caPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificates.RootCACert.Certificate[0]})
+	if err := ioutil.WriteFile(caFile, caPem, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	config := proxy.NewDefaultConfig()
+	config.InsecureSkipCidrDenyList = true
+	config.AllowedPorts = nil
+	config.Listeners = []proxy.ListenerConfig{{
+		Address:      proxyHttpsAddress,
+		Type:         proxy.HTTPS,
+		ClientCAFile: caFile,
+		ClientAuth:   proxy.ClientAuthRequire,
+	}}
+	proxy.SetupLogging(config)
+	proxyServer := proxy.CreateProxyServers(config)[0]
+	proxyServer.TLSConfig.Certificates = []tls.Certificate{*certificates.ProxyCert}
+	listener, err := net.Listen("tcp4", proxyHttpsAddress)
+	if err != nil {
+		t.Fatalf("Could not start proxy listener: %s\n", err)
+	}
+	go proxyServer.ServeTLS(listener, "", "")
+	targetServer := startTargetServer(t)
+	waitForStartup(t, proxyHttpsAddress)
+	defer proxyServer.Shutdown(context.TODO())
+	defer targetServer.Shutdown(context.TODO())
+
+	newClient := func(clientCerts []tls.Certificate) *http.Client {
+		return &http.Client{Transport: &http.Transport{
+			Proxy: func(r *http.Request) (*url.URL, error) {
+				return url.Parse("https://" + proxyHttpsAddress)
+			},
+			TLSClientConfig: &tls.Config{
+				RootCAs:      certificates.RootCAs,
+				Certificates: clientCerts,
+			},
+		}}
+	}
+
+	t.Run("Client without certificate is rejected", func(t *testing.T) {
+		_, err := newClient(nil).Get(fmt.Sprintf("http://localhost:%s/target", httpTargetServerPort))
+		if err == nil {
+			t.Fatal("Expected request without a client certificate to fail, instead got no error")
+		}
+	})
+
+	t.Run("Client with certificate from client CA", func(t *testing.T) {
+		resp, err := newClient([]tls.Certificate{*certificates.ClientCert}).Get(fmt.Sprintf("http://localhost:%s/target", httpTargetServerPort))
+		if err != nil {
+			t.Fatalf("Error in GET request to target server via proxy: %s\n", err)
+		}
+		if resp.StatusCode != 200 {
+			t.Errorf("Expected status code 200, got %d\n", resp.StatusCode)
+		}
+	})
+}
+
 func TestContentLengthLimit(t *testing.T) {
 	maxContentLength := 8
 	fixture := &testFixture{
@@ -705,6 +1167,16 @@ func startTargetServer(t *testing.T) *http.Server {
 		w.Header().Set("X-Custom-Header", "custom")
 		fmt.Fprint(w, "Hello from target")
 	})
+	serveMux.HandleFunc("/verify-signature", func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mac := hmac.New(sha256.New, []byte(targetSigningSecret))
+		mac.Write(body)
+		if r.Header.Get("X-Hub-Signature-256") != "sha256="+hex.EncodeToString(mac.Sum(nil)) {
+			http.Error(w, "Bad signature", http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprint(w, "Signature verified")
+	})
 
 	server := &http.Server{
 		Addr:    "127.0.0.1:" + httpTargetServerPort,
@@ -0,0 +1,37 @@
+/**
+ * Copyright (c) 2020 Ameya Lokare
+ */
+package proxy
+
+import (
+	"net"
+	"net/http"
+)
+
+// StartAdminServer serves the admin endpoints for p on address
+func StartAdminServer(address string, p *Proxy) *http.Server {
+	server := &http.Server{
+		Addr:    address,
+		Handler: newAdminHandler(p),
+	}
+	listener, err := net.Listen(listenNetwork(address), address)
+	if err != nil {
+		log.Fatalf("Could not start admin listener: %s\n", err)
+	}
+	go func() {
+		if err := server.Serve(listener); err != http.ErrServerClosed {
+			log.Warnf("Admin server stopped: %s\n", err)
+		}
+	}()
+	return server
+}
+
+func newAdminHandler(p *Proxy) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/reload", p.handleReload)
+	mux.HandleFunc("/circuit-breakers", p.handleCircuitBreakers)
+	mux.HandleFunc(deadLettersPath, p.handleDeadLetters)
+	mux.HandleFunc(deadLettersPath+"/", p.handleDeadLetters)
+	mux.HandleFunc(jwksPath, p.keyRings.handleJWKS)
+	return mux
+}
@@ -0,0 +1,307 @@
+/**
+ * Copyright (c) 2020 Ameya Lokare
+ */
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const redacted = "REDACTED"
+
+// AuditConfig configures the audit trail, a JSON lines file recording each proxied request in full
+type AuditConfig struct {
+	// File is where records are written; auditing is disabled unless it is set
+	File                string `yaml:"file"`
+	MaxRequestBodySize  uint32 `yaml:"maxRequestBodySize"`
+	MaxResponseBodySize uint32 `yaml:"maxResponseBodySize"`
+	// RedactHeaders are request and response headers whose values are replaced with REDACTED
+	RedactHeaders []string `yaml:"redactHeaders"`
+	// RedactJSONFields are object keys, at any depth in JSON bodies, whose values are replaced with
+	// REDACTED
+	RedactJSONFields []string `yaml:"redactJSONFields"`
+	// MaxFileSize, MaxFileAge and MaxBackups control how the file is rotated
+	MaxFileSize int64         `yaml:"maxFileSize"`
+	MaxFileAge  time.Duration `yaml:"maxFileAge"`
+	MaxBackups  int           `yaml:"maxBackups"`
+}
+
+func validateAuditConfig(c AuditConfig) error {
+	if c.File == "" {
+		return nil
+	}
+	if c.MaxFileSize < 0 || c.MaxFileAge < 0 || c.MaxBackups < 0 {
+		return fmt.Errorf("Audit maxFileSize, maxFileAge and maxBackups must not be negative")
+	}
+	return nil
+}
+
+// auditSink writes audit records. It's owned by Proxy, like the access log.
+type auditSink struct {
+	maxRequestBodySize  uint32
+	maxResponseBodySize uint32
+	redactHeaders       map[string]bool
+	redactJSONFields    map[string]bool
+
+	mu   sync.Mutex
+	file *rotatingFile
+}
+
+func newAuditSink(config AuditConfig) (*auditSink, error) {
+	file, err := openRotatingFile(config.File, config.MaxFileSize, config.MaxFileAge, config.MaxBackups)
+	if err != nil {
+		return nil, fmt.Errorf("Error opening audit file %s: %s", config.File, err)
+	}
+	sink := &auditSink{
+		maxRequestBodySize:  config.MaxRequestBodySize,
+		maxResponseBodySize: config.MaxResponseBodySize,
+		redactHeaders:       make(map[string]bool),
+		redactJSONFields:    make(map[string]bool),
+		file:                file,
+	}
+	for _, header := range config.RedactHeaders {
+		sink.redactHeaders[http.CanonicalHeaderKey(header)] = true
+	}
+	for _, field := range config.RedactJSONFields {
+		sink.redactJSONFields[strings.ToLower(field)] = true
+	}
+	return sink, nil
+}
+
+func (s *auditSink) write(record *auditRecord) {
+	data, err := json.Marshal(record)
+	if err != nil {
+		logError(record.RequestID, "Error encoding audit record", err)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.file.Write(append(data, '\n')); err != nil {
+		logError(record.RequestID, "Error writing audit record", err)
+	}
+}
+
+func (s *auditSink) close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.file.Close()
+}
+
+type auditRecord struct {
+	Time       time.Time        `json:"time"`
+	RequestID  string           `json:"rq_id"`
+	ClientAddr string           `json:"client_addr"`
+	Principal  string           `json:"principal,omitempty"`
+	Tenant     string           `json:"tenant,omitempty"`
+	Method     string           `json:"method"`
+	URL        string           `json:"url"`
+	Request    *auditedMessage  `json:"request,omitempty"`
+	Response   *auditedResponse `json:"response,omitempty"`
+	// ResponseCode is what the client got, which is the proxy's if it couldn't get one from the target
+	ResponseCode int       `json:"response_code"`
+	ReasonCode   uint16    `json:"reason_code,omitempty"`
+	Reason       string    `json:"reason,omitempty"`
+	UpstreamIP   string    `json:"upstream_ip,omitempty"`
+	TLS          *auditTLS `json:"tls,omitempty"`
+	DurationMs   int64     `json:"duration_ms"`
+	// FinalURL and Redirects are set if redirects were followed
+	FinalURL  string   `json:"final_url,omitempty"`
+	Redirects []string `json:"redirects,omitempty"`
+}
+
+type auditedMessage struct {
+	Header http.Header `json:"headers"`
+	Body   string      `json:"body,omitempty"`
+	// BodyEncoding is base64 for bodies that aren't UTF-8
+	BodyEncoding  string `json:"body_encoding,omitempty"`
+	BodyTruncated bool   `json:"body_truncated,omitempty"`
+	// BodyOmitted is set when a JSON body couldn't be parsed to redact it, usually because it was
+	// truncated, so it's left out rather than risk recording a secret
+	BodyOmitted bool `json:"body_omitted,omitempty"`
+
+	body *cappedBuffer
+}
+
+type auditedResponse struct {
+	StatusCode int `json:"status_code"`
+	auditedMessage
+}
+
+type auditTLS struct {
+	Version         string `json:"version"`
+	Cipher          string `json:"cipher"`
+	PeerCertSubject string `json:"peer_cert_subject,omitempty"`
+	PeerCertExpiry  string `json:"peer_cert_expiry,omitempty"`
+}
+
+type auditRecordKey struct{}
+
+func withAuditRecord(ctx context.Context, record *auditRecord) context.Context {
+	return context.WithValue(ctx, auditRecordKey{}, record)
+}
+
+// auditRecordFrom returns the record for the request ctx belongs to, if it's being audited
+func auditRecordFrom(ctx context.Context) *auditRecord {
+	record, _ := ctx.Value(auditRecordKey{}).(*auditRecord)
+	return record
+}
+
+// captureRequest records the headers of the outbound request, and a copy of the body as it's sent
+func (s *auditSink) captureRequest(record *auditRecord, r *http.Request) {
+	record.Request = &auditedMessage{Header: r.Header.Clone(), body: &cappedBuffer{max: s.maxRequestBodySize}}
+	if r.Body != nil {
+		r.Body = &teeReadCloser{ReadCloser: r.Body, w: record.Request.body}
+	}
+}
+
+// captureResponse records the response headers, and a copy of the body as it's read
+func (s *auditSink) captureResponse(record *auditRecord, resp *http.Response) {
+	record.Response = &auditedResponse{
+		StatusCode:     resp.StatusCode,
+		auditedMessage: auditedMessage{Header: resp.Header.Clone(), body: &cappedBuffer{max: s.maxResponseBodySize}},
+	}
+	resp.Body = &teeReadCloser{ReadCloser: resp.Body, w: record.Response.body}
+}
+
+// finish fills in the outcome of the request, redacts the record and writes it
+func (s *auditSink) finish(record *auditRecord, responseCode int, errorCode uint16, errorMessage string, metadata *connMetadata, duration time.Duration) {
+	record.ResponseCode = responseCode
+	record.ReasonCode = errorCode
+	record.Reason = errorMessage
+	record.DurationMs = duration.Milliseconds()
+	if metadata != nil && metadata.conn != nil {
+		if tcpAddr, ok := metadata.conn.RemoteAddr().(*net.TCPAddr); ok {
+			record.UpstreamIP = tcpAddr.IP.String()
+		}
+		if tlsConn, ok := metadata.conn.(*tls.Conn); ok {
+			state := tlsConn.ConnectionState()
+			record.TLS = &auditTLS{Version: tlsVersionName(state.Version), Cipher: tls.CipherSuiteName(state.CipherSuite)}
+			if len(state.PeerCertificates) > 0 {
+				record.TLS.PeerCertSubject = state.PeerCertificates[0].Subject.String()
+				record.TLS.PeerCertExpiry = state.PeerCertificates[0].NotAfter.UTC().Format(time.RFC3339)
+			}
+		}
+	}
+	if record.Request != nil {
+		s.redact(record.Request)
+	}
+	if record.Response != nil {
+		s.redact(&record.Response.auditedMessage)
+	}
+	s.write(record)
+}
+
+func (s *auditSink) redact(m *auditedMessage) {
+	for name := range m.Header {
+		if s.redactHeaders[name] {
+			m.Header[name] = []string{redacted}
+		}
+	}
+	body, truncated := m.body.contents()
+	m.BodyTruncated = truncated
+	if len(body) == 0 {
+		return
+	}
+	if len(s.redactJSONFields) > 0 && isJSONContentType(m.Header.Get("Content-Type")) {
+		var v interface{}
+		decoder := json.NewDecoder(bytes.NewReader(body))
+		decoder.UseNumber()
+		if err := decoder.Decode(&v); err != nil {
+			m.BodyOmitted = true
+			return
+		}
+		var err error
+		if body, err = json.Marshal(s.redactJSON(v)); err != nil {
+			m.BodyOmitted = true
+			return
+		}
+	}
+	if utf8.Valid(body) {
+		m.Body = string(body)
+	} else {
+		m.Body = base64.StdEncoding.EncodeToString(body)
+		m.BodyEncoding = "base64"
+	}
+}
+
+func (s *auditSink) redactJSON(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for key, value := range v {
+			if s.redactJSONFields[strings.ToLower(key)] {
+				v[key] = redacted
+			} else {
+				v[key] = s.redactJSON(value)
+			}
+		}
+	case []interface{}:
+		for i, value := range v {
+			v[i] = s.redactJSON(value)
+		}
+	}
+	return v
+}
+
+func isJSONContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
+
+// cappedBuffer keeps the first max bytes written to it, and notes whether there were more. The
+// transport can still be sending the request body after the response has arrived, so it's locked.
+type cappedBuffer struct {
+	mu        sync.Mutex
+	buf       bytes.Buffer
+	max       uint32
+	truncated bool
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	room := int(b.max) - b.buf.Len()
+	if room < len(p) {
+		b.truncated = true
+		if room > 0 {
+			b.buf.Write(p[:room])
+		}
+		return len(p), nil
+	}
+	return b.buf.Write(p)
+}
+
+// contents returns a copy of what has been kept so far, and whether anything was left out
+func (b *cappedBuffer) contents() ([]byte, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]byte(nil), b.buf.Bytes()...), b.truncated
+}
+
+type teeReadCloser struct {
+	io.ReadCloser
+	w io.Writer
+}
+
+func (t *teeReadCloser) Read(p []byte) (int, error) {
+	n, err := t.ReadCloser.Read(p)
+	if n > 0 {
+		t.w.Write(p[:n])
+	}
+	return n, err
+}
@@ -0,0 +1,162 @@
+/**
+ * Copyright (c) 2020 Ameya Lokare
+ */
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRotatingFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "audit.log")
+	now := time.Date(2020, 11, 2, 10, 0, 0, 0, time.UTC)
+	f, err := openRotatingFile(path, 10, time.Hour, 2)
+	checkNoError(t, err)
+	defer f.Close()
+	f.now = func() time.Time { return now }
+
+	backups := func() []string {
+		matches, err := filepath.Glob(path + ".*")
+		checkNoError(t, err)
+		return matches
+	}
+
+	_, err = f.Write([]byte("12345678"))
+	checkNoError(t, err)
+	assertEqual(t, 0, len(backups()))
+
+	// Would go past maxSize
+	now = now.Add(time.Second)
+	_, err = f.Write([]byte("abc"))
+	checkNoError(t, err)
+	assertEqual(t, 1, len(backups()))
+	data, err := ioutil.ReadFile(path)
+	checkNoError(t, err)
+	assertEqual(t, "abc", string(data))
+
+	// Open for maxAge
+	now = now.Add(time.Hour)
+	_, err = f.Write([]byte("d"))
+	checkNoError(t, err)
+	assertEqual(t, 2, len(backups()))
+
+	now = now.Add(time.Hour)
+	_, err = f.Write([]byte("e"))
+	checkNoError(t, err)
+	rotated := backups()
+	assertEqual(t, 2, len(rotated))
+	// The oldest is removed
+	data, err = ioutil.ReadFile(rotated[0])
+	checkNoError(t, err)
+	assertEqual(t, "abc", string(data))
+
+	info, err := os.Stat(path)
+	checkNoError(t, err)
+	assertEqual(t, os.FileMode(0600), info.Mode().Perm())
+
+	// The file is still written to if it can't be moved aside
+	now = now.Add(time.Hour)
+	blocked := path + "." + now.Format(rotatedFileTimeFormat)
+	checkNoError(t, os.MkdirAll(filepath.Join(blocked, "taken"), 0700))
+	_, err = f.Write([]byte("f"))
+	if err == nil {
+		t.Fatalf("Expected an error rotating onto %s", blocked)
+	}
+	now = now.Add(time.Second)
+	_, err = f.Write([]byte("g"))
+	checkNoError(t, err)
+	rotated = backups()
+	data, err = ioutil.ReadFile(rotated[len(rotated)-1])
+	checkNoError(t, err)
+	assertEqual(t, "e", string(data))
+	data, err = ioutil.ReadFile(path)
+	checkNoError(t, err)
+	assertEqual(t, "g", string(data))
+}
+
+func TestAuditTrail(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Set-Cookie", "session=secret")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"id": 42, "token": "abc"}`))
+	}))
+	defer target.Close()
+
+	auditFile := filepath.Join(t.TempDir(), "audit.log")
+	config := NewDefaultConfig()
+	config.AllowedPorts = nil
+	config.InsecureSkipCidrDenyList = true
+	config.Audit.File = auditFile
+	config.Audit.RedactJSONFields = []string{"password", "token"}
+	config.Audit.MaxRequestBodySize = 80
+	checkNoError(t, config.validate())
+	p := NewProxy(config, "")
+
+	send := func(body string, contentType string) {
+		r := httptest.NewRequest("POST", target.URL+"/events", strings.NewReader(body))
+		r.Header.Set("Content-Type", contentType)
+		r.Header.Set("Authorization", "Bearer secret")
+		p.currentHandler().ServeHTTP(httptest.NewRecorder(), r)
+	}
+	send(`{"user": {"name": "a", "password": "hunter2"}, "tags": [{"token": "x"}]}`, "application/json")
+	send(`{"user": {"name": "`+strings.Repeat("a", 100)+`"}}`, "application/json")
+	send(strings.Repeat("x", 100), "text/plain")
+	r := httptest.NewRequest("GET", "http://127.0.0.1:1/", nil)
+	p.currentHandler().ServeHTTP(httptest.NewRecorder(), r)
+	checkNoError(t, p.Shutdown(context.Background()))
+
+	f, err := os.Open(auditFile)
+	checkNoError(t, err)
+	defer f.Close()
+	var records []map[string]interface{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var record map[string]interface{}
+		checkNoError(t, json.Unmarshal(scanner.Bytes(), &record))
+		records = append(records, record)
+	}
+	assertEqual(t, 4, len(records))
+
+	t.Run("Redaction", func(t *testing.T) {
+		record := records[0]
+		request := record["request"].(map[string]interface{})
+		assertEqual(t, `{"tags":[{"token":"REDACTED"}],"user":{"name":"a","password":"REDACTED"}}`, request["body"])
+		assertEqual(t, "REDACTED", request["headers"].(map[string]interface{})["Authorization"].([]interface{})[0])
+		response := record["response"].(map[string]interface{})
+		assertEqual(t, float64(http.StatusCreated), response["status_code"])
+		assertEqual(t, `{"id":42,"token":"REDACTED"}`, response["body"])
+		assertEqual(t, "REDACTED", response["headers"].(map[string]interface{})["Set-Cookie"].([]interface{})[0])
+		assertEqual(t, "127.0.0.1", record["upstream_ip"])
+		assertEqual(t, target.URL+"/events", record["url"])
+	})
+
+	t.Run("Truncation", func(t *testing.T) {
+		request := records[1]["request"].(map[string]interface{})
+		assertEqual(t, true, request["body_truncated"])
+		assertEqual(t, true, request["body_omitted"])
+		assertEqual(t, nil, request["body"])
+
+		request = records[2]["request"].(map[string]interface{})
+		assertEqual(t, true, request["body_truncated"])
+		assertEqual(t, strings.Repeat("x", 80), request["body"])
+	})
+
+	t.Run("Errors", func(t *testing.T) {
+		record := records[3]
+		assertEqual(t, float64(TCPConnectionError), record["reason_code"])
+		assertEqual(t, float64(http.StatusBadGateway), record["response_code"])
+		assertEqual(t, nil, record["response"])
+	})
+}
@@ -0,0 +1,167 @@
+/**
+ * Copyright (c) 2020 Ameya Lokare
+ */
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ProxyAuthConfig configures the credentials clients must present in Proxy-Authorization
+type ProxyAuthConfig struct {
+	// CredentialsFile holds one username:bcrypt-hash pair per line, as written by htpasswd -B
+	CredentialsFile string `yaml:"credentialsFile"`
+	// BearerTokens maps the principal each token authenticates as to the token
+	BearerTokens map[string]string `yaml:"bearerTokens"`
+	Realm        string            `yaml:"realm"`
+	// Credentials maps usernames to bcrypt hashes, as loaded from CredentialsFile
+	Credentials map[string][]byte `yaml:"-"`
+}
+
+func (c ProxyAuthConfig) enabled() bool {
+	return c.CredentialsFile != "" || len(c.Credentials) > 0 || len(c.BearerTokens) > 0
+}
+
+func (p *ProxyConfig) loadProxyAuthCredentials() error {
+	if p.ProxyAuth.CredentialsFile == "" {
+		return nil
+	}
+	credentials, err := loadCredentialsFile(p.ProxyAuth.CredentialsFile)
+	if err != nil {
+		return fmt.Errorf("Error loading proxy credentials file %s: %s", p.ProxyAuth.CredentialsFile, err)
+	}
+	p.ProxyAuth.Credentials = credentials
+	return nil
+}
+
+func loadCredentialsFile(credentialsFile string) (map[string][]byte, error) {
+	f, err := os.Open(credentialsFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	credentials := make(map[string][]byte)
+	scanner := bufio.NewScanner(f)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.Index(line, ":")
+		if i <= 0 {
+			return nil, fmt.Errorf("line %d is not in the format username:hash", lineNum)
+		}
+		hash := []byte(line[i+1:])
+		if _, err := bcrypt.Cost(hash); err != nil {
+			return nil, fmt.Errorf("line %d does not have a bcrypt hash: %s", lineNum, err)
+		}
+		credentials[line[:i]] = hash
+	}
+	return credentials, scanner.Err()
+}
+
+// proxyAuthenticator checks the Proxy-Authorization header against Basic credentials and bearer
+// tokens
+type proxyAuthenticator struct {
+	realm        string
+	credentials  map[string][]byte
+	bearerTokens map[string]string
+	// verified remembers Basic credentials that have been checked, keyed by a hash of the
+	// username and password, since bcrypt is deliberately slow
+	verified     map[[sha256.Size]byte]string
+	verifiedLock sync.RWMutex
+}
+
+// newProxyAuthenticator returns nil if proxy authentication isn't configured
+func newProxyAuthenticator(config ProxyAuthConfig) *proxyAuthenticator {
+	if !config.enabled() {
+		return nil
+	}
+	return &proxyAuthenticator{
+		realm:        config.Realm,
+		credentials:  config.Credentials,
+		bearerTokens: config.BearerTokens,
+		verified:     make(map[[sha256.Size]byte]string),
+	}
+}
+
+// authenticate returns the principal the request's Proxy-Authorization header authenticates as
+func (a *proxyAuthenticator) authenticate(r *http.Request) (string, bool) {
+	authorization := r.Header.Get("Proxy-Authorization")
+	i := strings.Index(authorization, " ")
+	if i < 0 {
+		return "", false
+	}
+	scheme, credentials := authorization[:i], strings.TrimSpace(authorization[i+1:])
+	switch {
+	case strings.EqualFold(scheme, "Basic") && len(a.credentials) > 0:
+		return a.authenticateBasic(credentials)
+	case strings.EqualFold(scheme, "Bearer") && len(a.bearerTokens) > 0:
+		return a.authenticateBearer(credentials)
+	}
+	return "", false
+}
+
+func (a *proxyAuthenticator) authenticateBasic(credentials string) (string, bool) {
+	decoded, err := base64.StdEncoding.DecodeString(credentials)
+	if err != nil {
+		return "", false
+	}
+	i := bytes.IndexByte(decoded, ':')
+	if i < 0 {
+		return "", false
+	}
+	username, password := string(decoded[:i]), decoded[i+1:]
+	key := sha256.Sum256(decoded)
+
+	a.verifiedLock.RLock()
+	principal, ok := a.verified[key]
+	a.verifiedLock.RUnlock()
+	if ok {
+		return principal, true
+	}
+
+	hash, ok := a.credentials[username]
+	if !ok || bcrypt.CompareHashAndPassword(hash, password) != nil {
+		return "", false
+	}
+	a.verifiedLock.Lock()
+	a.verified[key] = username
+	a.verifiedLock.Unlock()
+	return username, true
+}
+
+func (a *proxyAuthenticator) authenticateBearer(token string) (string, bool) {
+	var principal string
+	for name, expected := range a.bearerTokens {
+		// Compare against every token so the time taken doesn't give away which one was close
+		if subtle.ConstantTimeCompare([]byte(token), []byte(expected)) == 1 {
+			principal = name
+		}
+	}
+	return principal, principal != ""
+}
+
+// challenge responds with a 407 that tells the client which schemes it can authenticate with
+func (a *proxyAuthenticator) challenge(w http.ResponseWriter) {
+	if len(a.credentials) > 0 {
+		w.Header().Add("Proxy-Authenticate", fmt.Sprintf("Basic realm=%q", a.realm))
+	}
+	if len(a.bearerTokens) > 0 {
+		w.Header().Add("Proxy-Authenticate", fmt.Sprintf("Bearer realm=%q", a.realm))
+	}
+	sendHTTPError(w, http.StatusProxyAuthRequired, ProxyAuthRequired, "Proxy authentication required")
+}
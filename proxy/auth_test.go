@@ -0,0 +1,115 @@
+/**
+ * Copyright (c) 2020 Ameya Lokare
+ */
+package proxy
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestProxyAuthenticator(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("s3cret"), bcrypt.MinCost)
+	checkNoError(t, err)
+	a := newProxyAuthenticator(ProxyAuthConfig{
+		Realm:        "Webhook Sentry",
+		Credentials:  map[string][]byte{"alice": hash},
+		BearerTokens: map[string]string{"ci": "token-1"},
+	})
+
+	authenticate := func(authorization string) (string, bool) {
+		r := httptest.NewRequest("GET", "http://example.com", nil)
+		if authorization != "" {
+			r.Header.Set("Proxy-Authorization", authorization)
+		}
+		return a.authenticate(r)
+	}
+	basic := func(userPass string) string {
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(userPass))
+	}
+
+	t.Run("Basic", func(t *testing.T) {
+		principal, ok := authenticate(basic("alice:s3cret"))
+		assertEqual(t, true, ok)
+		assertEqual(t, "alice", principal)
+		// Second time round comes from the cache
+		principal, ok = authenticate(basic("alice:s3cret"))
+		assertEqual(t, true, ok)
+		assertEqual(t, "alice", principal)
+	})
+
+	t.Run("Basic with wrong password", func(t *testing.T) {
+		_, ok := authenticate(basic("alice:wrong"))
+		assertEqual(t, false, ok)
+		_, ok = authenticate(basic("bob:s3cret"))
+		assertEqual(t, false, ok)
+		_, ok = authenticate("Basic not-base64!")
+		assertEqual(t, false, ok)
+	})
+
+	t.Run("Bearer", func(t *testing.T) {
+		principal, ok := authenticate("Bearer token-1")
+		assertEqual(t, true, ok)
+		assertEqual(t, "ci", principal)
+		_, ok = authenticate("Bearer token-2")
+		assertEqual(t, false, ok)
+	})
+
+	t.Run("Missing or unknown scheme", func(t *testing.T) {
+		_, ok := authenticate("")
+		assertEqual(t, false, ok)
+		_, ok = authenticate("Digest username=alice")
+		assertEqual(t, false, ok)
+	})
+
+	t.Run("Challenge", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		a.challenge(w)
+		assertEqual(t, http.StatusProxyAuthRequired, w.Code)
+		challenges := w.Header()["Proxy-Authenticate"]
+		assertEqual(t, 2, len(challenges))
+		assertEqual(t, `Basic realm="Webhook Sentry"`, challenges[0])
+		assertEqual(t, `Bearer realm="Webhook Sentry"`, challenges[1])
+		assertEqual(t, "1013", w.Header().Get(ReasonCodeHeader))
+	})
+
+	t.Run("Disabled", func(t *testing.T) {
+		if newProxyAuthenticator(NewDefaultConfig().ProxyAuth) != nil {
+			t.Fatalf("Expected no authenticator by default")
+		}
+	})
+}
+
+func TestCredentialsFile(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("s3cret"), bcrypt.MinCost)
+	checkNoError(t, err)
+	dir := t.TempDir()
+
+	t.Run("Valid file", func(t *testing.T) {
+		credentialsFile := filepath.Join(dir, "htpasswd")
+		checkNoError(t, ioutil.WriteFile(credentialsFile, []byte("# users\nalice:"+string(hash)+"\n\nbob:"+string(hash)+"\n"), 0600))
+		credentials, err := loadCredentialsFile(credentialsFile)
+		checkNoError(t, err)
+		assertEqual(t, 2, len(credentials))
+	})
+
+	t.Run("Hash that isn't bcrypt", func(t *testing.T) {
+		credentialsFile := filepath.Join(dir, "htpasswd-md5")
+		checkNoError(t, ioutil.WriteFile(credentialsFile, []byte("alice:$apr1$abc$def\n"), 0600))
+		_, err := loadCredentialsFile(credentialsFile)
+		assertError(t, "line 1 does not have a bcrypt hash", err)
+	})
+
+	t.Run("Malformed line", func(t *testing.T) {
+		credentialsFile := filepath.Join(dir, "htpasswd-malformed")
+		checkNoError(t, ioutil.WriteFile(credentialsFile, []byte("alice:"+string(hash)+"\nbob\n"), 0600))
+		_, err := loadCredentialsFile(credentialsFile)
+		assertError(t, "line 2 is not in the format username:hash", err)
+	})
+}
@@ -0,0 +1,216 @@
+/**
+ * Copyright (c) 2020 Ameya Lokare
+ */
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	circuitBreakerStateGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "circuit_breaker_state",
+		Help: "State of the circuit breaker for a destination host: 0 closed, 1 open, 2 half-open. Hosts without recent failures aren't reported.",
+	}, []string{"destination"})
+
+	circuitBreakerTripCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "circuit_breaker_trips",
+		Help: "The number of times a circuit breaker has opened",
+	})
+)
+
+// CircuitBreakerConfig configures the per-host circuit breaker, which fast-fails requests to hosts
+// that keep failing to connect instead of waiting out connectTimeout for each one
+type CircuitBreakerConfig struct {
+	// FailureThreshold is how many consecutive connection failures open the breaker; 0 disables it
+	FailureThreshold int `yaml:"failureThreshold"`
+	// Cooldown is how long the breaker stays open before a request is let through to try the host again
+	Cooldown time.Duration `yaml:"cooldown"`
+}
+
+func validateCircuitBreaker(c CircuitBreakerConfig) error {
+	if c.FailureThreshold < 0 {
+		return fmt.Errorf("Circuit breaker failureThreshold must not be negative")
+	}
+	if c.FailureThreshold > 0 && c.Cooldown <= 0 {
+		return fmt.Errorf("Circuit breaker cooldown must be positive")
+	}
+	return nil
+}
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	}
+	return "closed"
+}
+
+type hostBreaker struct {
+	state               breakerState
+	consecutiveFailures int
+	openedAt            time.Time
+	// probing is set while the one request allowed through a half-open breaker is in flight
+	probing bool
+}
+
+// circuitBreakers tracks the hosts that have failed recently. It outlives reloads, so that a
+// reload doesn't send a burst of requests to hosts that are known to be down.
+type circuitBreakers struct {
+	mu     sync.Mutex
+	config CircuitBreakerConfig
+	hosts  map[string]*hostBreaker
+	now    func() time.Time
+}
+
+func newCircuitBreakers(config CircuitBreakerConfig) *circuitBreakers {
+	return &circuitBreakers{config: config, hosts: make(map[string]*hostBreaker), now: time.Now}
+}
+
+// configure applies a reloaded config. Breakers that are open stay open, with the new cooldown.
+func (c *circuitBreakers) configure(config CircuitBreakerConfig) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.config = config
+	if config.FailureThreshold == 0 {
+		for host := range c.hosts {
+			c.forget(host)
+		}
+	}
+}
+
+// isBreakerFailure says whether a request failing with errorCode counts against the host
+func isBreakerFailure(errorCode uint16) bool {
+	return errorCode == TCPConnectionError || errorCode == RequestTimedOut || errorCode == TLSHandshakeError
+}
+
+// allow checks whether a request to host may go ahead. If it may, report must be called with the
+// request's error code (0 on success) once it's done. If it may not, the error says so and
+// retryAfter is how long until the breaker half-opens.
+func (c *circuitBreakers) allow(host string) (report func(errorCode uint16), retryAfter time.Duration, err error) {
+	if c == nil || host == "" {
+		return func(uint16) {}, 0, nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.config.FailureThreshold == 0 {
+		return func(uint16) {}, 0, nil
+	}
+	host = normalizeHost(host)
+	b, ok := c.hosts[host]
+	if !ok || b.state == breakerClosed {
+		return func(errorCode uint16) { c.record(host, errorCode) }, 0, nil
+	}
+	if b.state == breakerOpen {
+		if wait := b.openedAt.Add(c.config.Cooldown).Sub(c.now()); wait > 0 {
+			return nil, wait, circuitOpenError(host)
+		}
+		c.setState(host, b, breakerHalfOpen)
+	}
+	if b.probing {
+		return nil, time.Second, circuitOpenError(host)
+	}
+	b.probing = true
+	return func(errorCode uint16) { c.record(host, errorCode) }, 0, nil
+}
+
+func circuitOpenError(host string) error {
+	return &proxyError{statusCode: http.StatusServiceUnavailable, message: fmt.Sprintf("Circuit breaker open for %s", host), errorCode: CircuitOpen}
+}
+
+func (c *circuitBreakers) record(host string, errorCode uint16) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	b, ok := c.hosts[host]
+	switch {
+	case isBreakerFailure(errorCode):
+		if !ok {
+			b = &hostBreaker{}
+			c.hosts[host] = b
+		}
+		b.probing = false
+		b.consecutiveFailures++
+		if b.state == breakerHalfOpen || (b.state == breakerClosed && c.config.FailureThreshold > 0 && b.consecutiveFailures >= c.config.FailureThreshold) {
+			b.openedAt = c.now()
+			c.setState(host, b, breakerOpen)
+			circuitBreakerTripCounter.Inc()
+			log.Warnf("Circuit breaker opened for %s after %d consecutive failures\n", host, b.consecutiveFailures)
+		} else {
+			c.setState(host, b, b.state)
+		}
+	case errorCode == 0 || errorCode == ResponseTooLarge:
+		// The host responded, so it's healthy again
+		if ok {
+			if b.state != breakerClosed {
+				log.Infof("Circuit breaker closed for %s\n", host)
+			}
+			c.forget(host)
+		}
+	default:
+		// The request was stopped for reasons that say nothing about the host, like being blocked
+		// by policy, so let another request try
+		if ok {
+			b.probing = false
+		}
+	}
+}
+
+func (c *circuitBreakers) setState(host string, b *hostBreaker, state breakerState) {
+	b.state = state
+	circuitBreakerStateGauge.WithLabelValues(host).Set(float64(state))
+}
+
+func (c *circuitBreakers) forget(host string) {
+	delete(c.hosts, host)
+	circuitBreakerStateGauge.DeleteLabelValues(host)
+}
+
+type breakerStatus struct {
+	Host                string     `json:"host"`
+	State               string     `json:"state"`
+	ConsecutiveFailures int        `json:"consecutiveFailures"`
+	OpenedAt            *time.Time `json:"openedAt,omitempty"`
+	RetryAt             *time.Time `json:"retryAt,omitempty"`
+}
+
+// status lists the hosts that have failed since they last succeeded, sorted by host
+func (c *circuitBreakers) status() []breakerStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	statuses := make([]breakerStatus, 0, len(c.hosts))
+	for host, b := range c.hosts {
+		status := breakerStatus{Host: host, State: b.state.String(), ConsecutiveFailures: b.consecutiveFailures}
+		if b.state != breakerClosed {
+			openedAt := b.openedAt
+			retryAt := openedAt.Add(c.config.Cooldown)
+			status.OpenedAt, status.RetryAt = &openedAt, &retryAt
+		}
+		statuses = append(statuses, status)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Host < statuses[j].Host })
+	return statuses
+}
+
+func (p *Proxy) handleCircuitBreakers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Circuit breaker status must be a GET", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, p.breakers.status())
+}
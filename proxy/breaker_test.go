@@ -0,0 +1,125 @@
+/**
+ * Copyright (c) 2020 Ameya Lokare
+ */
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreakers(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	newBreakers := func() *circuitBreakers {
+		c := newCircuitBreakers(CircuitBreakerConfig{FailureThreshold: 2, Cooldown: 10 * time.Second})
+		c.now = func() time.Time { return now }
+		return c
+	}
+	fail := func(t *testing.T, c *circuitBreakers, host string, errorCode uint16) {
+		report, _, err := c.allow(host)
+		checkNoError(t, err)
+		report(errorCode)
+	}
+
+	t.Run("Opens after consecutive failures", func(t *testing.T) {
+		c := newBreakers()
+		fail(t, c, "example.com", TCPConnectionError)
+		fail(t, c, "example.com", RequestTimedOut)
+		_, retryAfter, err := c.allow("example.com")
+		assertError(t, "Circuit breaker open for example.com", err)
+		assertEqual(t, 10*time.Second, retryAfter)
+		assertEqual(t, CircuitOpen, err.(*proxyError).errorCode)
+
+		// Other hosts aren't affected
+		_, _, err = c.allow("other.example.com")
+		checkNoError(t, err)
+	})
+
+	t.Run("Success resets the count", func(t *testing.T) {
+		c := newBreakers()
+		fail(t, c, "example.com", TLSHandshakeError)
+		fail(t, c, "example.com", 0)
+		fail(t, c, "example.com", TLSHandshakeError)
+		_, _, err := c.allow("example.com")
+		checkNoError(t, err)
+	})
+
+	t.Run("Other errors don't count", func(t *testing.T) {
+		c := newBreakers()
+		fail(t, c, "example.com", BlockedIPAddress)
+		fail(t, c, "example.com", RateLimited)
+		fail(t, c, "example.com", CertificateValidationError)
+		_, _, err := c.allow("example.com")
+		checkNoError(t, err)
+		assertEqual(t, 0, len(c.status()))
+	})
+
+	t.Run("Half-opens after the cooldown", func(t *testing.T) {
+		c := newBreakers()
+		fail(t, c, "example.com", TCPConnectionError)
+		fail(t, c, "example.com", TCPConnectionError)
+		now = now.Add(10 * time.Second)
+
+		report, _, err := c.allow("example.com")
+		checkNoError(t, err)
+		assertEqual(t, "half-open", c.status()[0].State)
+		// Only one request tries the host at a time
+		_, _, err = c.allow("example.com")
+		assertError(t, "Circuit breaker open for example.com", err)
+
+		// A failed probe opens it again straight away
+		report(TCPConnectionError)
+		assertEqual(t, "open", c.status()[0].State)
+		now = now.Add(10 * time.Second)
+
+		report, _, err = c.allow("example.com")
+		checkNoError(t, err)
+		report(0)
+		assertEqual(t, 0, len(c.status()))
+	})
+
+	t.Run("Disabled on reload", func(t *testing.T) {
+		c := newBreakers()
+		fail(t, c, "example.com", TCPConnectionError)
+		fail(t, c, "example.com", TCPConnectionError)
+		c.configure(CircuitBreakerConfig{Cooldown: 10 * time.Second})
+		_, _, err := c.allow("example.com")
+		checkNoError(t, err)
+		assertEqual(t, 0, len(c.status()))
+	})
+
+	t.Run("Admin endpoint", func(t *testing.T) {
+		p := NewProxy(NewDefaultConfig(), "")
+		p.breakers = newBreakers()
+		fail(t, p.breakers, "example.com", TCPConnectionError)
+		fail(t, p.breakers, "example.com", TCPConnectionError)
+		fail(t, p.breakers, "flaky.example.com", TCPConnectionError)
+
+		admin := httptest.NewServer(newAdminHandler(p))
+		defer admin.Close()
+		resp, err := http.Get(admin.URL + "/circuit-breakers")
+		checkNoError(t, err)
+		defer resp.Body.Close()
+		assertEqual(t, http.StatusOK, resp.StatusCode)
+		var statuses []breakerStatus
+		checkNoError(t, json.NewDecoder(resp.Body).Decode(&statuses))
+		assertEqual(t, 2, len(statuses))
+		assertEqual(t, "example.com", statuses[0].Host)
+		assertEqual(t, "open", statuses[0].State)
+		assertEqual(t, now.Add(10*time.Second).Unix(), statuses[0].RetryAt.Unix())
+		assertEqual(t, "closed", statuses[1].State)
+		assertEqual(t, 1, statuses[1].ConsecutiveFailures)
+
+		resp, err = http.Post(admin.URL+"/circuit-breakers", "text/plain", nil)
+		checkNoError(t, err)
+		assertEqual(t, http.StatusMethodNotAllowed, resp.StatusCode)
+	})
+}
+
+func TestCircuitBreakerValidation(t *testing.T) {
+	_, err := UnmarshalConfig([]byte(`circuitBreaker: {failureThreshold: 5, cooldown: 0s}`))
+	assertError(t, "Circuit breaker cooldown must be positive", err)
+}
@@ -7,12 +7,14 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	_ "embed"
+	"encoding/pem"
 	"fmt"
 	"io/ioutil"
 	"net"
 	"strings"
 	"time"
 
+	"golang.org/x/crypto/pkcs12"
 	"gopkg.in/yaml.v2"
 )
 
@@ -32,45 +34,134 @@ cidrDenyList: [
 	"224.0.0.0/4",
 	"240.0.0.0/4"
 	]
+ipv6CidrDenyList: [
+	"::/128",
+	"::1/128",
+	"::ffff:0:0/96",
+	"64:ff9b::/96",
+	"64:ff9b:1::/48",
+	"100::/64",
+	"2001::/32",
+	"2001:db8::/32",
+	"fc00::/7",
+	"fe80::/10",
+	"fec0::/10",
+	"ff00::/8"
+	]
+allowedPorts: [80, 443, 8080, 8443]
 listeners:
   - type: http
     address: ":9090"
 connectTimeout: 10s
+dialMode: first
+dns:
+  protocol: udp
+  timeout: 5s
+  cache:
+    maxSize: 10000
+    maxTTL: 1h
+    negativeTTL: 30s
 connectionLifetime: 60s
 readTimeout: 10s
 insecureSkipCertVerification: false
 insecureSkipCidrDenyList: false
 maxResponseBodySize: 1048576
+maxRequestBodySize: 1048576
+circuitBreaker:
+  failureThreshold: 0
+  cooldown: 30s
+redirects:
+  follow: false
+  maxHops: 5
+connectionPool:
+  enabled: false
+  maxIdlePerHost: 10
+  idleTimeout: 90s
+  maxConnectionAge: 10m
+http2:
+  enabled: false
+delivery:
+  workers: 10
+  maxBodySize: 1048576
+  retention: 24h
+  retry:
+    maxAttempts: 8
+    initialBackoff: 1s
+    maxBackoff: 1h
+    multiplier: 2
+  receipts:
+    timeout: 10s
+    retry:
+      maxAttempts: 3
+      initialBackoff: 1s
+      maxBackoff: 10s
+      multiplier: 2
+idempotency:
+  header: Idempotency-Key
+  maxEntries: 10000
+audit:
+  maxRequestBodySize: 65536
+  maxResponseBodySize: 65536
+  redactHeaders: [Authorization, Proxy-Authorization, Cookie, Set-Cookie]
+  maxFileSize: 104857600
+  maxFileAge: 24h
+  maxBackups: 7
 accessLog:
   type: text
 proxyLog:
   type: text
+proxyAuth:
+  realm: Webhook Sentry
 metricsAddress: 127.0.0.1:2112
+shutdownTimeout: 30s
 requestIDHeader: Request-ID
 `
 
 type Cidr net.IPNet
 
 type ProxyConfig struct {
-	CidrDenyList                 []Cidr                     `yaml:"cidrDenyList"`
-	Listeners                    []ListenerConfig           `yaml:"listeners"`
-	ConnectTimeout               time.Duration              `yaml:"connectTimeout"`
-	ConnectionLifetime           time.Duration              `yaml:"connectionLifetime"`
-	ReadTimeout                  time.Duration              `yaml:"readTimeout"`
-	MaxResponseBodySize          uint32                     `yaml:"maxResponseBodySize"`
-	InsecureSkipCertVerification bool                       `yaml:"insecureSkipCertVerification"`
-	InsecureSkipCidrDenyList     bool                       `yaml:"insecureSkipCidrDenyList"`
-	ClientCertFile               string                     `yaml:"clientCertFile"`
-	ClientKeyFile                string                     `yaml:"clientKeyFile"`
-	ClientCerts                  map[string]tls.Certificate `yaml:"-"`
-	RootCACerts                  *x509.CertPool             `yaml:"-"` // TODO: not taking a file override yet
-	MitmIssuerCertFile           string                     `yaml:"mitmIssuerCertFile"`
-	MitmIssuerKeyFile            string                     `yaml:"mitmIssuerKeyFile"`
-	MitmIssuerCert               *tls.Certificate           `yaml:"-"`
-	AccessLog                    LogConfig                  `yaml:"accessLog"`
-	ProxyLog                     LogConfig                  `yaml:"proxyLog"`
-	MetricsAddress               string                     `yaml:"metricsAddress"`
-	RequestIDHeader string `yaml:"requestIDHeader"`
+	CidrDenyList                 []Cidr                      `yaml:"cidrDenyList"`
+	IPv6CidrDenyList             []Cidr                      `yaml:"ipv6CidrDenyList"`
+	CidrAllowList                []Cidr                      `yaml:"cidrAllowList"`
+	HostAllowList                []string                    `yaml:"hostAllowList"`
+	HostDenyList                 []string                    `yaml:"hostDenyList"`
+	AllowedPorts                 []PortRange                 `yaml:"allowedPorts"`
+	DeniedPorts                  []PortRange                 `yaml:"deniedPorts"`
+	Listeners                    []ListenerConfig            `yaml:"listeners"`
+	ConnectTimeout               time.Duration               `yaml:"connectTimeout"`
+	DialMode                     DialMode                    `yaml:"dialMode"`
+	DNS                          DNSConfig                   `yaml:"dns"`
+	ConnectionLifetime           time.Duration               `yaml:"connectionLifetime"`
+	ReadTimeout                  time.Duration               `yaml:"readTimeout"`
+	MaxResponseBodySize          uint32                      `yaml:"maxResponseBodySize"`
+	MaxRequestBodySize           uint32                      `yaml:"maxRequestBodySize"`
+	InsecureSkipCertVerification bool                        `yaml:"insecureSkipCertVerification"`
+	InsecureSkipCidrDenyList     bool                        `yaml:"insecureSkipCidrDenyList"`
+	ClientCertFile               string                      `yaml:"clientCertFile"`
+	ClientKeyFile                string                      `yaml:"clientKeyFile"`
+	ClientCertConfigs            map[string]ClientCertConfig `yaml:"clientCerts"`
+	ClientCerts                  map[string]tls.Certificate  `yaml:"-"`
+	RootCACerts                  *x509.CertPool              `yaml:"-"` // TODO: not taking a file override yet
+	MitmIssuerCertFile           string                      `yaml:"mitmIssuerCertFile"`
+	MitmIssuerKeyFile            string                      `yaml:"mitmIssuerKeyFile"`
+	MitmIssuerCert               *tls.Certificate            `yaml:"-"`
+	ProxyAuth                    ProxyAuthConfig             `yaml:"proxyAuth"`
+	Tenants                      map[string]TenantConfig     `yaml:"tenants"`
+	RateLimits                   RateLimitConfig             `yaml:"rateLimits"`
+	CircuitBreaker               CircuitBreakerConfig        `yaml:"circuitBreaker"`
+	Redirects                    RedirectConfig              `yaml:"redirects"`
+	ConnectionPool               ConnectionPoolConfig        `yaml:"connectionPool"`
+	HTTP2                        HTTP2Config                 `yaml:"http2"`
+	SigningKeys                  map[string]SigningKeyConfig `yaml:"signingKeys"`
+	Delivery                     DeliveryConfig              `yaml:"delivery"`
+	Idempotency                  IdempotencyConfig           `yaml:"idempotency"`
+	Audit                        AuditConfig                 `yaml:"audit"`
+	AccessLog                    LogConfig                   `yaml:"accessLog"`
+	ProxyLog                     LogConfig                   `yaml:"proxyLog"`
+	MetricsAddress               string                      `yaml:"metricsAddress"`
+	AdminAddress                 string                      `yaml:"adminAddress"`
+	ShutdownTimeout              time.Duration               `yaml:"shutdownTimeout"`
+	RequestIDHeader              string                      `yaml:"requestIDHeader"`
 }
 
 type Protocol string
@@ -81,10 +172,64 @@ const (
 )
 
 type ListenerConfig struct {
-	Address  string
-	Type     Protocol
-	CertFile string `yaml:"certFile"`
-	KeyFile  string `yaml:"keyFile"`
+	Address      string
+	Type         Protocol
+	CertFile     string         `yaml:"certFile"`
+	KeyFile      string         `yaml:"keyFile"`
+	ClientCAFile string         `yaml:"clientCAFile"`
+	ClientAuth   ClientAuthMode `yaml:"clientAuth"`
+}
+
+type ClientAuthMode string
+
+const (
+	// ClientAuthNone doesn't ask clients of an HTTPS listener for a certificate
+	ClientAuthNone ClientAuthMode = "none"
+	// ClientAuthRequest asks for a client certificate, and verifies it if one is presented
+	ClientAuthRequest ClientAuthMode = "request"
+	// ClientAuthRequire rejects clients that don't present a valid certificate
+	ClientAuthRequire ClientAuthMode = "require"
+)
+
+// ClientCertConfig is a named client certificate, given either as PEM certFile and keyFile, or as
+// a PKCS#12 bundle
+type ClientCertConfig struct {
+	CertFile       string `yaml:"certFile"`
+	KeyFile        string `yaml:"keyFile"`
+	PKCS12File     string `yaml:"pkcs12File"`
+	PKCS12Password string `yaml:"pkcs12Password"`
+}
+
+type DialMode string
+
+const (
+	// DialFirst connects to the first resolved address only, preferring IPv4
+	DialFirst DialMode = "first"
+	// DialSequential tries every allowed resolved address in order until one connects
+	DialSequential DialMode = "sequential"
+	// DialHappyEyeballs races the allowed resolved addresses across address families (RFC 8305)
+	DialHappyEyeballs DialMode = "happyEyeballs"
+)
+
+type DNSProtocol string
+
+const (
+	DNSOverUDP DNSProtocol = "udp"
+	DNSOverTCP DNSProtocol = "tcp"
+)
+
+type DNSConfig struct {
+	// Nameservers to query instead of the system resolver, as IP or IP:port
+	Nameservers []string       `yaml:"nameservers"`
+	Protocol    DNSProtocol    `yaml:"protocol"`
+	Timeout     time.Duration  `yaml:"timeout"`
+	Cache       DNSCacheConfig `yaml:"cache"`
+}
+
+type DNSCacheConfig struct {
+	MaxSize     int           `yaml:"maxSize"`
+	MaxTTL      time.Duration `yaml:"maxTTL"`
+	NegativeTTL time.Duration `yaml:"negativeTTL"`
 }
 
 type LogType string
@@ -116,6 +261,59 @@ func (config *ProxyConfig) validate() error {
 	if err := validateListeners(config.Listeners); err != nil {
 		return err
 	}
+	if err := validateHostPatterns(config.HostAllowList); err != nil {
+		return err
+	}
+	if err := validateHostPatterns(config.HostDenyList); err != nil {
+		return err
+	}
+	if err := validateDNSConfig(config.DNS); err != nil {
+		return err
+	}
+	if err := validateClientCertConfigs(config.ClientCertConfigs); err != nil {
+		return err
+	}
+	if err := validateTenants(config.Tenants); err != nil {
+		return err
+	}
+	if err := validateRateLimits(config.RateLimits); err != nil {
+		return err
+	}
+	if err := validateCircuitBreaker(config.CircuitBreaker); err != nil {
+		return err
+	}
+	if err := validateRedirectConfig(config.Redirects); err != nil {
+		return err
+	}
+	if err := validateConnectionPoolConfig(config.ConnectionPool); err != nil {
+		return err
+	}
+	if err := validateHTTP2Config(config.HTTP2, config.ConnectionPool); err != nil {
+		return err
+	}
+	if err := validateSigningKeys(config.SigningKeys); err != nil {
+		return err
+	}
+	if err := validateDeliveryConfig(config.Delivery); err != nil {
+		return err
+	}
+	if err := validateReceiptConfig(config.Delivery.Receipts, config.SigningKeys); err != nil {
+		return err
+	}
+	if err := validateIdempotencyConfig(config.Idempotency); err != nil {
+		return err
+	}
+	if err := validateAuditConfig(config.Audit); err != nil {
+		return err
+	}
+	if config.AdminAddress != "" {
+		if err := validateAddress(config.AdminAddress); err != nil {
+			return err
+		}
+	}
+	if config.DialMode != DialFirst && config.DialMode != DialSequential && config.DialMode != DialHappyEyeballs {
+		return fmt.Errorf("Invalid dial mode %s; must be one of 'first', 'sequential' or 'happyEyeballs'", config.DialMode)
+	}
 	return nil
 }
 
@@ -130,6 +328,17 @@ func validateListeners(listeners []ListenerConfig) error {
 		if l.Type == HTTPS && (l.CertFile == "" || l.KeyFile == "") {
 			return fmt.Errorf("Both certificate file and private key file must be specified for listener %s", l.Address)
 		}
+		if l.ClientAuth != "" && l.ClientAuth != ClientAuthNone && l.ClientAuth != ClientAuthRequest && l.ClientAuth != ClientAuthRequire {
+			return fmt.Errorf("Invalid client auth mode %s for listener %s; must be one of 'none', 'request' or 'require'", l.ClientAuth, l.Address)
+		}
+		if l.ClientAuth == ClientAuthRequest || l.ClientAuth == ClientAuthRequire {
+			if l.Type != HTTPS {
+				return fmt.Errorf("Client certificates can only be checked on https listeners, but listener %s is %s", l.Address, l.Type)
+			}
+			if l.ClientCAFile == "" {
+				return fmt.Errorf("clientCAFile must be specified for listener %s to check client certificates", l.Address)
+			}
+		}
 	}
 	return nil
 }
@@ -144,22 +353,143 @@ func validateAddress(address string) error {
 		if ip == nil {
 			return fmt.Errorf("Invalid listener address %s; it should be in the format IP:Port", address)
 		}
-		if strings.Count(ip.String(), ":") > 0 {
-			return fmt.Errorf("Invalid listener address %s; only IPv4 addresses are supported", address)
+	}
+	return nil
+}
+
+// listenNetwork returns the network to listen on for a listener address; IPv6
+// literals listen on tcp6, everything else (including a bare port) on tcp4
+func listenNetwork(address string) string {
+	host, _, err := net.SplitHostPort(address)
+	if err == nil && host != "" {
+		if ip := net.ParseIP(host); ip != nil && ip.To4() == nil {
+			return "tcp6"
+		}
+	}
+	return "tcp4"
+}
+
+func validateDNSConfig(dns DNSConfig) error {
+	if dns.Protocol != DNSOverUDP && dns.Protocol != DNSOverTCP {
+		return fmt.Errorf("Invalid DNS protocol %s; must be one of 'udp' or 'tcp'", dns.Protocol)
+	}
+	for _, nameserver := range dns.Nameservers {
+		host, _, err := net.SplitHostPort(nameserverAddress(nameserver))
+		if err != nil || net.ParseIP(host) == nil {
+			return fmt.Errorf("Invalid nameserver %s; it should be in the format IP or IP:Port", nameserver)
 		}
 	}
 	return nil
 }
 
-func (p *ProxyConfig) loadClientCert() error {
+func validateClientCertConfigs(certConfigs map[string]ClientCertConfig) error {
+	for alias, certConfig := range certConfigs {
+		if alias == "" {
+			return fmt.Errorf("Client certificate alias must not be empty")
+		}
+		hasPEM := certConfig.CertFile != "" || certConfig.KeyFile != ""
+		hasPKCS12 := certConfig.PKCS12File != ""
+		if hasPEM == hasPKCS12 {
+			return fmt.Errorf("Client certificate %s must specify either certFile and keyFile, or pkcs12File", alias)
+		}
+		if hasPEM && (certConfig.CertFile == "" || certConfig.KeyFile == "") {
+			return fmt.Errorf("Both certFile and keyFile must be specified for client certificate %s", alias)
+		}
+	}
+	return nil
+}
+
+func (p *ProxyConfig) loadClientCerts() error {
 	p.ClientCerts = make(map[string]tls.Certificate)
 	cert, err := loadCert(p.ClientCertFile, p.ClientKeyFile, "client")
 	if err != nil {
 		return err
 	}
 	if cert != nil {
+		if err := checkNotExpired(cert, "default"); err != nil {
+			return err
+		}
 		p.ClientCerts["default"] = *cert
 	}
+	for alias, certConfig := range p.ClientCertConfigs {
+		if _, found := p.ClientCerts[alias]; found {
+			return fmt.Errorf("Client certificate alias %s is already used by clientCertFile", alias)
+		}
+		cert, err := loadClientCert(alias, certConfig)
+		if err != nil {
+			return err
+		}
+		if err := checkNotExpired(cert, alias); err != nil {
+			return err
+		}
+		p.ClientCerts[alias] = *cert
+	}
+	return nil
+}
+
+func loadClientCert(alias string, certConfig ClientCertConfig) (*tls.Certificate, error) {
+	if certConfig.PKCS12File == "" {
+		cert, err := tls.LoadX509KeyPair(certConfig.CertFile, certConfig.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Error loading client certificate %s: %s", alias, err)
+		}
+		return &cert, nil
+	}
+	pkcs12Data, err := ioutil.ReadFile(certConfig.PKCS12File)
+	if err != nil {
+		return nil, fmt.Errorf("Error loading client certificate %s: %s", alias, err)
+	}
+	cert, err := parsePKCS12(pkcs12Data, certConfig.PKCS12Password)
+	if err != nil {
+		return nil, fmt.Errorf("Error loading client certificate %s: %s", alias, err)
+	}
+	return cert, nil
+}
+
+// parsePKCS12 decodes a PKCS#12 bundle holding a private key, its certificate and optionally the
+// rest of the chain
+func parsePKCS12(pkcs12Data []byte, password string) (*tls.Certificate, error) {
+	blocks, err := pkcs12.ToPEM(pkcs12Data, password)
+	if err != nil {
+		return nil, err
+	}
+	var keyPEM []byte
+	var keyID string
+	for _, block := range blocks {
+		if strings.HasSuffix(block.Type, "PRIVATE KEY") {
+			keyPEM = pem.EncodeToMemory(block)
+			keyID = block.Headers["localKeyId"]
+		}
+	}
+	// The leaf certificate must come first, so put the one that shares the key's ID ahead of the chain
+	var leafPEM, chainPEM []byte
+	for _, block := range blocks {
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		certPEM := pem.EncodeToMemory(&pem.Block{Type: block.Type, Bytes: block.Bytes})
+		if leafPEM == nil && (keyID == "" || block.Headers["localKeyId"] == keyID) {
+			leafPEM = certPEM
+		} else {
+			chainPEM = append(chainPEM, certPEM...)
+		}
+	}
+	cert, err := tls.X509KeyPair(append(leafPEM, chainPEM...), keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	return &cert, nil
+}
+
+func checkNotExpired(cert *tls.Certificate, alias string) error {
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return fmt.Errorf("Error parsing client certificate %s: %s", alias, err)
+	}
+	if time.Now().After(leaf.NotAfter) {
+		return fmt.Errorf("Client certificate %s expired on %s", alias, leaf.NotAfter.Format(time.RFC3339))
+	}
+	cert.Leaf = leaf
 	return nil
 }
 
@@ -221,12 +551,21 @@ func UnmarshalConfig(configData []byte) (*ProxyConfig, error) {
 }
 
 func InitConfig(config *ProxyConfig) error {
-	if err := config.loadClientCert(); err != nil {
+	if err := config.loadClientCerts(); err != nil {
 		return err
 	}
 	if err := config.loadMitmIssuerCert(); err != nil {
 		return err
 	}
+	if err := config.loadProxyAuthCredentials(); err != nil {
+		return err
+	}
+	if err := config.loadSigningSecrets(); err != nil {
+		return err
+	}
+	if err := config.loadTenantClientCerts(); err != nil {
+		return err
+	}
 	rootCerts := loadRootCABundle()
 	config.RootCACerts = rootCerts
 	return nil
@@ -4,6 +4,16 @@
 package proxy
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
@@ -47,8 +57,14 @@ func TestListenerValidation(t *testing.T) {
 		assertError(t, "should be in the format IP:Port", validateAddress("foohost:9090"))
 	})
 
-	t.Run("IPv6 is not valid", func(t *testing.T) {
-		assertError(t, "only IPv4 addresses are supported", validateAddress("[2001:db8::68]:11090"))
+	t.Run("IPv6 is valid", func(t *testing.T) {
+		checkNoError(t, validateAddress("[2001:db8::68]:11090"))
+	})
+
+	t.Run("Listen network", func(t *testing.T) {
+		assertEqual(t, "tcp4", listenNetwork(":9090"))
+		assertEqual(t, "tcp4", listenNetwork("127.0.0.1:9090"))
+		assertEqual(t, "tcp6", listenNetwork("[::1]:9090"))
 	})
 
 	t.Run("HTTPS needs both certFile and keyFile", func(t *testing.T) {
@@ -73,6 +89,7 @@ func TestYaml(t *testing.T) {
 		assertEqual(t, time.Duration(10)*time.Second, config.ConnectTimeout)
 		assertEqual(t, false, config.InsecureSkipCertVerification)
 		assertEqual(t, false, config.InsecureSkipCidrDenyList)
+		assertEqual(t, 12, len(config.IPv6CidrDenyList))
 	})
 
 	t.Run("Override config", func(t *testing.T) {
@@ -94,4 +111,138 @@ listeners:
 		// test defaults set for parameters that aren't overridden
 		assertEqual(t, time.Duration(10)*time.Second, config.ConnectTimeout)
 	})
+
+	t.Run("DNS config", func(t *testing.T) {
+		var data = `
+dns:
+  nameservers: ["1.1.1.1", "8.8.8.8:5353", "2606:4700:4700::1111"]
+  protocol: tcp
+`
+		config, err := UnmarshalConfig([]byte(data))
+		checkNoError(t, err)
+		assertEqual(t, 3, len(config.DNS.Nameservers))
+		assertEqual(t, DNSOverTCP, config.DNS.Protocol)
+		assertEqual(t, "[2606:4700:4700::1111]:53", nameserverAddress(config.DNS.Nameservers[2]))
+		// cache defaults are kept
+		assertEqual(t, 10000, config.DNS.Cache.MaxSize)
+		assertEqual(t, time.Duration(5)*time.Second, config.DNS.Timeout)
+	})
+
+	t.Run("Invalid nameserver", func(t *testing.T) {
+		_, err := UnmarshalConfig([]byte(`dns: {nameservers: ["dns.google"]}`))
+		assertError(t, "Invalid nameserver dns.google", err)
+	})
+}
+
+func TestClientCerts(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeClientCert(t, dir, "acme", time.Now().Add(time.Hour))
+	expiredCertFile, expiredKeyFile := writeClientCert(t, dir, "expired", time.Now().Add(-time.Hour))
+
+	t.Run("PEM and PKCS#12 client certs", func(t *testing.T) {
+		var data = fmt.Sprintf(`
+clientCerts:
+  acme:
+    certFile: %s
+    keyFile: %s
+  globex:
+    pkcs12File: testdata/client.p12
+    pkcs12Password: changeit
+`, certFile, keyFile)
+		config, err := UnmarshalConfig([]byte(data))
+		checkNoError(t, err)
+		assertEqual(t, 2, len(config.ClientCerts))
+		assertEqual(t, "acme", config.ClientCerts["acme"].Leaf.Subject.CommonName)
+		assertEqual(t, "pkcs12-client", config.ClientCerts["globex"].Leaf.Subject.CommonName)
+	})
+
+	t.Run("Expired client cert", func(t *testing.T) {
+		var data = fmt.Sprintf(`
+clientCerts:
+  expired:
+    certFile: %s
+    keyFile: %s
+`, expiredCertFile, expiredKeyFile)
+		_, err := UnmarshalConfig([]byte(data))
+		assertError(t, "Client certificate expired expired on", err)
+	})
+
+	t.Run("Wrong PKCS#12 password", func(t *testing.T) {
+		_, err := UnmarshalConfig([]byte(`clientCerts: {globex: {pkcs12File: testdata/client.p12, pkcs12Password: wrong}}`))
+		assertError(t, "Error loading client certificate globex", err)
+	})
+
+	t.Run("Missing file", func(t *testing.T) {
+		_, err := UnmarshalConfig([]byte(`clientCerts: {acme: {certFile: /nonexistent/cert.pem, keyFile: /nonexistent/key.pem}}`))
+		assertError(t, "Error loading client certificate acme", err)
+	})
+
+	t.Run("PEM and PKCS#12 are mutually exclusive", func(t *testing.T) {
+		_, err := UnmarshalConfig([]byte(`clientCerts: {acme: {certFile: cert.pem, keyFile: key.pem, pkcs12File: testdata/client.p12}}`))
+		assertError(t, "must specify either certFile and keyFile, or pkcs12File", err)
+	})
+
+	t.Run("Key file required", func(t *testing.T) {
+		_, err := UnmarshalConfig([]byte(`clientCerts: {acme: {certFile: cert.pem}}`))
+		assertError(t, "Both certFile and keyFile must be specified for client certificate acme", err)
+	})
+
+	t.Run("Alias clashes with clientCertFile", func(t *testing.T) {
+		var data = fmt.Sprintf(`
+clientCertFile: %s
+clientKeyFile: %s
+clientCerts:
+  default:
+    pkcs12File: testdata/client.p12
+    pkcs12Password: changeit
+`, certFile, keyFile)
+		_, err := UnmarshalConfig([]byte(data))
+		assertError(t, "alias default is already used by clientCertFile", err)
+	})
+}
+
+// writeClientCert writes a self-signed client certificate and its key to PEM files in dir
+func writeClientCert(t *testing.T, dir string, name string, notAfter time.Time) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	checkNoError(t, err)
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    notAfter.Add(-24 * time.Hour),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	certBytes, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	checkNoError(t, err)
+	keyBytes, err := x509.MarshalPKCS8PrivateKey(key)
+	checkNoError(t, err)
+
+	certFile := filepath.Join(dir, name+".pem")
+	keyFile := filepath.Join(dir, name+"-key.pem")
+	checkNoError(t, ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certBytes}), 0600))
+	checkNoError(t, ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyBytes}), 0600))
+	return certFile, keyFile
+}
+
+func TestListenerClientAuthValidation(t *testing.T) {
+	t.Run("Client auth needs a CA file", func(t *testing.T) {
+		_, err := UnmarshalConfig([]byte(`listeners: [{type: https, address: ":9091", certFile: cert.pem, keyFile: key.pem, clientAuth: require}]`))
+		assertError(t, "clientCAFile must be specified for listener :9091", err)
+	})
+
+	t.Run("Client auth needs an https listener", func(t *testing.T) {
+		_, err := UnmarshalConfig([]byte(`listeners: [{type: http, address: ":9090", clientAuth: request, clientCAFile: ca.pem}]`))
+		assertError(t, "Client certificates can only be checked on https listeners", err)
+	})
+
+	t.Run("Invalid client auth mode", func(t *testing.T) {
+		_, err := UnmarshalConfig([]byte(`listeners: [{type: https, address: ":9091", certFile: cert.pem, keyFile: key.pem, clientAuth: optional}]`))
+		assertError(t, "Invalid client auth mode optional", err)
+	})
+
+	t.Run("None needs nothing else", func(t *testing.T) {
+		_, err := UnmarshalConfig([]byte(`listeners: [{type: http, address: ":9090", clientAuth: none}]`))
+		checkNoError(t, err)
+	})
 }
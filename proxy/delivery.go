@@ -0,0 +1,498 @@
+/**
+ * Copyright (c) 2020 Ameya Lokare
+ */
+package proxy
+
+import (
+	"bytes"
+	"container/heap"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	pendingDeliveriesGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "pending_deliveries",
+		Help: "The number of asynchronous deliveries that haven't been delivered or given up on yet",
+	})
+
+	deliveryAttemptCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "delivery_attempts",
+		Help: "Asynchronous delivery attempts, by result",
+	}, []string{"result"})
+)
+
+// DeliveryConfig configures asynchronous delivery, where the proxy accepts a webhook, responds
+// straight away and delivers it in the background, retrying until the target accepts it
+type DeliveryConfig struct {
+	// StoreFile is where deliveries are kept until they're finished with; asynchronous delivery is
+	// disabled unless it is set
+	StoreFile   string `yaml:"storeFile"`
+	Workers     int    `yaml:"workers"`
+	MaxBodySize uint32 `yaml:"maxBodySize"`
+	// Retention is how long delivered deliveries are kept, so that their status can be looked up
+	Retention time.Duration `yaml:"retention"`
+	// Retry is the retry policy for deliveries that don't specify their own
+	Retry RetryPolicy `yaml:"retry"`
+	// Receipts are posted when deliveries finish, if a URL is set
+	Receipts ReceiptConfig `yaml:"receipts"`
+}
+
+// RetryPolicy says how often a delivery is attempted. The wait after each failed attempt grows by
+// Multiplier, up to MaxBackoff, with jitter so that retries to the same target are spread out.
+type RetryPolicy struct {
+	MaxAttempts    int           `yaml:"maxAttempts"`
+	InitialBackoff time.Duration `yaml:"initialBackoff"`
+	MaxBackoff     time.Duration `yaml:"maxBackoff"`
+	Multiplier     float64       `yaml:"multiplier"`
+}
+
+type retryPolicyJSON struct {
+	MaxAttempts    int     `json:"maxAttempts,omitempty"`
+	InitialBackoff string  `json:"initialBackoff,omitempty"`
+	MaxBackoff     string  `json:"maxBackoff,omitempty"`
+	Multiplier     float64 `json:"multiplier,omitempty"`
+}
+
+func (r RetryPolicy) MarshalJSON() ([]byte, error) {
+	return json.Marshal(retryPolicyJSON{
+		MaxAttempts:    r.MaxAttempts,
+		InitialBackoff: r.InitialBackoff.String(),
+		MaxBackoff:     r.MaxBackoff.String(),
+		Multiplier:     r.Multiplier,
+	})
+}
+
+// UnmarshalJSON only overwrites the fields that are present, so that a policy can be decoded onto
+// the default one
+func (r *RetryPolicy) UnmarshalJSON(data []byte) error {
+	var v retryPolicyJSON
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	if v.MaxAttempts != 0 {
+		r.MaxAttempts = v.MaxAttempts
+	}
+	if v.Multiplier != 0 {
+		r.Multiplier = v.Multiplier
+	}
+	var err error
+	if v.InitialBackoff != "" {
+		if r.InitialBackoff, err = time.ParseDuration(v.InitialBackoff); err != nil {
+			return fmt.Errorf("invalid initialBackoff: %s", err)
+		}
+	}
+	if v.MaxBackoff != "" {
+		if r.MaxBackoff, err = time.ParseDuration(v.MaxBackoff); err != nil {
+			return fmt.Errorf("invalid maxBackoff: %s", err)
+		}
+	}
+	return nil
+}
+
+func validateDeliveryConfig(c DeliveryConfig) error {
+	if c.Workers <= 0 {
+		return fmt.Errorf("Delivery workers must be positive")
+	}
+	if c.MaxBodySize == 0 {
+		return fmt.Errorf("Delivery maxBodySize must be positive")
+	}
+	if c.Retention < 0 {
+		return fmt.Errorf("Delivery retention must not be negative")
+	}
+	if err := validateRetryPolicy(c.Retry); err != nil {
+		return fmt.Errorf("Delivery retry policy: %s", err)
+	}
+	return nil
+}
+
+func validateRetryPolicy(r RetryPolicy) error {
+	if r.MaxAttempts < 1 {
+		return fmt.Errorf("maxAttempts must be at least 1")
+	}
+	if r.InitialBackoff <= 0 {
+		return fmt.Errorf("initialBackoff must be positive")
+	}
+	if r.MaxBackoff < r.InitialBackoff {
+		return fmt.Errorf("maxBackoff must not be less than initialBackoff")
+	}
+	if r.Multiplier < 1 {
+		return fmt.Errorf("multiplier must be at least 1")
+	}
+	return nil
+}
+
+// backoff returns how long to wait after the given number of failed attempts
+func (r RetryPolicy) backoff(attempts int, random *rand.Rand) time.Duration {
+	backoff := float64(r.InitialBackoff) * math.Pow(r.Multiplier, float64(attempts-1))
+	if backoff > float64(r.MaxBackoff) {
+		backoff = float64(r.MaxBackoff)
+	}
+	half := int64(backoff / 2)
+	return time.Duration(half + random.Int63n(half+1))
+}
+
+type DeliveryStatus string
+
+const (
+	DeliveryPending   DeliveryStatus = "pending"
+	DeliveryDelivered DeliveryStatus = "delivered"
+	DeliveryFailed    DeliveryStatus = "failed"
+)
+
+// Delivery is a webhook accepted for asynchronous delivery, along with how its delivery is going
+type Delivery struct {
+	ID        string         `json:"id"`
+	Tenant    string         `json:"tenant,omitempty"`
+	Principal string         `json:"principal,omitempty"`
+	URL       string         `json:"url"`
+	Method    string         `json:"method"`
+	Header    http.Header    `json:"header,omitempty"`
+	Body      []byte         `json:"body,omitempty"`
+	Retry     RetryPolicy    `json:"retry"`
+	Status    DeliveryStatus `json:"status"`
+	Attempts  int            `json:"attempts"`
+	CreatedAt time.Time      `json:"createdAt"`
+	// NextAttemptAt is when a pending delivery is next attempted
+	NextAttemptAt  *time.Time    `json:"nextAttemptAt,omitempty"`
+	LastAttemptAt  *time.Time    `json:"lastAttemptAt,omitempty"`
+	LastStatusCode int           `json:"lastStatusCode,omitempty"`
+	LastErrorCode  uint16        `json:"lastErrorCode,omitempty"`
+	LastError      string        `json:"lastError,omitempty"`
+	LastDuration   time.Duration `json:"lastDuration,omitempty"`
+	LastUpstreamIP string        `json:"lastUpstreamIP,omitempty"`
+	FinishedAt     *time.Time    `json:"finishedAt,omitempty"`
+}
+
+// isRetryable says whether an attempt that got statusCode and errorCode might succeed if tried again
+func isRetryable(statusCode int, errorCode uint16) bool {
+	switch errorCode {
+	case 0:
+		return statusCode >= 500 || statusCode == http.StatusTooManyRequests
+	case RequestTimedOut, TCPConnectionError, TLSHandshakeError, UnableToResolveIP, RateLimited, CircuitOpen:
+		return true
+	}
+	return false
+}
+
+// deliveryQueue attempts deliveries when they're due, with a fixed number of workers. The store is
+// the source of truth; the schedule is rebuilt from it on startup. A delivery is only marked as
+// finished after its attempt completes, so one that was in flight when the proxy stopped is
+// attempted again.
+type deliveryQueue struct {
+	config DeliveryConfig
+	store  *deliveryStore
+	// handler returns the handler deliveries are proxied with, so that they pick up reloads
+	handler func() *ProxyHTTPHandler
+	now     func() time.Time
+
+	mu       sync.Mutex
+	schedule deliverySchedule
+	random   *rand.Rand
+
+	wake     chan struct{}
+	work     chan string
+	stopping chan struct{}
+	workers  sync.WaitGroup
+
+	receiptClient *http.Client
+	receipts      sync.WaitGroup
+}
+
+func newDeliveryQueue(config DeliveryConfig, handler func() *ProxyHTTPHandler) (*deliveryQueue, error) {
+	store, err := openDeliveryStore(config.StoreFile)
+	if err != nil {
+		return nil, fmt.Errorf("Error opening delivery store %s: %s", config.StoreFile, err)
+	}
+	q := &deliveryQueue{
+		config:   config,
+		store:    store,
+		handler:  handler,
+		now:      time.Now,
+		random:   rand.New(rand.NewSource(time.Now().UnixNano())),
+		wake:     make(chan struct{}, 1),
+		work:     make(chan string),
+		stopping: make(chan struct{}),
+		receiptClient: &http.Client{
+			Timeout: config.Receipts.Timeout,
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}
+	var deadLetters int
+	err = store.forEach(func(d *Delivery) error {
+		if d.Status == DeliveryPending {
+			heap.Push(&q.schedule, scheduledDelivery{id: d.ID, at: *d.NextAttemptAt})
+		} else if d.Status == DeliveryFailed {
+			deadLetters++
+		}
+		return nil
+	})
+	if err != nil {
+		store.close()
+		return nil, fmt.Errorf("Error loading deliveries from %s: %s", config.StoreFile, err)
+	}
+	pendingDeliveriesGauge.Set(float64(q.schedule.Len()))
+	deadLettersGauge.Set(float64(deadLetters))
+	return q, nil
+}
+
+// start begins attempting deliveries
+func (q *deliveryQueue) start() {
+	for i := 0; i < q.config.Workers; i++ {
+		q.workers.Add(1)
+		go func() {
+			defer q.workers.Done()
+			for id := range q.work {
+				q.attempt(id)
+			}
+		}()
+	}
+	go q.dispatch()
+}
+
+// stop waits for attempts and receipts in flight to finish, or ctx to be done. Deliveries that
+// are still pending are attempted when the proxy next starts.
+func (q *deliveryQueue) stop(ctx context.Context) error {
+	close(q.stopping)
+	done := make(chan struct{})
+	go func() {
+		q.workers.Wait()
+		q.receipts.Wait()
+		q.store.close()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (q *deliveryQueue) submit(d *Delivery) error {
+	now := q.now()
+	d.Status = DeliveryPending
+	d.CreatedAt = now
+	d.NextAttemptAt = &now
+	if err := q.store.put(d); err != nil {
+		return err
+	}
+	pendingDeliveriesGauge.Inc()
+	q.scheduleAt(d.ID, now)
+	return nil
+}
+
+func (q *deliveryQueue) scheduleAt(id string, at time.Time) {
+	q.mu.Lock()
+	heap.Push(&q.schedule, scheduledDelivery{id: id, at: at})
+	q.mu.Unlock()
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// dispatch hands deliveries to the workers as they become due
+func (q *deliveryQueue) dispatch() {
+	defer close(q.work)
+	sweep := time.NewTicker(time.Minute)
+	defer sweep.Stop()
+	for {
+		id, wait := q.next()
+		if id != "" {
+			select {
+			case q.work <- id:
+				continue
+			case <-q.stopping:
+				return
+			}
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-q.wake:
+		case <-sweep.C:
+			q.sweep()
+		case <-q.stopping:
+			timer.Stop()
+			return
+		}
+		timer.Stop()
+	}
+}
+
+// next returns the next delivery that is due, or how long until one is
+func (q *deliveryQueue) next() (string, time.Duration) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.schedule.Len() == 0 {
+		return "", time.Hour
+	}
+	if wait := q.schedule[0].at.Sub(q.now()); wait > 0 {
+		return "", wait
+	}
+	return heap.Pop(&q.schedule).(scheduledDelivery).id, 0
+}
+
+func (q *deliveryQueue) attempt(id string) {
+	d, err := q.store.get(id)
+	if err != nil {
+		logError(id, "Error loading delivery", err)
+		return
+	}
+	if d == nil || d.Status != DeliveryPending {
+		return
+	}
+
+	handler := q.handler()
+	var statusCode int
+	var errorCode uint16
+	var errorMessage string
+	var upstreamIP string
+	start := q.now()
+	if d.Tenant != "" && handler.tenants[d.Tenant] == nil {
+		errorMessage = fmt.Sprintf("Tenant %s is no longer configured", d.Tenant)
+	} else {
+		if d.Tenant != "" {
+			handler = handler.tenants[d.Tenant]
+		}
+		statusCode, errorCode, errorMessage, upstreamIP = handler.deliver(d)
+	}
+	now := q.now()
+
+	d.Attempts++
+	d.LastAttemptAt = &now
+	d.LastStatusCode, d.LastErrorCode, d.LastError = statusCode, errorCode, errorMessage
+	d.LastDuration = now.Sub(start)
+	d.LastUpstreamIP = upstreamIP
+	d.NextAttemptAt = nil
+	result := "failed"
+	switch {
+	case errorCode == 0 && statusCode >= 200 && statusCode < 300:
+		result = "delivered"
+		d.Status = DeliveryDelivered
+		d.FinishedAt = &now
+	case isRetryable(statusCode, errorCode) && d.Attempts < d.Retry.MaxAttempts:
+		result = "retry"
+		q.mu.Lock()
+		next := now.Add(d.Retry.backoff(d.Attempts, q.random))
+		q.mu.Unlock()
+		d.NextAttemptAt = &next
+	default:
+		d.Status = DeliveryFailed
+		d.FinishedAt = &now
+		log.WithField("rq_id", d.ID).Warnf("Giving up on delivery to %s after %d attempts and dead-lettering it; last status %d, reason code %d\n", d.URL, d.Attempts, statusCode, errorCode)
+	}
+	deliveryAttemptCounter.With(prometheus.Labels{"result": result}).Inc()
+
+	if err := q.store.put(d); err != nil {
+		// The delivery is left as it was, so it's attempted again
+		logError(d.ID, "Error saving delivery", err)
+		return
+	}
+	if d.Status == DeliveryPending {
+		q.scheduleAt(d.ID, *d.NextAttemptAt)
+	} else {
+		pendingDeliveriesGauge.Dec()
+		q.sendReceipt(d)
+	}
+	if d.Status == DeliveryFailed {
+		deadLettersGauge.Inc()
+	}
+}
+
+// sweep deletes delivered deliveries that are past the retention period. Failed ones are kept
+// as dead letters until they're replayed or purged.
+func (q *deliveryQueue) sweep() {
+	cutoff := q.now().Add(-q.config.Retention)
+	_, err := q.store.deleteMatching(func(d *Delivery) bool {
+		return d.Status == DeliveryDelivered && d.FinishedAt.Before(cutoff)
+	})
+	if err != nil {
+		log.Warnf("Error deleting expired deliveries: %s\n", err)
+	}
+}
+
+// deliver makes one attempt at d, through the same path as proxied requests, and returns the
+// target's status code or the proxy's reason code for not getting one, along with the IP address
+// of the target if it was connected to
+func (p *ProxyHTTPHandler) deliver(d *Delivery) (int, uint16, string, string) {
+	target, err := url.Parse(d.URL)
+	if err != nil {
+		return 0, InvalidRequestURI, err.Error(), ""
+	}
+	header := d.Header.Clone()
+	if header == nil {
+		header = http.Header{}
+	}
+	header.Set(p.requestIDHeader, d.ID)
+	header.Set(MetadataHeader, "true")
+	r := &http.Request{
+		Method:        d.Method,
+		URL:           target,
+		RequestURI:    target.String(),
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          ioutil.NopCloser(bytes.NewReader(d.Body)),
+		ContentLength: int64(len(d.Body)),
+		Host:          target.Host,
+		RemoteAddr:    "async-delivery",
+	}
+	recorder := &deliveryRecorder{header: http.Header{}}
+	statusCode, errorCode, errorMessage := p.proxyRequest(recorder, r, &requestIdentity{principal: d.Principal, tenant: d.Tenant})
+	return statusCode, errorCode, errorMessage, recorder.header.Get(UpstreamIPHeader)
+}
+
+// deliveryRecorder is the http.ResponseWriter for delivery attempts. The response body is discarded.
+type deliveryRecorder struct {
+	header     http.Header
+	statusCode int
+}
+
+func (r *deliveryRecorder) Header() http.Header {
+	return r.header
+}
+
+func (r *deliveryRecorder) WriteHeader(statusCode int) {
+	if r.statusCode == 0 {
+		r.statusCode = statusCode
+	}
+}
+
+func (r *deliveryRecorder) Write(b []byte) (int, error) {
+	r.WriteHeader(http.StatusOK)
+	return len(b), nil
+}
+
+type scheduledDelivery struct {
+	id string
+	at time.Time
+}
+
+// deliverySchedule is a heap of deliveries, earliest first
+type deliverySchedule []scheduledDelivery
+
+func (s deliverySchedule) Len() int            { return len(s) }
+func (s deliverySchedule) Less(i, j int) bool  { return s[i].at.Before(s[j].at) }
+func (s deliverySchedule) Swap(i, j int)       { s[i], s[j] = s[j], s[i] }
+func (s *deliverySchedule) Push(x interface{}) { *s = append(*s, x.(scheduledDelivery)) }
+func (s *deliverySchedule) Pop() interface{} {
+	old := *s
+	x := old[len(old)-1]
+	*s = old[:len(old)-1]
+	return x
+}
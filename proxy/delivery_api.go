@@ -0,0 +1,165 @@
+/**
+ * Copyright (c) 2020 Ameya Lokare
+ */
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+const deliveriesPath = "/deliveries"
+
+// deliveryRequest is the body of a request to queue a webhook for asynchronous delivery
+type deliveryRequest struct {
+	URL     string            `json:"url"`
+	Method  string            `json:"method"`
+	Headers map[string]string `json:"headers"`
+	Body    string            `json:"body"`
+	// Retry overrides the fields of the default retry policy it sets
+	Retry json.RawMessage `json:"retry"`
+}
+
+// isDeliveriesRequest says whether r is for the deliveries API rather than to be proxied. Proxied
+// requests always have an absolute URI.
+func isDeliveriesRequest(r *http.Request) bool {
+	if r.Method == http.MethodConnect || r.URL.IsAbs() {
+		return false
+	}
+	return r.URL.Path == deliveriesPath || strings.HasPrefix(r.URL.Path, deliveriesPath+"/")
+}
+
+// serveAPI serves the deliveries API on the proxy listeners, so that deliveries are subject to the
+// same authentication and tenant policy as proxied requests. POST /deliveries queues a delivery and
+// responds with its ID, and GET /deliveries/{id} responds with its status.
+func (q *deliveryQueue) serveAPI(w http.ResponseWriter, r *http.Request, identity *requestIdentity, idempotency *idempotencyCache) {
+	if r.URL.Path == deliveriesPath {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Deliveries must be submitted with a POST", http.StatusMethodNotAllowed)
+			return
+		}
+		q.handleSubmit(w, r, identity, idempotency)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Delivery status must be a GET", http.StatusMethodNotAllowed)
+		return
+	}
+	q.handleStatus(w, strings.TrimPrefix(r.URL.Path, deliveriesPath+"/"), identity)
+}
+
+// handleSubmit queues a delivery. A submission with an idempotency key that duplicates an earlier
+// one for the same destination gets the response to that one, and isn't queued again.
+func (q *deliveryQueue) handleSubmit(w http.ResponseWriter, r *http.Request, identity *requestIdentity, idempotency *idempotencyCache) {
+	var request deliveryRequest
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, int64(q.config.MaxBodySize)))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&request); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid delivery: %s", err), http.StatusBadRequest)
+		return
+	}
+	d, err := q.newDelivery(request, identity)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid delivery: %s", err), http.StatusBadRequest)
+		return
+	}
+	target, _ := url.Parse(d.URL)
+	if key := idempotency.key(r, identity.tenant, target); key != "" {
+		idempotency.serve(w, r, key, q.config.MaxBodySize, func(w http.ResponseWriter) bool {
+			return q.accept(w, d)
+		})
+		return
+	}
+	q.accept(w, d)
+}
+
+// accept queues d and responds with its ID, and returns whether it was queued
+func (q *deliveryQueue) accept(w http.ResponseWriter, d *Delivery) bool {
+	if err := q.submit(d); err != nil {
+		logError(d.ID, "Error queueing delivery", err)
+		http.Error(w, "Error queueing delivery", http.StatusInternalServerError)
+		return false
+	}
+	w.Header().Set("Location", deliveriesPath+"/"+d.ID)
+	writeJSON(w, http.StatusAccepted, map[string]string{"id": d.ID, "status": string(d.Status)})
+	return true
+}
+
+func (q *deliveryQueue) newDelivery(request deliveryRequest, identity *requestIdentity) (*Delivery, error) {
+	target, err := url.Parse(request.URL)
+	if err != nil {
+		return nil, err
+	}
+	if !target.IsAbs() || target.Host == "" {
+		return nil, fmt.Errorf("url must be absolute")
+	}
+	if target.Scheme != "http" && target.Scheme != "https" {
+		return nil, fmt.Errorf("url scheme must be http or https")
+	}
+	method := request.Method
+	if method == "" {
+		method = http.MethodPost
+	}
+	if method == http.MethodConnect || strings.ContainsAny(method, " \t\r\n") {
+		return nil, fmt.Errorf("invalid method %q", method)
+	}
+	retry := q.config.Retry
+	if len(request.Retry) > 0 {
+		if err := json.Unmarshal(request.Retry, &retry); err != nil {
+			return nil, fmt.Errorf("invalid retry policy: %s", err)
+		}
+		if err := validateRetryPolicy(retry); err != nil {
+			return nil, fmt.Errorf("invalid retry policy: %s", err)
+		}
+	}
+	header := http.Header{}
+	for name, value := range request.Headers {
+		header.Set(name, value)
+	}
+	return &Delivery{
+		ID:        uuid.New().String(),
+		Tenant:    identity.tenant,
+		Principal: identity.principal,
+		URL:       target.String(),
+		Method:    method,
+		Header:    header,
+		Body:      []byte(request.Body),
+		Retry:     retry,
+	}, nil
+}
+
+func (q *deliveryQueue) handleStatus(w http.ResponseWriter, id string, identity *requestIdentity) {
+	d, err := q.store.get(id)
+	if err != nil {
+		logError(id, "Error loading delivery", err)
+		http.Error(w, "Error loading delivery", http.StatusInternalServerError)
+		return
+	}
+	// Deliveries belonging to other tenants are treated as not existing
+	if d == nil || d.Tenant != identity.tenant {
+		http.Error(w, "Delivery not found", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, d.summary())
+}
+
+// summary leaves out the headers and body, which can hold credentials
+func (d *Delivery) summary() *Delivery {
+	summary := *d
+	summary.Header = nil
+	summary.Body = nil
+	return &summary
+}
+
+func writeJSON(w http.ResponseWriter, statusCode int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Warnf("Error writing response: %s\n", err)
+	}
+}
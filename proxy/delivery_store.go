@@ -0,0 +1,144 @@
+/**
+ * Copyright (c) 2020 Ameya Lokare
+ */
+package proxy
+
+import (
+	"encoding/json"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var deliveriesBucket = []byte("deliveries")
+
+// deliveryStore persists deliveries in a bolt database, so that queued deliveries survive restarts
+type deliveryStore struct {
+	db *bolt.DB
+}
+
+func openDeliveryStore(storeFile string) (*deliveryStore, error) {
+	// Deliveries hold request headers and bodies, which may well contain credentials
+	db, err := bolt.Open(storeFile, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(deliveriesBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &deliveryStore{db: db}, nil
+}
+
+func (s *deliveryStore) put(d *Delivery) error {
+	data, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(deliveriesBucket).Put([]byte(d.ID), data)
+	})
+}
+
+// get returns nil if there's no delivery with id
+func (s *deliveryStore) get(id string) (*Delivery, error) {
+	var d *Delivery
+	err := s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(deliveriesBucket).Get([]byte(id))
+		if data == nil {
+			return nil
+		}
+		d = &Delivery{}
+		return json.Unmarshal(data, d)
+	})
+	return d, err
+}
+
+// deleteMatching deletes the deliveries match returns true for, and returns how many there were
+func (s *deliveryStore) deleteMatching(match func(d *Delivery) bool) (int, error) {
+	var deleted int
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(deliveriesBucket)
+		var keys [][]byte
+		err := b.ForEach(func(k, v []byte) error {
+			d := &Delivery{}
+			if err := json.Unmarshal(v, d); err != nil {
+				return err
+			}
+			if match(d) {
+				keys = append(keys, k)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		// Keys can't be deleted while iterating over the bucket
+		for _, k := range keys {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		deleted = len(keys)
+		return nil
+	})
+	return deleted, err
+}
+
+// updateMatching applies update to the deliveries match returns true for, in one transaction, and
+// returns the updated deliveries
+func (s *deliveryStore) updateMatching(match func(d *Delivery) bool, update func(d *Delivery)) ([]*Delivery, error) {
+	var updated []*Delivery
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(deliveriesBucket)
+		err := b.ForEach(func(k, v []byte) error {
+			d := &Delivery{}
+			if err := json.Unmarshal(v, d); err != nil {
+				return err
+			}
+			if match(d) {
+				update(d)
+				updated = append(updated, d)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, d := range updated {
+			data, err := json.Marshal(d)
+			if err != nil {
+				return err
+			}
+			if err := b.Put([]byte(d.ID), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return updated, nil
+}
+
+// forEach calls fn with every delivery, in no particular order
+func (s *deliveryStore) forEach(fn func(d *Delivery) error) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(deliveriesBucket).ForEach(func(k, v []byte) error {
+			d := &Delivery{}
+			if err := json.Unmarshal(v, d); err != nil {
+				return err
+			}
+			return fn(d)
+		})
+	})
+}
+
+func (s *deliveryStore) close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,193 @@
+/**
+ * Copyright (c) 2020 Ameya Lokare
+ */
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRetryPolicy(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 5, InitialBackoff: time.Second, MaxBackoff: 10 * time.Second, Multiplier: 2}
+
+	t.Run("Backoff", func(t *testing.T) {
+		random := rand.New(rand.NewSource(1))
+		for attempts, max := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 3: 4 * time.Second, 10: 10 * time.Second} {
+			for i := 0; i < 100; i++ {
+				backoff := policy.backoff(attempts, random)
+				if backoff < max/2 || backoff > max {
+					t.Fatalf("Expected backoff after %d attempts to be between %s and %s, got %s", attempts, max/2, max, backoff)
+				}
+			}
+		}
+	})
+
+	t.Run("JSON", func(t *testing.T) {
+		data, err := json.Marshal(policy)
+		checkNoError(t, err)
+		assertEqual(t, `{"maxAttempts":5,"initialBackoff":"1s","maxBackoff":"10s","multiplier":2}`, string(data))
+
+		overridden := policy
+		checkNoError(t, json.Unmarshal([]byte(`{"maxAttempts": 3, "maxBackoff": "1m"}`), &overridden))
+		assertEqual(t, RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Second, MaxBackoff: time.Minute, Multiplier: 2}, overridden)
+
+		assertError(t, "invalid initialBackoff", json.Unmarshal([]byte(`{"initialBackoff": "soon"}`), &overridden))
+	})
+
+	t.Run("Retryable", func(t *testing.T) {
+		assertEqual(t, true, isRetryable(http.StatusServiceUnavailable, 0))
+		assertEqual(t, true, isRetryable(http.StatusTooManyRequests, 0))
+		assertEqual(t, false, isRetryable(http.StatusBadRequest, 0))
+		assertEqual(t, true, isRetryable(http.StatusBadGateway, TCPConnectionError))
+		assertEqual(t, true, isRetryable(http.StatusBadGateway, RequestTimedOut))
+		assertEqual(t, false, isRetryable(http.StatusForbidden, BlockedIPAddress))
+		assertEqual(t, false, isRetryable(http.StatusBadGateway, ResponseTooLarge))
+	})
+}
+
+func newDeliveryTestProxy(t *testing.T, storeFile string) *Proxy {
+	config := NewDefaultConfig()
+	config.InsecureSkipCidrDenyList = true
+	config.AllowedPorts = nil
+	config.Delivery.StoreFile = storeFile
+	config.Delivery.Retry = RetryPolicy{MaxAttempts: 3, InitialBackoff: 10 * time.Millisecond, MaxBackoff: 20 * time.Millisecond, Multiplier: 2}
+	return NewProxy(config, "")
+}
+
+func submitDelivery(t *testing.T, p *Proxy, body string) string {
+	w := httptest.NewRecorder()
+	p.currentHandler().ServeHTTP(w, httptest.NewRequest("POST", "/deliveries", strings.NewReader(body)))
+	assertEqual(t, http.StatusAccepted, w.Code)
+	var response map[string]string
+	checkNoError(t, json.NewDecoder(w.Body).Decode(&response))
+	assertEqual(t, "/deliveries/"+response["id"], w.Header().Get("Location"))
+	return response["id"]
+}
+
+func waitForDelivery(t *testing.T, p *Proxy, id string, status DeliveryStatus) *Delivery {
+	for i := 0; i < 200; i++ {
+		w := httptest.NewRecorder()
+		p.currentHandler().ServeHTTP(w, httptest.NewRequest("GET", "/deliveries/"+id, nil))
+		assertEqual(t, http.StatusOK, w.Code)
+		d := &Delivery{}
+		checkNoError(t, json.NewDecoder(w.Body).Decode(d))
+		if d.Status == status {
+			return d
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Delivery %s never became %s", id, status)
+	return nil
+}
+
+func TestAsyncDelivery(t *testing.T) {
+	var requests int32
+	var lastBody atomic.Value
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		lastBody.Store(r.Method + " " + r.Header.Get("Content-Type") + " " + string(body))
+		switch {
+		case r.URL.Path == "/flaky" && atomic.AddInt32(&requests, 1) == 1:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case r.URL.Path == "/gone":
+			w.WriteHeader(http.StatusGone)
+		case r.URL.Path == "/down":
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer target.Close()
+
+	p := newDeliveryTestProxy(t, filepath.Join(t.TempDir(), "deliveries.db"))
+	defer p.deliveries.stop(context.Background())
+
+	t.Run("Delivered after a retry", func(t *testing.T) {
+		id := submitDelivery(t, p, `{"url": "`+target.URL+`/flaky", "headers": {"Content-Type": "application/json"}, "body": "{\"event\": \"paid\"}"}`)
+		d := waitForDelivery(t, p, id, DeliveryDelivered)
+		assertEqual(t, 2, d.Attempts)
+		assertEqual(t, http.StatusOK, d.LastStatusCode)
+		assertEqual(t, `POST application/json {"event": "paid"}`, lastBody.Load().(string))
+		if d.Body != nil || d.Header != nil {
+			t.Fatalf("Expected the status not to include the body and headers")
+		}
+	})
+
+	t.Run("Not retried on a client error", func(t *testing.T) {
+		id := submitDelivery(t, p, `{"url": "`+target.URL+`/gone", "method": "PUT"}`)
+		d := waitForDelivery(t, p, id, DeliveryFailed)
+		assertEqual(t, 1, d.Attempts)
+		assertEqual(t, http.StatusGone, d.LastStatusCode)
+	})
+
+	t.Run("Gives up after the max attempts", func(t *testing.T) {
+		id := submitDelivery(t, p, `{"url": "`+target.URL+`/down", "retry": {"maxAttempts": 2}}`)
+		d := waitForDelivery(t, p, id, DeliveryFailed)
+		assertEqual(t, 2, d.Attempts)
+		assertEqual(t, http.StatusInternalServerError, d.LastStatusCode)
+	})
+
+	t.Run("Retried on connection errors", func(t *testing.T) {
+		// Nothing listens on port 1
+		id := submitDelivery(t, p, `{"url": "http://127.0.0.1:1/"}`)
+		d := waitForDelivery(t, p, id, DeliveryFailed)
+		assertEqual(t, 3, d.Attempts)
+		assertEqual(t, TCPConnectionError, d.LastErrorCode)
+	})
+
+	t.Run("Invalid deliveries", func(t *testing.T) {
+		for body, message := range map[string]string{
+			`{"url": "/relative"}`:                                        "url must be absolute",
+			`{"url": "ftp://example.com"}`:                                "url scheme must be http or https",
+			`{"url": "http://example.com", "ttl": 1}`:                     "unknown field",
+			`{"url": "http://example.com", "retry": {"maxAttempts": -1}}`: "maxAttempts must be at least 1",
+		} {
+			w := httptest.NewRecorder()
+			p.currentHandler().ServeHTTP(w, httptest.NewRequest("POST", "/deliveries", strings.NewReader(body)))
+			assertEqual(t, http.StatusBadRequest, w.Code)
+			assertError(t, message, errorString(w.Body.String()))
+		}
+	})
+
+	t.Run("Unknown delivery", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		p.currentHandler().ServeHTTP(w, httptest.NewRequest("GET", "/deliveries/no-such-delivery", nil))
+		assertEqual(t, http.StatusNotFound, w.Code)
+	})
+}
+
+func TestDeliveriesSurviveRestart(t *testing.T) {
+	storeFile := filepath.Join(t.TempDir(), "deliveries.db")
+	p := newDeliveryTestProxy(t, storeFile)
+	// Nothing listens on port 1, and the backoff is long enough that it isn't retried before the stop
+	id := submitDelivery(t, p, `{"url": "http://127.0.0.1:1/", "retry": {"initialBackoff": "1h", "maxBackoff": "1h"}}`)
+	for i := 0; i < 200; i++ {
+		d, err := p.deliveries.store.get(id)
+		checkNoError(t, err)
+		if d.Attempts == 1 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	checkNoError(t, p.deliveries.stop(context.Background()))
+
+	q, err := newDeliveryQueue(p.config.Delivery, p.currentHandler)
+	checkNoError(t, err)
+	defer q.stop(context.Background())
+	assertEqual(t, 1, q.schedule.Len())
+	assertEqual(t, id, q.schedule[0].id)
+}
+
+type errorString string
+
+func (e errorString) Error() string {
+	return string(e)
+}
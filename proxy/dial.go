@@ -0,0 +1,291 @@
+/**
+ * Copyright (c) 2020 Ameya Lokare
+ */
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// connectionAttemptDelay is the time to wait for a connection attempt before starting the next
+// one in happy eyeballs mode, as recommended by RFC 8305
+const connectionAttemptDelay = 250 * time.Millisecond
+
+// minAttemptTimeout is the least amount of time given to a single connection attempt in
+// sequential mode, unless there's less time than that left altogether
+const minAttemptTimeout = 2 * time.Second
+
+type dialAttempt struct {
+	ip  net.IP
+	err error
+}
+
+type dialResult struct {
+	conn    net.Conn
+	attempt dialAttempt
+}
+
+// connectError is returned when none of the addresses a target resolved to could be connected to,
+// either because they are blocked or because connecting to them failed
+type connectError struct {
+	addr    string
+	blocked []net.IP
+	failed  []dialAttempt
+}
+
+func (c *connectError) Error() string {
+	if len(c.failed) == 0 {
+		if len(c.blocked) == 1 {
+			return fmt.Sprintf("IP %s is blocked", c.blocked[0])
+		}
+		return fmt.Sprintf("IPs %s are blocked", joinIPs(c.blocked))
+	}
+	var unreachable []string
+	for _, attempt := range c.failed {
+		err := attempt.err
+		if opErr, ok := err.(*net.OpError); ok && opErr.Err != nil {
+			err = opErr.Err
+		}
+		unreachable = append(unreachable, fmt.Sprintf("%s (%s)", attempt.ip, err))
+	}
+	message := fmt.Sprintf("Could not connect to %s; unreachable: %s", c.addr, strings.Join(unreachable, ", "))
+	if len(c.blocked) > 0 {
+		message += fmt.Sprintf("; blocked: %s", joinIPs(c.blocked))
+	}
+	return message
+}
+
+// timedOut is true if every failed connection attempt timed out
+func (c *connectError) timedOut() bool {
+	for _, attempt := range c.failed {
+		netErr, ok := attempt.err.(net.Error)
+		if !(ok && netErr.Timeout()) && attempt.err != context.DeadlineExceeded {
+			return false
+		}
+	}
+	return len(c.failed) > 0
+}
+
+func joinIPs(ips []net.IP) string {
+	var ipStrs []string
+	for _, ip := range ips {
+		ipStrs = append(ipStrs, ip.String())
+	}
+	return strings.Join(ipStrs, ", ")
+}
+
+// dialTCP connects to addr after checking its hostname and port against the host and port policies
+// and the addresses it resolves to against the deny list.
+// Depending on the dial mode, either only the first resolved address is tried, or every allowed
+// address is tried until one connects, all within the connect timeout.
+func (s *safeDialer) dialTCP(ctx context.Context, addr string) (net.Conn, error) {
+	if err := s.checkHost(addr); err != nil {
+		return nil, err
+	}
+	if err := s.checkPort(addr); err != nil {
+		return nil, err
+	}
+	ips, blocked, err := s.resolveAllowed(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	return s.dialAllowed(ctx, addr, ips, blocked)
+}
+
+// resolveAllowed resolves the hostname in addr and returns the addresses the dial mode may connect
+// to, in the order they're tried, along with the ones that were left out for being blocked
+func (s *safeDialer) resolveAllowed(ctx context.Context, addr string) ([]net.IP, []net.IP, error) {
+	if s.dialMode == DialFirst || s.dialMode == "" {
+		ipPort, err := s.resolveIPPort(ctx, addr)
+		if err != nil {
+			return nil, nil, err
+		}
+		host, _, err := net.SplitHostPort(ipPort)
+		if err != nil {
+			return nil, nil, err
+		}
+		return []net.IP{net.ParseIP(host)}, nil, nil
+	}
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	ips, err := s.lookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(ips) == 0 {
+		return nil, nil, &proxyError{statusCode: http.StatusBadRequest, message: fmt.Sprintf("Target %s did not resolve to a valid IP address", addr), errorCode: UnableToResolveIP}
+	}
+	var allowed, blocked []net.IP
+	for _, ip := range ips {
+		if s.isBlocked(ip.IP) {
+			blocked = append(blocked, ip.IP)
+		} else {
+			allowed = append(allowed, ip.IP)
+		}
+	}
+	if len(allowed) == 0 {
+		return nil, nil, &connectError{addr: addr, blocked: blocked}
+	}
+	if s.dialMode == DialHappyEyeballs {
+		allowed = interleaveFamilies(allowed)
+	}
+	return allowed, blocked, nil
+}
+
+// dialAllowed connects to one of ips, the allowed addresses resolveAllowed returned for addr
+func (s *safeDialer) dialAllowed(ctx context.Context, addr string, ips []net.IP, blocked []net.IP) (net.Conn, error) {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if s.dialMode == DialFirst || s.dialMode == "" {
+		return s.dialer.DialContext(ctx, "tcp", net.JoinHostPort(ips[0].String(), port))
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, s.dialer.Timeout)
+	defer cancel()
+	var conn net.Conn
+	var failed []dialAttempt
+	if s.dialMode == DialHappyEyeballs {
+		conn, failed = s.dialParallel(ctx, ips, port)
+	} else {
+		conn, failed = s.dialSerial(ctx, ips, port)
+	}
+	if conn == nil {
+		return nil, &connectError{addr: addr, blocked: blocked, failed: failed}
+	}
+	return conn, nil
+}
+
+// dialSerial tries each address in turn, giving each attempt a fair share of the remaining time
+func (s *safeDialer) dialSerial(ctx context.Context, ips []net.IP, port string) (net.Conn, []dialAttempt) {
+	var failed []dialAttempt
+	for i, ip := range ips {
+		attemptCtx, cancel := withPartialDeadline(ctx, len(ips)-i)
+		conn, err := s.dialer.DialContext(attemptCtx, "tcp", net.JoinHostPort(ip.String(), port))
+		cancel()
+		if err == nil {
+			return conn, nil
+		}
+		failed = append(failed, dialAttempt{ip: ip, err: err})
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, failed
+}
+
+// dialParallel starts a new connection attempt every connectionAttemptDelay (or as soon as the
+// previous one fails) and returns the first connection established, closing any others
+func (s *safeDialer) dialParallel(ctx context.Context, ips []net.IP, port string) (net.Conn, []dialAttempt) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan dialResult, len(ips))
+	next, pending := 0, 0
+	startNext := func() {
+		ip := ips[next]
+		next++
+		pending++
+		go func() {
+			conn, err := s.dialer.DialContext(ctx, "tcp", net.JoinHostPort(ip.String(), port))
+			results <- dialResult{conn: conn, attempt: dialAttempt{ip: ip, err: err}}
+		}()
+	}
+
+	timer := time.NewTimer(connectionAttemptDelay)
+	defer timer.Stop()
+	resetTimer := func() {
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(connectionAttemptDelay)
+	}
+
+	var failed []dialAttempt
+	startNext()
+	for pending > 0 {
+		select {
+		case result := <-results:
+			pending--
+			if result.attempt.err == nil {
+				go closeRemaining(results, pending)
+				return result.conn, nil
+			}
+			failed = append(failed, result.attempt)
+			if next < len(ips) {
+				startNext()
+				resetTimer()
+			}
+		case <-timer.C:
+			if next < len(ips) {
+				startNext()
+				timer.Reset(connectionAttemptDelay)
+			}
+		}
+	}
+	return nil, failed
+}
+
+// closeRemaining closes connections from attempts that completed after another attempt won the race
+func closeRemaining(results <-chan dialResult, pending int) {
+	for i := 0; i < pending; i++ {
+		if result := <-results; result.conn != nil {
+			result.conn.Close()
+		}
+	}
+}
+
+// interleaveFamilies reorders addresses so that address families alternate, starting with the
+// family of the first address, as described in RFC 8305 section 4
+func interleaveFamilies(ips []net.IP) []net.IP {
+	var first, second []net.IP
+	firstIsIPv4 := ips[0].To4() != nil
+	for _, ip := range ips {
+		if (ip.To4() != nil) == firstIsIPv4 {
+			first = append(first, ip)
+		} else {
+			second = append(second, ip)
+		}
+	}
+	interleaved := make([]net.IP, 0, len(ips))
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			interleaved = append(interleaved, first[i])
+		}
+		if i < len(second) {
+			interleaved = append(interleaved, second[i])
+		}
+	}
+	return interleaved
+}
+
+// withPartialDeadline returns a context whose deadline is an even share of the time left in ctx
+// across the remaining connection attempts
+func withPartialDeadline(ctx context.Context, attemptsRemaining int) (context.Context, context.CancelFunc) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return context.WithCancel(ctx)
+	}
+	timeRemaining := time.Until(deadline)
+	timeout := timeRemaining / time.Duration(attemptsRemaining)
+	if timeout < minAttemptTimeout {
+		if timeRemaining < minAttemptTimeout {
+			timeout = timeRemaining
+		} else {
+			timeout = minAttemptTimeout
+		}
+	}
+	return context.WithTimeout(ctx, timeout)
+}
@@ -0,0 +1,235 @@
+/**
+ * Copyright (c) 2020 Ameya Lokare
+ */
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const deadLettersPath = "/dead-letters"
+
+var (
+	deadLettersGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "dead_letters",
+		Help: "The number of failed asynchronous deliveries waiting to be replayed or purged",
+	})
+)
+
+// DeadLetterFilter selects dead-lettered deliveries. Zero fields match everything.
+type DeadLetterFilter struct {
+	// Host is a destination host pattern, in the same syntax as hostDenyList
+	Host   string
+	Tenant string
+	// Since and Until bound when deliveries failed
+	Since time.Time
+	Until time.Time
+}
+
+func (f DeadLetterFilter) isEmpty() bool {
+	return f.Host == "" && f.Tenant == "" && f.Since.IsZero() && f.Until.IsZero()
+}
+
+func (f DeadLetterFilter) matches(d *Delivery) bool {
+	if d.Status != DeliveryFailed {
+		return false
+	}
+	if f.Host != "" {
+		target, err := url.Parse(d.URL)
+		if err != nil || !matchesHostPattern([]string{normalizeHost(f.Host)}, normalizeHost(target.Hostname())) {
+			return false
+		}
+	}
+	if f.Tenant != "" && f.Tenant != d.Tenant {
+		return false
+	}
+	if !f.Since.IsZero() && d.FinishedAt.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && d.FinishedAt.After(f.Until) {
+		return false
+	}
+	return true
+}
+
+// parseDeadLetterFilter reads a filter from the host, tenant, since and until query parameters.
+// since and until are RFC 3339 timestamps.
+func parseDeadLetterFilter(query url.Values) (DeadLetterFilter, error) {
+	filter := DeadLetterFilter{Host: query.Get("host"), Tenant: query.Get("tenant")}
+	if filter.Host != "" {
+		if err := validateHostPatterns([]string{filter.Host}); err != nil {
+			return filter, err
+		}
+	}
+	var err error
+	if since := query.Get("since"); since != "" {
+		if filter.Since, err = time.Parse(time.RFC3339, since); err != nil {
+			return filter, fmt.Errorf("Invalid since: %s", err)
+		}
+	}
+	if until := query.Get("until"); until != "" {
+		if filter.Until, err = time.Parse(time.RFC3339, until); err != nil {
+			return filter, fmt.Errorf("Invalid until: %s", err)
+		}
+	}
+	return filter, nil
+}
+
+// Values is the inverse of parseDeadLetterFilter
+func (f DeadLetterFilter) Values() url.Values {
+	query := url.Values{}
+	if f.Host != "" {
+		query.Set("host", f.Host)
+	}
+	if f.Tenant != "" {
+		query.Set("tenant", f.Tenant)
+	}
+	if !f.Since.IsZero() {
+		query.Set("since", f.Since.Format(time.RFC3339))
+	}
+	if !f.Until.IsZero() {
+		query.Set("until", f.Until.Format(time.RFC3339))
+	}
+	return query
+}
+
+func (q *deliveryQueue) deadLetters(filter DeadLetterFilter) ([]*Delivery, error) {
+	var deadLetters []*Delivery
+	err := q.store.forEach(func(d *Delivery) error {
+		if filter.matches(d) {
+			deadLetters = append(deadLetters, d)
+		}
+		return nil
+	})
+	return deadLetters, err
+}
+
+func (q *deliveryQueue) purgeMatching(match func(d *Delivery) bool) (int, error) {
+	purged, err := q.store.deleteMatching(match)
+	deadLettersGauge.Sub(float64(purged))
+	return purged, err
+}
+
+// replayMatching queues the matching dead letters again, as if they had just been submitted. They
+// keep their IDs.
+func (q *deliveryQueue) replayMatching(match func(d *Delivery) bool) (int, error) {
+	now := q.now()
+	replayed, err := q.store.updateMatching(match, func(d *Delivery) {
+		d.Status = DeliveryPending
+		d.Attempts = 0
+		d.NextAttemptAt = &now
+		d.FinishedAt = nil
+	})
+	for _, d := range replayed {
+		q.scheduleAt(d.ID, now)
+	}
+	deadLettersGauge.Sub(float64(len(replayed)))
+	pendingDeliveriesGauge.Add(float64(len(replayed)))
+	return len(replayed), err
+}
+
+// handleDeadLetters serves the dead-letter endpoints on the admin listener:
+//
+// GET /dead-letters lists the dead letters matching the filter in the query parameters,
+// DELETE /dead-letters purges them and POST /dead-letters/replay replays them.
+// GET /dead-letters/{id} shows one in full, including its headers and body,
+// DELETE /dead-letters/{id} purges it and POST /dead-letters/{id}/replay replays it.
+func (p *Proxy) handleDeadLetters(w http.ResponseWriter, r *http.Request) {
+	if p.deliveries == nil {
+		http.Error(w, "Asynchronous delivery is not enabled", http.StatusNotFound)
+		return
+	}
+	q := p.deliveries
+	path := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, deadLettersPath), "/")
+	if path == "" || path == "replay" {
+		filter, err := parseDeadLetterFilter(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		switch {
+		case path == "" && r.Method == http.MethodGet:
+			deadLetters, err := q.deadLetters(filter)
+			if err != nil {
+				writeStoreError(w, err)
+				return
+			}
+			summaries := make([]*Delivery, 0, len(deadLetters))
+			for _, d := range deadLetters {
+				summaries = append(summaries, d.summary())
+			}
+			writeJSON(w, http.StatusOK, summaries)
+		case path == "" && r.Method == http.MethodDelete:
+			// Guard against purging everything by leaving out the filter by mistake
+			if filter.isEmpty() && r.URL.Query().Get("all") != "true" {
+				http.Error(w, "Specify a filter, or all=true to purge every dead letter", http.StatusBadRequest)
+				return
+			}
+			purged, err := q.purgeMatching(filter.matches)
+			if err != nil {
+				writeStoreError(w, err)
+				return
+			}
+			writeJSON(w, http.StatusOK, map[string]int{"purged": purged})
+		case path == "replay" && r.Method == http.MethodPost:
+			if filter.isEmpty() && r.URL.Query().Get("all") != "true" {
+				http.Error(w, "Specify a filter, or all=true to replay every dead letter", http.StatusBadRequest)
+				return
+			}
+			replayed, err := q.replayMatching(filter.matches)
+			if err != nil {
+				writeStoreError(w, err)
+				return
+			}
+			writeJSON(w, http.StatusOK, map[string]int{"replayed": replayed})
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	id := strings.TrimSuffix(path, "/replay")
+	d, err := q.store.get(id)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	if d == nil || d.Status != DeliveryFailed {
+		http.Error(w, "Dead letter not found", http.StatusNotFound)
+		return
+	}
+	byID := func(candidate *Delivery) bool {
+		return candidate.ID == id && candidate.Status == DeliveryFailed
+	}
+	switch {
+	case id == path && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, d)
+	case id == path && r.Method == http.MethodDelete:
+		purged, err := q.purgeMatching(byID)
+		if err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]int{"purged": purged})
+	case id != path && r.Method == http.MethodPost:
+		replayed, err := q.replayMatching(byID)
+		if err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]int{"replayed": replayed})
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func writeStoreError(w http.ResponseWriter, err error) {
+	log.Errorf("Error accessing delivery store: %s\n", err)
+	http.Error(w, "Error accessing delivery store", http.StatusInternalServerError)
+}
@@ -0,0 +1,119 @@
+/**
+ * Copyright (c) 2020 Ameya Lokare
+ */
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+)
+
+func TestDeadLetters(t *testing.T) {
+	var healthy int32
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&healthy) == 0 {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer target.Close()
+
+	p := newDeliveryTestProxy(t, filepath.Join(t.TempDir(), "deliveries.db"))
+	defer p.deliveries.stop(context.Background())
+	admin := newAdminHandler(p)
+
+	request := func(method string, path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		admin.ServeHTTP(w, httptest.NewRequest(method, path, nil))
+		return w
+	}
+	list := func(path string) []*Delivery {
+		w := request("GET", path)
+		assertEqual(t, http.StatusOK, w.Code)
+		var deadLetters []*Delivery
+		checkNoError(t, json.NewDecoder(w.Body).Decode(&deadLetters))
+		return deadLetters
+	}
+	count := func(w *httptest.ResponseRecorder, action string) int {
+		assertEqual(t, http.StatusOK, w.Code)
+		var counts map[string]int
+		checkNoError(t, json.NewDecoder(w.Body).Decode(&counts))
+		return counts[action]
+	}
+
+	rejected := submitDelivery(t, p, `{"url": "`+target.URL+`/rejected", "body": "hello"}`)
+	// Nothing listens on port 1
+	unreachable := submitDelivery(t, p, `{"url": "http://localhost:1/"}`)
+	delivered := submitDelivery(t, p, `{"url": "`+target.URL+`/rejected"}`)
+	waitForDelivery(t, p, rejected, DeliveryFailed)
+	waitForDelivery(t, p, unreachable, DeliveryFailed)
+	waitForDelivery(t, p, delivered, DeliveryFailed)
+	atomic.StoreInt32(&healthy, 1)
+	_, err := p.deliveries.replayMatching(func(d *Delivery) bool { return d.ID == delivered })
+	checkNoError(t, err)
+	waitForDelivery(t, p, delivered, DeliveryDelivered)
+	atomic.StoreInt32(&healthy, 0)
+
+	t.Run("List", func(t *testing.T) {
+		deadLetters := list("/dead-letters")
+		assertEqual(t, 2, len(deadLetters))
+		for _, d := range deadLetters {
+			if d.Body != nil || d.Header != nil {
+				t.Fatalf("Expected the list not to include bodies and headers")
+			}
+		}
+	})
+
+	t.Run("Filters", func(t *testing.T) {
+		byHost := list("/dead-letters?host=localhost")
+		assertEqual(t, 1, len(byHost))
+		assertEqual(t, unreachable, byHost[0].ID)
+		assertEqual(t, 0, len(list("/dead-letters?tenant=acme")))
+		assertEqual(t, 0, len(list("/dead-letters?since=2999-01-01T00:00:00Z")))
+		assertEqual(t, 2, len(list("/dead-letters?until=2999-01-01T00:00:00Z")))
+		assertEqual(t, http.StatusBadRequest, request("GET", "/dead-letters?since=yesterday").Code)
+	})
+
+	t.Run("Show", func(t *testing.T) {
+		w := request("GET", "/dead-letters/"+rejected)
+		assertEqual(t, http.StatusOK, w.Code)
+		d := &Delivery{}
+		checkNoError(t, json.NewDecoder(w.Body).Decode(d))
+		assertEqual(t, "hello", string(d.Body))
+		assertEqual(t, http.StatusBadRequest, d.LastStatusCode)
+
+		assertEqual(t, http.StatusNotFound, request("GET", "/dead-letters/no-such-delivery").Code)
+		// Delivered deliveries aren't dead letters
+		assertEqual(t, http.StatusNotFound, request("GET", "/dead-letters/"+delivered).Code)
+	})
+
+	t.Run("Purge and replay need a filter", func(t *testing.T) {
+		assertEqual(t, http.StatusBadRequest, request("DELETE", "/dead-letters").Code)
+		assertEqual(t, http.StatusBadRequest, request("POST", "/dead-letters/replay").Code)
+		assertEqual(t, 2, len(list("/dead-letters")))
+	})
+
+	t.Run("Replay", func(t *testing.T) {
+		atomic.StoreInt32(&healthy, 1)
+		assertEqual(t, 1, count(request("POST", "/dead-letters/"+rejected+"/replay"), "replayed"))
+		d := waitForDelivery(t, p, rejected, DeliveryDelivered)
+		assertEqual(t, 1, d.Attempts)
+		assertEqual(t, 1, len(list("/dead-letters")))
+		assertEqual(t, http.StatusNotFound, request("POST", "/dead-letters/"+rejected+"/replay").Code)
+	})
+
+	t.Run("Purge", func(t *testing.T) {
+		assertEqual(t, 0, count(request("DELETE", "/dead-letters?host=example.com"), "purged"))
+		assertEqual(t, 1, count(request("DELETE", "/dead-letters?host=localhost"), "purged"))
+		assertEqual(t, 0, len(list("/dead-letters")))
+		d, err := p.deliveries.store.get(unreachable)
+		checkNoError(t, err)
+		if d != nil {
+			t.Fatalf("Expected the purged delivery to be deleted")
+		}
+	})
+}
@@ -0,0 +1,446 @@
+/**
+ * Copyright (c) 2020 Ameya Lokare
+ */
+package proxy
+
+import (
+	"container/list"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+var (
+	dnsLookupHistogram = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "dns_lookup_duration",
+		Help:    "DNS lookup time histogram in milliseconds",
+		Buckets: []float64{1, 5, 10, 50, 100, 500, 1000, 5000},
+	}, []string{"result"})
+
+	dnsCacheCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "dns_cache_lookups",
+		Help: "The number of DNS cache lookups, by hit or miss",
+	}, []string{"result"})
+)
+
+// maxUDPResponseSize is the UDP payload size advertised with EDNS(0); 1232 bytes avoids IP
+// fragmentation on practically every network
+const maxUDPResponseSize = 1232
+
+// ipResolver is satisfied by *net.Resolver
+type ipResolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// newResolver returns the system resolver if no nameservers are configured, otherwise a resolver
+// that queries the configured nameservers directly and caches answers for as long as their TTL
+func newResolver(config DNSConfig) ipResolver {
+	if len(config.Nameservers) == 0 {
+		return net.DefaultResolver
+	}
+	var nameservers []string
+	for _, nameserver := range config.Nameservers {
+		nameservers = append(nameservers, nameserverAddress(nameserver))
+	}
+	resolver := &cachingResolver{
+		nameservers: nameservers,
+		protocol:    config.Protocol,
+		maxTTL:      config.Cache.MaxTTL,
+		negativeTTL: config.Cache.NegativeTTL,
+	}
+	if config.Cache.MaxSize > 0 {
+		resolver.cache = newDNSCache(config.Cache.MaxSize)
+	}
+	return resolver
+}
+
+func (s *safeDialer) lookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	if s.dnsTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.dnsTimeout)
+		defer cancel()
+	}
+	start := time.Now()
+	ips, err := s.resolver.LookupIPAddr(ctx, host)
+	result := "success"
+	if err != nil {
+		result = "error"
+	}
+	dnsLookupHistogram.With(prometheus.Labels{"result": result}).Observe(float64(time.Since(start).Milliseconds()))
+	return ips, err
+}
+
+// nameserverAddress adds the default DNS port to a nameserver address if it doesn't have one
+func nameserverAddress(nameserver string) string {
+	if _, _, err := net.SplitHostPort(nameserver); err == nil {
+		return nameserver
+	}
+	return net.JoinHostPort(strings.Trim(nameserver, "[]"), "53")
+}
+
+type cachingResolver struct {
+	nameservers []string
+	protocol    DNSProtocol
+	maxTTL      time.Duration
+	negativeTTL time.Duration
+	cache       *dnsCache
+}
+
+func (r *cachingResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IPAddr{{IP: ip}}, nil
+	}
+	name := strings.ToLower(host)
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	if r.cache != nil {
+		if entry, ok := r.cache.get(name); ok {
+			dnsCacheCounter.With(prometheus.Labels{"result": "hit"}).Inc()
+			if entry.addrs == nil {
+				return nil, notFoundError(host)
+			}
+			return entry.addrs, nil
+		}
+		dnsCacheCounter.With(prometheus.Labels{"result": "miss"}).Inc()
+	}
+
+	addrs, ttl, err := r.lookup(ctx, name)
+	if err != nil {
+		return nil, &net.DNSError{Err: err.Error(), Name: host, IsTimeout: isTimeout(err), IsTemporary: true}
+	}
+	if r.cache != nil {
+		if len(addrs) == 0 {
+			ttl = r.negativeTTL
+		} else if r.maxTTL > 0 && ttl > r.maxTTL {
+			ttl = r.maxTTL
+		}
+		if ttl > 0 {
+			r.cache.put(name, addrs, ttl)
+		}
+	}
+	if len(addrs) == 0 {
+		return nil, notFoundError(host)
+	}
+	return addrs, nil
+}
+
+func notFoundError(host string) error {
+	return &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout())
+}
+
+// lookup queries A and AAAA records in parallel, returning the addresses found (IPv6 first, as
+// RFC 8305 prefers) and the lowest TTL among them. A name that doesn't exist or has no addresses
+// returns no addresses and no error.
+func (r *cachingResolver) lookup(ctx context.Context, name string) ([]net.IPAddr, time.Duration, error) {
+	qname, err := dnsmessage.NewName(name)
+	if err != nil {
+		return nil, 0, err
+	}
+	type lookupResult struct {
+		addrs []net.IPAddr
+		ttl   time.Duration
+		err   error
+	}
+	qtypes := []dnsmessage.Type{dnsmessage.TypeAAAA, dnsmessage.TypeA}
+	results := make([]lookupResult, len(qtypes))
+	var wg sync.WaitGroup
+	for i, qtype := range qtypes {
+		wg.Add(1)
+		go func(i int, qtype dnsmessage.Type) {
+			defer wg.Done()
+			addrs, ttl, err := r.query(ctx, qname, qtype)
+			results[i] = lookupResult{addrs: addrs, ttl: ttl, err: err}
+		}(i, qtype)
+	}
+	wg.Wait()
+
+	var addrs []net.IPAddr
+	var ttl time.Duration
+	for _, result := range results {
+		if result.err != nil {
+			return nil, 0, result.err
+		}
+		if len(result.addrs) > 0 && (ttl == 0 || result.ttl < ttl) {
+			ttl = result.ttl
+		}
+		addrs = append(addrs, result.addrs...)
+	}
+	return addrs, ttl, nil
+}
+
+// query asks each nameserver in turn until one answers
+func (r *cachingResolver) query(ctx context.Context, qname dnsmessage.Name, qtype dnsmessage.Type) ([]net.IPAddr, time.Duration, error) {
+	var lastErr error
+	for _, nameserver := range r.nameservers {
+		addrs, ttl, err := r.queryNameserver(ctx, nameserver, qname, qtype)
+		if err == nil {
+			return addrs, ttl, nil
+		}
+		lastErr = err
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, 0, lastErr
+}
+
+func (r *cachingResolver) queryNameserver(ctx context.Context, nameserver string, qname dnsmessage.Name, qtype dnsmessage.Type) ([]net.IPAddr, time.Duration, error) {
+	idBytes := make([]byte, 2)
+	if _, err := rand.Read(idBytes); err != nil {
+		return nil, 0, err
+	}
+	id := binary.BigEndian.Uint16(idBytes)
+	query, err := newDNSQuery(id, qname, qtype)
+	if err != nil {
+		return nil, 0, err
+	}
+	var response []byte
+	if r.protocol == DNSOverTCP {
+		response, err = exchangeTCP(ctx, nameserver, query)
+	} else {
+		response, err = exchangeUDP(ctx, nameserver, query)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	var parser dnsmessage.Parser
+	header, err := parser.Start(response)
+	if err != nil {
+		return nil, 0, err
+	}
+	if header.Truncated && r.protocol != DNSOverTCP {
+		if response, err = exchangeTCP(ctx, nameserver, query); err != nil {
+			return nil, 0, err
+		}
+		if header, err = parser.Start(response); err != nil {
+			return nil, 0, err
+		}
+	}
+	if header.ID != id || !header.Response {
+		return nil, 0, fmt.Errorf("invalid response from nameserver %s", nameserver)
+	}
+	switch header.RCode {
+	case dnsmessage.RCodeSuccess:
+	case dnsmessage.RCodeNameError:
+		return nil, 0, nil
+	default:
+		return nil, 0, fmt.Errorf("nameserver %s returned %s", nameserver, header.RCode)
+	}
+	question, err := parser.Question()
+	if err != nil {
+		return nil, 0, err
+	}
+	if !strings.EqualFold(question.Name.String(), qname.String()) || question.Type != qtype {
+		return nil, 0, fmt.Errorf("invalid response from nameserver %s", nameserver)
+	}
+	if err := parser.SkipAllQuestions(); err != nil {
+		return nil, 0, err
+	}
+	return parseAnswers(&parser, qname, qtype)
+}
+
+func newDNSQuery(id uint16, qname dnsmessage.Name, qtype dnsmessage.Type) ([]byte, error) {
+	builder := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: id, RecursionDesired: true})
+	builder.EnableCompression()
+	if err := builder.StartQuestions(); err != nil {
+		return nil, err
+	}
+	if err := builder.Question(dnsmessage.Question{Name: qname, Type: qtype, Class: dnsmessage.ClassINET}); err != nil {
+		return nil, err
+	}
+	if err := builder.StartAdditionals(); err != nil {
+		return nil, err
+	}
+	var opt dnsmessage.ResourceHeader
+	if err := opt.SetEDNS0(maxUDPResponseSize, dnsmessage.RCodeSuccess, false); err != nil {
+		return nil, err
+	}
+	if err := builder.OPTResource(opt, dnsmessage.OPTResource{}); err != nil {
+		return nil, err
+	}
+	return builder.Finish()
+}
+
+// parseAnswers collects the addresses of qname, following any CNAME chain in the answer section
+func parseAnswers(parser *dnsmessage.Parser, qname dnsmessage.Name, qtype dnsmessage.Type) ([]net.IPAddr, time.Duration, error) {
+	var addrs []net.IPAddr
+	var ttl uint32
+	target := qname
+	for {
+		header, err := parser.AnswerHeader()
+		if err == dnsmessage.ErrSectionDone {
+			break
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		if !strings.EqualFold(header.Name.String(), target.String()) || header.Class != dnsmessage.ClassINET {
+			if err := parser.SkipAnswer(); err != nil {
+				return nil, 0, err
+			}
+			continue
+		}
+		var ip net.IP
+		switch header.Type {
+		case dnsmessage.TypeCNAME:
+			cname, err := parser.CNAMEResource()
+			if err != nil {
+				return nil, 0, err
+			}
+			target = cname.CNAME
+			continue
+		case dnsmessage.TypeA:
+			if qtype != dnsmessage.TypeA {
+				err = parser.SkipAnswer()
+				break
+			}
+			a, err := parser.AResource()
+			if err != nil {
+				return nil, 0, err
+			}
+			ip = net.IP(a.A[:])
+		case dnsmessage.TypeAAAA:
+			if qtype != dnsmessage.TypeAAAA {
+				err = parser.SkipAnswer()
+				break
+			}
+			aaaa, err := parser.AAAAResource()
+			if err != nil {
+				return nil, 0, err
+			}
+			ip = net.IP(aaaa.AAAA[:])
+		default:
+			err = parser.SkipAnswer()
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		if ip != nil {
+			addrs = append(addrs, net.IPAddr{IP: ip})
+			if len(addrs) == 1 || header.TTL < ttl {
+				ttl = header.TTL
+			}
+		}
+	}
+	return addrs, time.Duration(ttl) * time.Second, nil
+}
+
+func exchangeUDP(ctx context.Context, nameserver string, query []byte) ([]byte, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "udp", nameserver)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	response := make([]byte, maxUDPResponseSize)
+	n, err := conn.Read(response)
+	if err != nil {
+		return nil, err
+	}
+	return response[:n], nil
+}
+
+func exchangeTCP(ctx context.Context, nameserver string, query []byte) ([]byte, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", nameserver)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	msg := make([]byte, 2+len(query))
+	binary.BigEndian.PutUint16(msg, uint16(len(query)))
+	copy(msg[2:], query)
+	if _, err := conn.Write(msg); err != nil {
+		return nil, err
+	}
+	lengthBuf := make([]byte, 2)
+	if _, err := io.ReadFull(conn, lengthBuf); err != nil {
+		return nil, err
+	}
+	response := make([]byte, binary.BigEndian.Uint16(lengthBuf))
+	if _, err := io.ReadFull(conn, response); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+type dnsCacheEntry struct {
+	name    string
+	addrs   []net.IPAddr
+	expires time.Time
+}
+
+// dnsCache is an LRU cache of lookup results. Entries without addresses are negative entries.
+type dnsCache struct {
+	mu      sync.Mutex
+	maxSize int
+	entries map[string]*list.Element
+	lru     *list.List
+}
+
+func newDNSCache(maxSize int) *dnsCache {
+	return &dnsCache{
+		maxSize: maxSize,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+func (c *dnsCache) get(name string) (*dnsCacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[name]
+	if !ok {
+		return nil, false
+	}
+	entry := elem.Value.(*dnsCacheEntry)
+	if time.Now().After(entry.expires) {
+		c.lru.Remove(elem)
+		delete(c.entries, name)
+		return nil, false
+	}
+	c.lru.MoveToFront(elem)
+	return entry, true
+}
+
+func (c *dnsCache) put(name string, addrs []net.IPAddr, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry := &dnsCacheEntry{name: name, addrs: addrs, expires: time.Now().Add(ttl)}
+	if elem, ok := c.entries[name]; ok {
+		elem.Value = entry
+		c.lru.MoveToFront(elem)
+		return
+	}
+	c.entries[name] = c.lru.PushFront(entry)
+	if c.lru.Len() > c.maxSize {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*dnsCacheEntry).name)
+	}
+}
@@ -0,0 +1,189 @@
+/**
+ * Copyright (c) 2020 Ameya Lokare
+ */
+package proxy
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// startFakeNameserver answers A and AAAA queries over UDP from the given records; names without
+// records get NXDOMAIN
+func startFakeNameserver(t *testing.T, records map[string][]dnsmessage.Resource) (string, *int32, func()) {
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to start fake nameserver: %s", err)
+	}
+	var queries int32
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&queries, 1)
+			var query dnsmessage.Message
+			if err := query.Unpack(buf[:n]); err != nil {
+				continue
+			}
+			question := query.Questions[0]
+			response := dnsmessage.Message{
+				Header:    dnsmessage.Header{ID: query.ID, Response: true, RCode: dnsmessage.RCodeSuccess},
+				Questions: []dnsmessage.Question{question},
+			}
+			answers, ok := records[question.Name.String()]
+			if !ok {
+				response.RCode = dnsmessage.RCodeNameError
+			}
+			for _, answer := range answers {
+				if answer.Header.Type == question.Type || answer.Header.Type == dnsmessage.TypeCNAME {
+					response.Answers = append(response.Answers, answer)
+				}
+			}
+			packed, err := response.Pack()
+			if err != nil {
+				t.Errorf("Failed to pack DNS response: %s", err)
+				continue
+			}
+			conn.WriteTo(packed, addr)
+		}
+	}()
+	return conn.LocalAddr().String(), &queries, func() { conn.Close() }
+}
+
+func aRecord(name string, ttl uint32, ip [4]byte) dnsmessage.Resource {
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(name), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: ttl},
+		Body:   &dnsmessage.AResource{A: ip},
+	}
+}
+
+func aaaaRecord(name string, ttl uint32, ip string) dnsmessage.Resource {
+	var aaaa [16]byte
+	copy(aaaa[:], net.ParseIP(ip))
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(name), Type: dnsmessage.TypeAAAA, Class: dnsmessage.ClassINET, TTL: ttl},
+		Body:   &dnsmessage.AAAAResource{AAAA: aaaa},
+	}
+}
+
+func cnameRecord(name string, ttl uint32, target string) dnsmessage.Resource {
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(name), Type: dnsmessage.TypeCNAME, Class: dnsmessage.ClassINET, TTL: ttl},
+		Body:   &dnsmessage.CNAMEResource{CNAME: dnsmessage.MustNewName(target)},
+	}
+}
+
+func TestCachingResolver(t *testing.T) {
+	records := map[string][]dnsmessage.Resource{
+		"hooks.example.com.": {
+			aRecord("hooks.example.com.", 300, [4]byte{192, 0, 2, 1}),
+			aRecord("hooks.example.com.", 60, [4]byte{192, 0, 2, 2}),
+			aaaaRecord("hooks.example.com.", 300, "2001:db8::1"),
+		},
+		"alias.example.com.": {
+			cnameRecord("alias.example.com.", 300, "hooks.example.com."),
+			aRecord("hooks.example.com.", 300, [4]byte{192, 0, 2, 1}),
+		},
+	}
+	nameserver, queries, stop := startFakeNameserver(t, records)
+	defer stop()
+
+	config := NewDefaultConfig().DNS
+	config.Nameservers = []string{nameserver}
+	resolver := newResolver(config).(*cachingResolver)
+
+	t.Run("A and AAAA records", func(t *testing.T) {
+		addrs, err := resolver.LookupIPAddr(context.Background(), "hooks.example.com")
+		checkNoError(t, err)
+		assertEqual(t, 3, len(addrs))
+		assertEqual(t, "2001:db8::1", addrs[0].IP.String())
+		assertEqual(t, "192.0.2.1", addrs[1].IP.String())
+		assertEqual(t, "192.0.2.2", addrs[2].IP.String())
+		entry, ok := resolver.cache.get("hooks.example.com.")
+		if !ok {
+			t.Fatal("Expected lookup result to be cached")
+		}
+		// The entry expires with the lowest TTL among the records
+		if ttl := time.Until(entry.expires); ttl > 60*time.Second || ttl < 55*time.Second {
+			t.Errorf("Expected cache entry to expire in 60s, expires in %s", ttl)
+		}
+	})
+
+	t.Run("Cache hit", func(t *testing.T) {
+		before := atomic.LoadInt32(queries)
+		addrs, err := resolver.LookupIPAddr(context.Background(), "HOOKS.example.com.")
+		checkNoError(t, err)
+		assertEqual(t, 3, len(addrs))
+		assertEqual(t, before, atomic.LoadInt32(queries))
+	})
+
+	t.Run("CNAME", func(t *testing.T) {
+		addrs, err := resolver.LookupIPAddr(context.Background(), "alias.example.com")
+		checkNoError(t, err)
+		assertEqual(t, 1, len(addrs))
+		assertEqual(t, "192.0.2.1", addrs[0].IP.String())
+	})
+
+	t.Run("Negative cache", func(t *testing.T) {
+		_, err := resolver.LookupIPAddr(context.Background(), "missing.example.com")
+		dnsErr, ok := err.(*net.DNSError)
+		if !ok || !dnsErr.IsNotFound {
+			t.Fatalf("Expected not found DNS error, got %v", err)
+		}
+		before := atomic.LoadInt32(queries)
+		_, err = resolver.LookupIPAddr(context.Background(), "missing.example.com")
+		if err == nil {
+			t.Fatal("Expected cached not found error, got no error")
+		}
+		assertEqual(t, before, atomic.LoadInt32(queries))
+	})
+
+	t.Run("IP literal", func(t *testing.T) {
+		before := atomic.LoadInt32(queries)
+		addrs, err := resolver.LookupIPAddr(context.Background(), "192.0.2.10")
+		checkNoError(t, err)
+		assertEqual(t, "192.0.2.10", addrs[0].IP.String())
+		assertEqual(t, before, atomic.LoadInt32(queries))
+	})
+
+	t.Run("Timeout", func(t *testing.T) {
+		// Nothing answers on this nameserver
+		silent, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		checkNoError(t, err)
+		defer silent.Close()
+		config.Nameservers = []string{silent.LocalAddr().String()}
+		sd := newSafeDialer(NewDefaultConfig())
+		sd.resolver = newResolver(config)
+		sd.dnsTimeout = 100 * time.Millisecond
+		_, err = sd.lookupIPAddr(context.Background(), "hooks.example.com")
+		_, errorCode, _ := mapError("test", err)
+		assertEqual(t, UnableToResolveIP, errorCode)
+	})
+}
+
+func TestDNSCacheEviction(t *testing.T) {
+	cache := newDNSCache(2)
+	addrs := []net.IPAddr{{IP: net.ParseIP("192.0.2.1")}}
+	cache.put("a.", addrs, time.Minute)
+	cache.put("b.", addrs, time.Minute)
+	cache.get("a.")
+	cache.put("c.", addrs, time.Minute)
+	if _, ok := cache.get("b."); ok {
+		t.Error("Expected least recently used entry to be evicted")
+	}
+	if _, ok := cache.get("a."); !ok {
+		t.Error("Expected recently used entry to be cached")
+	}
+	cache.put("d.", addrs, -time.Second)
+	if _, ok := cache.get("d."); ok {
+		t.Error("Expected expired entry not to be returned")
+	}
+}
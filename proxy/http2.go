@@ -0,0 +1,77 @@
+/**
+ * Copyright (c) 2020 Ameya Lokare
+ */
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+
+	"golang.org/x/net/http2"
+)
+
+// HTTP2Config configures negotiating HTTP/2 with HTTPS targets
+type HTTP2Config struct {
+	// Enabled offers HTTP/2 to targets by ALPN; otherwise every request is sent over HTTP/1.1
+	Enabled bool `yaml:"enabled"`
+	// Hosts limits HTTP/2 to the targets matching these patterns, if set
+	Hosts []string `yaml:"hosts"`
+	// ExcludeHosts are targets HTTP/2 is never offered to
+	ExcludeHosts []string `yaml:"excludeHosts"`
+}
+
+func validateHTTP2Config(c HTTP2Config, pool ConnectionPoolConfig) error {
+	if err := validateHostPatterns(c.Hosts); err != nil {
+		return err
+	}
+	if err := validateHostPatterns(c.ExcludeHosts); err != nil {
+		return err
+	}
+	if c.Enabled && !pool.Enabled {
+		// Streams are multiplexed over pooled connections
+		return fmt.Errorf("HTTP/2 requires connectionPool to be enabled")
+	}
+	return nil
+}
+
+// newHTTP2Policy returns the hosts HTTP/2 is offered to, or nil if it isn't offered to any
+func newHTTP2Policy(c HTTP2Config) *hostPolicy {
+	if !c.Enabled {
+		return nil
+	}
+	return newHostPolicy(c.Hosts, c.ExcludeHosts)
+}
+
+// unprocessedHTTP2Error is true if err means the target didn't process a request sent on a
+// multiplexed connection, because the connection went away after the stream for the request was
+// reserved, or the target refused the stream, so it can be sent again on another connection
+func unprocessedHTTP2Error(err error) bool {
+	if streamErr, ok := err.(http2.StreamError); ok {
+		return streamErr.Code == http2.ErrCodeRefusedStream
+	}
+	// The HTTP/2 client doesn't export these errors
+	switch err.Error() {
+	case "http2: client conn is closed", "http2: client conn not usable", "http2: Transport received Server's graceful shutdown GOAWAY":
+		return true
+	}
+	return false
+}
+
+// mapHTTP2Error maps the errors returned when the target resets the stream or the connection a
+// request was sent on, or sends something that isn't valid HTTP/2
+func mapHTTP2Error(requestID string, err error) (int, uint16, string) {
+	var code http2.ErrCode
+	switch v := err.(type) {
+	case http2.StreamError:
+		code = v.Code
+	case http2.GoAwayError:
+		code = v.ErrCode
+	case http2.ConnectionError:
+		code = http2.ErrCode(v)
+	}
+	logWarn(requestID, "HTTP/2 error", err)
+	if code == http2.ErrCodeHTTP11Required {
+		return http.StatusBadGateway, TCPConnectionError, "Target requires HTTP/1.1; add it to http2.excludeHosts"
+	}
+	return http.StatusBadGateway, TCPConnectionError, fmt.Sprintf("HTTP/2 error from target: %s", err)
+}
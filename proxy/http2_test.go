@@ -0,0 +1,190 @@
+/**
+ * Copyright (c) 2020 Ameya Lokare
+ */
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+func TestHTTP2(t *testing.T) {
+	recorder := &connRecorder{}
+	var arrived sync.WaitGroup
+	target := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/reset":
+			// Resets the stream
+			panic(http.ErrAbortHandler)
+		case "/together":
+			// Holds the response until every concurrent request has arrived
+			arrived.Done()
+			arrived.Wait()
+		}
+		w.Write([]byte(r.Proto))
+	}))
+	target.EnableHTTP2 = true
+	target.Config.ConnState = recorder.connState
+	target.StartTLS()
+	defer target.Close()
+
+	config := NewDefaultConfig()
+	config.InsecureSkipCidrDenyList = true
+	config.InsecureSkipCertVerification = true
+	config.AllowedPorts = nil
+	config.ConnectionPool.Enabled = true
+	config.HTTP2.Enabled = true
+	checkNoError(t, config.validate())
+	p := NewProxy(config, "")
+	defer p.Shutdown(context.Background())
+
+	send := func(path string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", target.URL+path, nil)
+		w := httptest.NewRecorder()
+		p.currentHandler().ServeHTTP(w, r)
+		return w
+	}
+
+	t.Run("Requests are multiplexed", func(t *testing.T) {
+		w := send("/")
+		assertEqual(t, http.StatusOK, w.Code)
+		assertEqual(t, "HTTP/2.0", w.Body.String())
+
+		const concurrent = 5
+		arrived.Add(concurrent)
+		var wg sync.WaitGroup
+		for i := 0; i < concurrent; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				w := send("/together")
+				assertEqual(t, "HTTP/2.0", w.Body.String())
+			}()
+		}
+		wg.Wait()
+		assertEqual(t, "127.0.0.1", recorder.accepted())
+	})
+
+	t.Run("Stream errors", func(t *testing.T) {
+		w := send("/reset")
+		assertEqual(t, http.StatusBadGateway, w.Code)
+		assertEqual(t, strconv.Itoa(int(TCPConnectionError)), w.Header().Get(ReasonCodeHeader))
+		// The HTTP/2 client doesn't reuse the connection, and the next request gets a new one
+		assertEqual(t, "HTTP/2.0", send("/").Body.String())
+		assertEqual(t, "127.0.0.1 127.0.0.1", recorder.accepted())
+	})
+
+	t.Run("Connection metadata", func(t *testing.T) {
+		r := httptest.NewRequest("GET", target.URL, nil)
+		r.Header.Set(MetadataHeader, "true")
+		w := httptest.NewRecorder()
+		p.currentHandler().ServeHTTP(w, r)
+		assertEqual(t, "HTTP/2.0", w.Body.String())
+		assertEqual(t, "127.0.0.1", w.Header().Get(UpstreamIPHeader))
+		assertEqual(t, "TLS 1.3", w.Header().Get(TLSVersionHeader))
+	})
+
+	t.Run("Connections with reserved streams aren't swept", func(t *testing.T) {
+		pool := p.currentHandler().pool
+		key := transportKey{scheme: "https", serverName: "127.0.0.1"}
+		port := strings.TrimPrefix(target.URL, "https://127.0.0.1:")
+		conn := pool.multiplexedConn(key, []net.IP{net.ParseIP("127.0.0.1")}, port)
+		if conn == nil {
+			t.Fatalf("Expected an HTTP/2 connection")
+		}
+		pool.now = func() time.Time { return time.Now().Add(config.ConnectionPool.IdleTimeout) }
+		defer func() { pool.now = time.Now }()
+		pool.sweep()
+		req := httptest.NewRequest("GET", target.URL, nil)
+		resp, err := pool.roundTripHTTP2(conn, pool.outbound(req.Context(), req, conn.key.addr), true)
+		checkNoError(t, err)
+		resp.Body.Close()
+		assertEqual(t, http.StatusOK, resp.StatusCode)
+	})
+
+	t.Run("Protocol in the access log", func(t *testing.T) {
+		var buf bytes.Buffer
+		out, formatter := accessLog.Out, accessLog.Formatter
+		accessLog.SetOutput(&buf)
+		accessLog.SetFormatter(&AccessLogTextFormatter{})
+		defer func() {
+			accessLog.SetOutput(out)
+			accessLog.SetFormatter(formatter)
+		}()
+		send("/")
+		if !strings.Contains(buf.String(), " protocol=HTTP/2.0") {
+			t.Fatalf("Expected the protocol in the access log line %q", buf.String())
+		}
+	})
+
+	t.Run("Idle connections are closed", func(t *testing.T) {
+		pool := p.currentHandler().pool
+		accepted := recorder.accepted()
+		pool.sweep()
+		send("/")
+		assertEqual(t, accepted, recorder.accepted())
+		pool.now = func() time.Time { return time.Now().Add(config.ConnectionPool.IdleTimeout) }
+		pool.sweep()
+		assertEqual(t, "HTTP/2.0", send("/").Body.String())
+		assertEqual(t, accepted+" 127.0.0.1", recorder.accepted())
+	})
+
+	t.Run("Connections opened once the pool is closed", func(t *testing.T) {
+		pool := p.currentHandler().pool
+		pool.close()
+		waitClosed(t, pool)
+		accepted := recorder.accepted()
+		assertEqual(t, "HTTP/2.0", send("/").Body.String())
+		assertEqual(t, accepted+" 127.0.0.1", recorder.accepted())
+		waitClosed(t, pool)
+	})
+
+	t.Run("Excluded hosts get HTTP/1.1", func(t *testing.T) {
+		config.HTTP2.ExcludeHosts = []string{"127.0.0.1"}
+		checkNoError(t, p.swapConfig(config))
+		assertEqual(t, "HTTP/1.1", send("/").Body.String())
+	})
+}
+
+func TestHTTP2Errors(t *testing.T) {
+	for _, test := range []struct {
+		err     error
+		message string
+	}{
+		{http2.StreamError{StreamID: 3, Code: http2.ErrCodeInternal}, "HTTP/2 error from target: stream error: stream ID 3; INTERNAL_ERROR"},
+		{http2.StreamError{StreamID: 3, Code: http2.ErrCodeHTTP11Required}, "Target requires HTTP/1.1"},
+		{http2.GoAwayError{LastStreamID: 1, ErrCode: http2.ErrCodeEnhanceYourCalm}, "HTTP/2 error from target: http2: server sent GOAWAY"},
+		{http2.ConnectionError(http2.ErrCodeProtocol), "HTTP/2 error from target: connection error: PROTOCOL_ERROR"},
+	} {
+		statusCode, errorCode, message := mapError("rq-1", test.err)
+		assertEqual(t, http.StatusBadGateway, statusCode)
+		assertEqual(t, TCPConnectionError, errorCode)
+		if !strings.HasPrefix(message, test.message) {
+			t.Fatalf("Expected %q to start with %q", message, test.message)
+		}
+	}
+
+	assertEqual(t, true, unprocessedHTTP2Error(http2.StreamError{Code: http2.ErrCodeRefusedStream}))
+	assertEqual(t, false, unprocessedHTTP2Error(http2.StreamError{Code: http2.ErrCodeInternal}))
+	assertEqual(t, true, unprocessedHTTP2Error(fmt.Errorf("http2: client conn is closed")))
+
+	_, err := UnmarshalConfig([]byte(`http2: {enabled: true}`))
+	assertError(t, "HTTP/2 requires connectionPool to be enabled", err)
+	_, err = UnmarshalConfig([]byte(`{connectionPool: {enabled: true}, http2: {enabled: true, hosts: ["*.example.com"], excludeHosts: ["legacy.example.com"]}}`))
+	checkNoError(t, err)
+	policy := newHTTP2Policy(HTTP2Config{Enabled: true, Hosts: []string{"*.example.com"}, ExcludeHosts: []string{"legacy.example.com"}})
+	assertEqual(t, true, policy.isAllowed("api.example.com"))
+	assertEqual(t, false, policy.isAllowed("legacy.example.com"))
+	assertEqual(t, false, policy.isAllowed("example.org"))
+}
@@ -0,0 +1,383 @@
+/**
+ * Copyright (c) 2020 Ameya Lokare
+ */
+package proxy
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	bolt "go.etcd.io/bbolt"
+)
+
+// IdempotentReplayHeader is set on responses replayed from the idempotency cache
+const IdempotentReplayHeader string = "X-WhSentry-Idempotent-Replay"
+
+var (
+	idempotentReplayCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "idempotent_replays",
+		Help: "Duplicate requests answered with the cached response of the first one",
+	})
+
+	idempotencyEntriesGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "idempotency_cache_entries",
+		Help: "The number of responses in the in-memory idempotency cache",
+	})
+
+	idempotencyBucket = []byte("responses")
+)
+
+// IdempotencyConfig configures deduplication of requests by idempotency key
+type IdempotencyConfig struct {
+	// Window is how long responses are kept for duplicates; deduplication is disabled unless it is set
+	Window time.Duration `yaml:"window"`
+	// Header carries the idempotency key
+	Header string `yaml:"header"`
+	// MaxEntries bounds the number of responses kept in memory
+	MaxEntries int `yaml:"maxEntries"`
+	// StoreFile, if set, keeps responses on disk as well, so that they survive restarts and
+	// evictions from memory
+	StoreFile string `yaml:"storeFile"`
+}
+
+func validateIdempotencyConfig(c IdempotencyConfig) error {
+	if c.Window < 0 {
+		return fmt.Errorf("Idempotency window must not be negative")
+	}
+	if c.Window == 0 {
+		return nil
+	}
+	if c.Header == "" {
+		return fmt.Errorf("Idempotency header must be set")
+	}
+	if c.MaxEntries <= 0 {
+		return fmt.Errorf("Idempotency maxEntries must be positive")
+	}
+	return nil
+}
+
+// cachedResponse is the response to the first request with an idempotency key
+type cachedResponse struct {
+	StatusCode int         `json:"statusCode"`
+	Header     http.Header `json:"header"`
+	Body       []byte      `json:"body"`
+	CreatedAt  time.Time   `json:"createdAt"`
+}
+
+func (c *cachedResponse) write(w http.ResponseWriter) {
+	for name, values := range c.Header {
+		w.Header()[name] = values
+	}
+	w.Header().Set(IdempotentReplayHeader, "true")
+	w.WriteHeader(c.StatusCode)
+	w.Write(c.Body)
+}
+
+type idempotencyEntry struct {
+	key      string
+	response *cachedResponse
+}
+
+// idempotencyCache keeps the responses to requests with idempotency keys for the window, in an LRU
+// in memory and optionally on disk. It's owned by Proxy, so that it survives reloads.
+type idempotencyCache struct {
+	config IdempotencyConfig
+	db     *bolt.DB
+	now    func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+	// inFlight has a channel for each key whose first request hasn't finished yet, closed when it does
+	inFlight map[string]chan struct{}
+
+	stopping chan struct{}
+}
+
+func newIdempotencyCache(config IdempotencyConfig) (*idempotencyCache, error) {
+	c := &idempotencyCache{
+		config:   config,
+		now:      time.Now,
+		entries:  make(map[string]*list.Element),
+		lru:      list.New(),
+		inFlight: make(map[string]chan struct{}),
+		stopping: make(chan struct{}),
+	}
+	if config.StoreFile != "" {
+		// Responses may well contain credentials
+		db, err := bolt.Open(config.StoreFile, 0600, &bolt.Options{Timeout: time.Second})
+		if err != nil {
+			return nil, fmt.Errorf("Error opening idempotency store %s: %s", config.StoreFile, err)
+		}
+		err = db.Update(func(tx *bolt.Tx) error {
+			_, err := tx.CreateBucketIfNotExists(idempotencyBucket)
+			return err
+		})
+		if err != nil {
+			db.Close()
+			return nil, fmt.Errorf("Error opening idempotency store %s: %s", config.StoreFile, err)
+		}
+		c.db = db
+	}
+	return c, nil
+}
+
+// start begins deleting expired responses from disk
+func (c *idempotencyCache) start() {
+	if c.db != nil {
+		go c.sweepPeriodically()
+	}
+}
+
+// key returns the cache key for r, or an empty string if it has no idempotency key. Keys are
+// scoped to the tenant and to the origin and path of target, the URL r is destined for.
+func (c *idempotencyCache) key(r *http.Request, tenant string, target *url.URL) string {
+	if c == nil {
+		return ""
+	}
+	value := r.Header.Get(c.config.Header)
+	if value == "" {
+		return ""
+	}
+	return strings.Join([]string{tenant, origin(target), target.EscapedPath(), value}, "\x00")
+}
+
+// serve replays the cached response for key if there is one. Otherwise it calls handle, and caches
+// the response it writes if it returns true. Duplicates that arrive while the first request is in
+// flight wait for it. It returns the response that was replayed, if any.
+func (c *idempotencyCache) serve(w http.ResponseWriter, r *http.Request, key string, maxBodySize uint32, handle func(w http.ResponseWriter) bool) *cachedResponse {
+	cached, done, err := c.begin(r.Context(), key)
+	if err != nil {
+		// The client has gone away
+		return nil
+	}
+	if cached != nil {
+		idempotentReplayCounter.Inc()
+		cached.write(w)
+		return cached
+	}
+	capture := &responseCapture{ResponseWriter: w, maxBodySize: maxBodySize}
+	if handle(capture) && capture.statusCode != 0 {
+		done(&cachedResponse{StatusCode: capture.statusCode, Header: capture.header, Body: capture.body.Bytes(), CreatedAt: c.now()})
+	} else {
+		done(nil)
+	}
+	return nil
+}
+
+// begin returns the cached response for key, or claims key for the caller, who must call done with
+// the response to cache, or nil to release the key without caching anything
+func (c *idempotencyCache) begin(ctx context.Context, key string) (*cachedResponse, func(*cachedResponse), error) {
+	for {
+		c.mu.Lock()
+		if cached := c.get(key); cached != nil {
+			c.mu.Unlock()
+			return cached, nil, nil
+		}
+		wait, ok := c.inFlight[key]
+		if !ok {
+			finished := make(chan struct{})
+			c.inFlight[key] = finished
+			c.mu.Unlock()
+			return nil, func(response *cachedResponse) {
+				if response != nil {
+					// Duplicates keep waiting until it's saved
+					c.save(key, response)
+				}
+				c.mu.Lock()
+				defer c.mu.Unlock()
+				if response != nil {
+					c.add(key, response)
+				}
+				delete(c.inFlight, key)
+				close(finished)
+			}, nil
+		}
+		c.mu.Unlock()
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		}
+	}
+}
+
+// get looks key up in memory, then on disk. It must be called with mu held.
+func (c *idempotencyCache) get(key string) *cachedResponse {
+	expired := func(response *cachedResponse) bool {
+		return c.now().Sub(response.CreatedAt) >= c.config.Window
+	}
+	if element, ok := c.entries[key]; ok {
+		entry := element.Value.(*idempotencyEntry)
+		if !expired(entry.response) {
+			c.lru.MoveToFront(element)
+			return entry.response
+		}
+		c.remove(element)
+	}
+	if c.db == nil {
+		return nil
+	}
+	var response *cachedResponse
+	err := c.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(idempotencyBucket).Get([]byte(key))
+		if data == nil {
+			return nil
+		}
+		response = &cachedResponse{}
+		return json.Unmarshal(data, response)
+	})
+	if err != nil {
+		log.Warnf("Error loading response from idempotency store: %s\n", err)
+		return nil
+	}
+	if response == nil || expired(response) {
+		return nil
+	}
+	c.add(key, response)
+	return response
+}
+
+// save writes response to disk, if there's a store. It's called without mu held, so that other
+// keys aren't held up by the write.
+func (c *idempotencyCache) save(key string, response *cachedResponse) {
+	if c.db == nil {
+		return
+	}
+	data, err := json.Marshal(response)
+	if err == nil {
+		err = c.db.Update(func(tx *bolt.Tx) error {
+			return tx.Bucket(idempotencyBucket).Put([]byte(key), data)
+		})
+	}
+	if err != nil {
+		log.Warnf("Error saving response to idempotency store: %s\n", err)
+	}
+}
+
+func (c *idempotencyCache) add(key string, response *cachedResponse) {
+	if element, ok := c.entries[key]; ok {
+		c.remove(element)
+	}
+	c.entries[key] = c.lru.PushFront(&idempotencyEntry{key: key, response: response})
+	for c.lru.Len() > c.config.MaxEntries {
+		c.remove(c.lru.Back())
+	}
+	idempotencyEntriesGauge.Set(float64(c.lru.Len()))
+}
+
+func (c *idempotencyCache) remove(element *list.Element) {
+	c.lru.Remove(element)
+	delete(c.entries, element.Value.(*idempotencyEntry).key)
+	idempotencyEntriesGauge.Set(float64(c.lru.Len()))
+}
+
+func (c *idempotencyCache) sweepPeriodically() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		c.sweep()
+		select {
+		case <-ticker.C:
+		case <-c.stopping:
+			return
+		}
+	}
+}
+
+// sweep deletes expired responses from disk. Expired ones in memory are dropped when they're looked
+// up or evicted.
+func (c *idempotencyCache) sweep() {
+	cutoff := c.now().Add(-c.config.Window)
+	err := c.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(idempotencyBucket)
+		var expired [][]byte
+		err := b.ForEach(func(k, v []byte) error {
+			response := &cachedResponse{}
+			if err := json.Unmarshal(v, response); err != nil || response.CreatedAt.Before(cutoff) {
+				expired = append(expired, k)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range expired {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Warnf("Error deleting expired responses from idempotency store: %s\n", err)
+	}
+}
+
+func (c *idempotencyCache) close() error {
+	close(c.stopping)
+	if c.db == nil {
+		return nil
+	}
+	return c.db.Close()
+}
+
+// responseCapture passes a response through to the client, keeping a copy of the status code,
+// headers and the first maxBodySize bytes of the body
+type responseCapture struct {
+	http.ResponseWriter
+	maxBodySize uint32
+	statusCode  int
+	header      http.Header
+	body        bytes.Buffer
+}
+
+func (c *responseCapture) WriteHeader(statusCode int) {
+	if c.statusCode == 0 {
+		c.statusCode = statusCode
+		c.header = c.ResponseWriter.Header().Clone()
+	}
+	c.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (c *responseCapture) Write(b []byte) (int, error) {
+	if c.statusCode == 0 {
+		c.WriteHeader(http.StatusOK)
+	}
+	if room := int(c.maxBodySize) - c.body.Len(); room > 0 {
+		if len(b) < room {
+			room = len(b)
+		}
+		c.body.Write(b[:room])
+	}
+	return c.ResponseWriter.Write(b)
+}
+
+// serveIdempotent proxies r, unless it's a duplicate of an earlier request with the same
+// idempotency key, in which case the response to that one is replayed. Responses are cached if
+// the target got the request; if the proxy couldn't get it there, the key is released so that a
+// retry is sent.
+func (p *ProxyHTTPHandler) serveIdempotent(w http.ResponseWriter, r *http.Request, identity *requestIdentity, key string) {
+	start := time.Now()
+	replayed := p.idempotency.serve(w, r, key, p.maxContentLength, func(w http.ResponseWriter) bool {
+		_, errorCode, _ := p.proxyRequest(w, r, identity)
+		return errorCode == 0 || errorCode == ResponseTooLarge
+	})
+	if replayed != nil {
+		requestID := r.Header.Get(p.requestIDHeader)
+		if requestID == "" {
+			requestID = uuid.New().String()
+		}
+		logRequest(r, requestID, identity, nil, "", replayed.StatusCode, time.Now().Sub(start))
+	}
+}
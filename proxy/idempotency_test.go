@@ -0,0 +1,221 @@
+/**
+ * Copyright (c) 2020 Ameya Lokare
+ */
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestIdempotencyCache(t *testing.T) {
+	now := time.Now()
+	config := IdempotencyConfig{Window: time.Minute, Header: "Idempotency-Key", MaxEntries: 2}
+	newCache := func(t *testing.T, config IdempotencyConfig) *idempotencyCache {
+		c, err := newIdempotencyCache(config)
+		checkNoError(t, err)
+		c.now = func() time.Time { return now }
+		return c
+	}
+	claim := func(t *testing.T, c *idempotencyCache, key string, response *cachedResponse) {
+		cached, done, err := c.begin(context.Background(), key)
+		checkNoError(t, err)
+		if cached != nil {
+			t.Fatalf("Expected %s not to be cached", key)
+		}
+		done(response)
+	}
+	lookup := func(t *testing.T, c *idempotencyCache, key string) *cachedResponse {
+		cached, done, err := c.begin(context.Background(), key)
+		checkNoError(t, err)
+		if done != nil {
+			done(nil)
+		}
+		return cached
+	}
+
+	t.Run("Expiry", func(t *testing.T) {
+		c := newCache(t, config)
+		defer c.close()
+		claim(t, c, "a", &cachedResponse{StatusCode: http.StatusCreated, CreatedAt: now})
+		assertEqual(t, http.StatusCreated, lookup(t, c, "a").StatusCode)
+		now = now.Add(time.Minute)
+		if lookup(t, c, "a") != nil {
+			t.Fatalf("Expected the response to have expired")
+		}
+	})
+
+	t.Run("Eviction", func(t *testing.T) {
+		c := newCache(t, config)
+		defer c.close()
+		for _, key := range []string{"a", "b", "c"} {
+			claim(t, c, key, &cachedResponse{StatusCode: http.StatusOK, CreatedAt: now})
+		}
+		if lookup(t, c, "a") != nil {
+			t.Fatalf("Expected the least recently used response to have been evicted")
+		}
+		if lookup(t, c, "c") == nil {
+			t.Fatalf("Expected the most recent response to be cached")
+		}
+	})
+
+	t.Run("Released keys aren't cached", func(t *testing.T) {
+		c := newCache(t, config)
+		defer c.close()
+		claim(t, c, "a", nil)
+		claim(t, c, "a", nil)
+	})
+
+	t.Run("Duplicates wait for the first request", func(t *testing.T) {
+		c := newCache(t, config)
+		defer c.close()
+		_, done, err := c.begin(context.Background(), "a")
+		checkNoError(t, err)
+		replayed := make(chan *cachedResponse)
+		go func() {
+			cached, _, _ := c.begin(context.Background(), "a")
+			replayed <- cached
+		}()
+		time.Sleep(10 * time.Millisecond)
+		done(&cachedResponse{StatusCode: http.StatusAccepted, CreatedAt: now})
+		assertEqual(t, http.StatusAccepted, (<-replayed).StatusCode)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		_, done, _ = c.begin(ctx, "b")
+		defer done(nil)
+		cancel()
+		_, _, err = c.begin(ctx, "b")
+		assertError(t, "canceled", err)
+	})
+
+	t.Run("Disk", func(t *testing.T) {
+		diskConfig := config
+		diskConfig.StoreFile = filepath.Join(t.TempDir(), "idempotency.db")
+		c := newCache(t, diskConfig)
+		for _, key := range []string{"a", "b", "c"} {
+			claim(t, c, key, &cachedResponse{StatusCode: http.StatusOK, Body: []byte(key), CreatedAt: now})
+		}
+		// Evicted from memory, but still on disk
+		assertEqual(t, "a", string(lookup(t, c, "a").Body))
+		checkNoError(t, c.close())
+
+		c = newCache(t, diskConfig)
+		defer c.close()
+		assertEqual(t, "b", string(lookup(t, c, "b").Body))
+		now = now.Add(time.Minute)
+		c.sweep()
+		if lookup(t, c, "c") != nil {
+			t.Fatalf("Expected the expired response to have been swept")
+		}
+	})
+}
+
+func TestIdempotentRequests(t *testing.T) {
+	var requests int32
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&requests, 1)
+		w.Header().Set("X-Request-Number", fmt.Sprint(n))
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, "request %d", n)
+	}))
+	defer target.Close()
+
+	config := NewDefaultConfig()
+	config.InsecureSkipCidrDenyList = true
+	config.AllowedPorts = nil
+	config.Idempotency.Window = time.Minute
+	config.Idempotency.Header = "X-Dedup-Key"
+	config.Delivery.StoreFile = filepath.Join(t.TempDir(), "deliveries.db")
+	p := NewProxy(config, "")
+	defer p.Shutdown(context.Background())
+
+	send := func(url string, key string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", url, strings.NewReader("hello"))
+		if key != "" {
+			r.Header.Set("X-Dedup-Key", key)
+		}
+		w := httptest.NewRecorder()
+		p.currentHandler().ServeHTTP(w, r)
+		return w
+	}
+
+	t.Run("Duplicates are replayed", func(t *testing.T) {
+		first := send(target.URL+"/events", "abc")
+		assertEqual(t, http.StatusCreated, first.Code)
+		assertEqual(t, "", first.Header().Get(IdempotentReplayHeader))
+		duplicate := send(target.URL+"/events", "abc")
+		assertEqual(t, http.StatusCreated, duplicate.Code)
+		assertEqual(t, "true", duplicate.Header().Get(IdempotentReplayHeader))
+		assertEqual(t, first.Header().Get("X-Request-Number"), duplicate.Header().Get("X-Request-Number"))
+		assertEqual(t, first.Body.String(), duplicate.Body.String())
+		assertEqual(t, int32(1), atomic.LoadInt32(&requests))
+	})
+
+	t.Run("Keys are per destination", func(t *testing.T) {
+		other := httptest.NewServer(target.Config.Handler)
+		defer other.Close()
+		before := atomic.LoadInt32(&requests)
+		send(strings.Replace(target.URL, "127.0.0.1", "localhost", 1)+"/events", "abc")
+		send(other.URL+"/events", "abc")
+		send(target.URL+"/other-events", "abc")
+		send(target.URL+"/events", "def")
+		send(target.URL+"/events", "")
+		send(target.URL+"/events", "")
+		assertEqual(t, before+6, atomic.LoadInt32(&requests))
+	})
+
+	t.Run("Concurrent duplicates are sent once", func(t *testing.T) {
+		before := atomic.LoadInt32(&requests)
+		codes := make(chan int, 5)
+		var wg sync.WaitGroup
+		for i := 0; i < 5; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				codes <- send(target.URL+"/events", "concurrent").Code
+			}()
+		}
+		wg.Wait()
+		close(codes)
+		for code := range codes {
+			assertEqual(t, http.StatusCreated, code)
+		}
+		assertEqual(t, before+1, atomic.LoadInt32(&requests))
+	})
+
+	t.Run("Failures to reach the target aren't cached", func(t *testing.T) {
+		// Nothing listens on port 1
+		for i := 0; i < 2; i++ {
+			w := send("http://127.0.0.1:1/events", "unreachable")
+			assertEqual(t, http.StatusBadGateway, w.Code)
+			assertEqual(t, "", w.Header().Get(IdempotentReplayHeader))
+		}
+	})
+
+	t.Run("Deliveries", func(t *testing.T) {
+		submit := func() map[string]string {
+			r := httptest.NewRequest("POST", "/deliveries", strings.NewReader(`{"url": "`+target.URL+`/events"}`))
+			r.Header.Set("X-Dedup-Key", "delivery")
+			w := httptest.NewRecorder()
+			p.currentHandler().ServeHTTP(w, r)
+			assertEqual(t, http.StatusAccepted, w.Code)
+			body, err := ioutil.ReadAll(w.Body)
+			checkNoError(t, err)
+			var response map[string]string
+			checkNoError(t, json.Unmarshal(body, &response))
+			return response
+		}
+		first := submit()
+		assertEqual(t, first["id"], submit()["id"])
+	})
+}
@@ -0,0 +1,88 @@
+/**
+ * Copyright (c) 2020 Ameya Lokare
+ */
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// requestIdentity is who a request comes from: the principal it authenticated as with
+// Proxy-Authorization, the verified client certificate it presented to an HTTPS listener, and the
+// tenant those put it in
+type requestIdentity struct {
+	principal         string
+	clientCertSubject string
+	clientCertSANs    []string
+	tenant            string
+}
+
+func newRequestIdentity(r *http.Request, principal string) *requestIdentity {
+	identity := &requestIdentity{principal: principal}
+	// VerifiedChains is only set if the certificate chains up to one of the listener's client CAs
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		clientCert := r.TLS.VerifiedChains[0][0]
+		identity.clientCertSubject = clientCert.Subject.String()
+		identity.clientCertSANs = subjectAltNames(clientCert)
+	}
+	return identity
+}
+
+func (id *requestIdentity) addLogFields(fields logrus.Fields) {
+	if id.principal != "" {
+		fields["principal"] = id.principal
+	}
+	if id.clientCertSubject != "" {
+		fields["client_cert_subject"] = id.clientCertSubject
+	}
+	if len(id.clientCertSANs) > 0 {
+		fields["client_cert_san"] = strings.Join(id.clientCertSANs, ",")
+	}
+	if id.tenant != "" {
+		fields["tenant"] = id.tenant
+	}
+}
+
+func subjectAltNames(cert *x509.Certificate) []string {
+	var sans []string
+	sans = append(sans, cert.DNSNames...)
+	sans = append(sans, cert.EmailAddresses...)
+	for _, ip := range cert.IPAddresses {
+		sans = append(sans, ip.String())
+	}
+	for _, uri := range cert.URIs {
+		sans = append(sans, uri.String())
+	}
+	return sans
+}
+
+// listenerTLSConfig returns the TLS config for an HTTPS listener that checks client certificates
+// against the listener's client CAs, or nil if it doesn't check them
+func listenerTLSConfig(listenerConfig ListenerConfig) (*tls.Config, error) {
+	if listenerConfig.ClientAuth == "" || listenerConfig.ClientAuth == ClientAuthNone {
+		return nil, nil
+	}
+	caData, err := ioutil.ReadFile(listenerConfig.ClientCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading client CA file: %s", err)
+	}
+	clientCAs := x509.NewCertPool()
+	if !clientCAs.AppendCertsFromPEM(caData) {
+		return nil, fmt.Errorf("No certificates found in client CA file %s", listenerConfig.ClientCAFile)
+	}
+	clientAuth := tls.VerifyClientCertIfGiven
+	if listenerConfig.ClientAuth == ClientAuthRequire {
+		clientAuth = tls.RequireAndVerifyClientCert
+	}
+	return &tls.Config{
+		ClientCAs:  clientCAs,
+		ClientAuth: clientAuth,
+	}, nil
+}
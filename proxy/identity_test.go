@@ -0,0 +1,46 @@
+/**
+ * Copyright (c) 2020 Ameya Lokare
+ */
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestRequestIdentity(t *testing.T) {
+	t.Run("Verified client certificate", func(t *testing.T) {
+		spiffeID, _ := url.Parse("spiffe://example.org/billing")
+		clientCert := &x509.Certificate{
+			Subject:     pkix.Name{CommonName: "billing", Organization: []string{"Example"}},
+			DNSNames:    []string{"billing.internal"},
+			IPAddresses: []net.IP{net.ParseIP("10.0.0.1")},
+			URIs:        []*url.URL{spiffeID},
+		}
+		r := httptest.NewRequest("GET", "http://example.com", nil)
+		r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{clientCert}}}
+
+		identity := newRequestIdentity(r, "alice")
+		fields := logrus.Fields{}
+		identity.addLogFields(fields)
+		assertEqual(t, "alice", fields["principal"])
+		assertEqual(t, "CN=billing,O=Example", fields["client_cert_subject"])
+		assertEqual(t, "billing.internal,10.0.0.1,spiffe://example.org/billing", fields["client_cert_san"])
+	})
+
+	t.Run("Unverified client certificate is ignored", func(t *testing.T) {
+		r := httptest.NewRequest("GET", "http://example.com", nil)
+		r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{{Subject: pkix.Name{CommonName: "mallory"}}}}
+
+		fields := logrus.Fields{}
+		newRequestIdentity(r, "").addLogFields(fields)
+		assertEqual(t, 0, len(fields))
+	})
+}
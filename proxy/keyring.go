@@ -0,0 +1,448 @@
+/**
+ * Copyright (c) 2020 Ameya Lokare
+ */
+package proxy
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	jwksPath = "/.well-known/jwks.json"
+
+	// keyCreatedHeader is the PEM header recording when a key in a key file was generated
+	keyCreatedHeader = "Created"
+	// keyStatusHeader is the PEM header marking the next key in a key file, which is published but
+	// not used yet
+	keyStatusHeader = "Status"
+	keyStatusNext   = "next"
+
+	// jwksMaxAge is how long verifiers may cache the JWKS for
+	jwksMaxAge = 5 * time.Minute
+)
+
+var (
+	keyRotationCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "signing_key_rotations",
+		Help: "Rotations of the ed25519 and ecdsa signing keys, by result",
+	}, []string{"result"})
+
+	// keyRingCheckInterval is how often key files are checked for keys that are due to be rotated,
+	// or that were changed by someone else
+	keyRingCheckInterval = time.Minute
+)
+
+// signingKey is a private key for one of the asymmetric signing schemes
+type signingKey struct {
+	id        string
+	private   crypto.Signer
+	createdAt time.Time
+}
+
+func generateSigningKey(scheme SigningScheme, now time.Time) (*signingKey, error) {
+	var private crypto.Signer
+	var err error
+	if scheme == SigningSchemeEd25519 {
+		_, private, err = ed25519.GenerateKey(rand.Reader)
+	} else {
+		private, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return newSigningKey(private, now.UTC().Truncate(time.Second))
+}
+
+func newSigningKey(private crypto.Signer, createdAt time.Time) (*signingKey, error) {
+	key := &signingKey{private: private, createdAt: createdAt}
+	jwk, err := key.jwk()
+	if err != nil {
+		return nil, err
+	}
+	key.id = jwk.thumbprint()
+	return key, nil
+}
+
+// sign signs data with Ed25519, or with ECDSA over its SHA-256 hash in the fixed length r || s
+// form that JWS uses
+func (k *signingKey) sign(data []byte) ([]byte, error) {
+	switch private := k.private.(type) {
+	case ed25519.PrivateKey:
+		return ed25519.Sign(private, data), nil
+	case *ecdsa.PrivateKey:
+		digest := sha256.Sum256(data)
+		r, s, err := ecdsa.Sign(rand.Reader, private, digest[:])
+		if err != nil {
+			return nil, err
+		}
+		signature := make([]byte, 64)
+		r.FillBytes(signature[:32])
+		s.FillBytes(signature[32:])
+		return signature, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %T", k.private)
+}
+
+// jsonWebKey is the public half of a signing key, as published in the JWKS
+type jsonWebKey struct {
+	KeyType   string `json:"kty"`
+	Curve     string `json:"crv"`
+	X         string `json:"x"`
+	Y         string `json:"y,omitempty"`
+	KeyID     string `json:"kid,omitempty"`
+	Algorithm string `json:"alg"`
+	Use       string `json:"use"`
+}
+
+func (k *signingKey) jwk() (*jsonWebKey, error) {
+	switch public := PublicKey(k.private).(type) {
+	case ed25519.PublicKey:
+		return &jsonWebKey{KeyType: "OKP", Curve: "Ed25519", X: base64.RawURLEncoding.EncodeToString(public), KeyID: k.id, Algorithm: "EdDSA", Use: "sig"}, nil
+	case *ecdsa.PublicKey:
+		if public.Curve != elliptic.P256() {
+			return nil, fmt.Errorf("unsupported ECDSA curve %s; only P-256 is supported", public.Curve.Params().Name)
+		}
+		x, y := make([]byte, 32), make([]byte, 32)
+		public.X.FillBytes(x)
+		public.Y.FillBytes(y)
+		return &jsonWebKey{KeyType: "EC", Curve: "P-256", X: base64.RawURLEncoding.EncodeToString(x), Y: base64.RawURLEncoding.EncodeToString(y), KeyID: k.id, Algorithm: "ES256", Use: "sig"}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %T", k.private)
+}
+
+// thumbprint is the RFC 7638 thumbprint of the key, which is used as its ID
+func (j *jsonWebKey) thumbprint() string {
+	var members string
+	if j.KeyType == "EC" {
+		members = fmt.Sprintf(`{"crv":%q,"kty":%q,"x":%q,"y":%q}`, j.Curve, j.KeyType, j.X, j.Y)
+	} else {
+		members = fmt.Sprintf(`{"crv":%q,"kty":%q,"x":%q}`, j.Curve, j.KeyType, j.X)
+	}
+	digest := sha256.Sum256([]byte(members))
+	return base64.RawURLEncoding.EncodeToString(digest[:])
+}
+
+// signingKeyRing is the current and previous key for an asymmetric signing key alias, kept in its
+// key file. Requests are signed with the current key; the previous one is still published, so that
+// signatures made just before a rotation can be verified. If keys are rotated, the next key is
+// published too, a rotation period before it replaces the current one, so that verifiers caching
+// the JWKS have it before the first signature made with it.
+type signingKeyRing struct {
+	scheme         SigningScheme
+	keyFile        string
+	rotationPeriod time.Duration
+	now            func() time.Time
+
+	mu sync.Mutex
+	// keys are newest first
+	keys    []*signingKey
+	next    *signingKey
+	modTime time.Time
+}
+
+func openSigningKeyRing(config SigningKeyConfig) (*signingKeyRing, error) {
+	ring := &signingKeyRing{scheme: config.Scheme, keyFile: config.KeyFile, rotationPeriod: config.RotationPeriod, now: time.Now}
+	if err := ring.check(); err != nil {
+		return nil, err
+	}
+	return ring, nil
+}
+
+func (r *signingKeyRing) current() *signingKey {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.keys[0]
+}
+
+func (r *signingKeyRing) publicKeys() []*jsonWebKey {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var keys []*jsonWebKey
+	all := r.keys
+	if r.next != nil {
+		all = append([]*signingKey{r.next}, all...)
+	}
+	for _, key := range all {
+		// Keys were checked when they were loaded
+		jwk, _ := key.jwk()
+		keys = append(keys, jwk)
+	}
+	return keys
+}
+
+// check loads the key file if it has changed since it was last loaded, then rotates the current key
+// if it's due, which is once the next key has been published for the rotation period. A missing key
+// file is created with a new key.
+func (r *signingKeyRing) check() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	info, err := os.Stat(r.keyFile)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil && !info.ModTime().Equal(r.modTime) {
+		keys, next, err := r.load(info.ModTime())
+		if err != nil {
+			return fmt.Errorf("Error loading key file %s: %s", r.keyFile, err)
+		}
+		r.keys = keys
+		r.next = next
+		r.modTime = info.ModTime()
+	}
+	due := len(r.keys) == 0 || (r.rotationPeriod > 0 && (r.next == nil || r.now().Sub(r.next.createdAt) >= r.rotationPeriod))
+	if !due {
+		return nil
+	}
+	if err := r.rotate(); err != nil {
+		keyRotationCounter.With(prometheus.Labels{"result": "failure"}).Inc()
+		return fmt.Errorf("Error rotating key in %s: %s", r.keyFile, err)
+	}
+	keyRotationCounter.With(prometheus.Labels{"result": "success"}).Inc()
+	if r.next != nil {
+		log.Infof("Rotated signing key in %s; the current key ID is %s, and the next %s\n", r.keyFile, r.keys[0].id, r.next.id)
+	} else {
+		log.Infof("Rotated signing key in %s; the new key ID is %s\n", r.keyFile, r.keys[0].id)
+	}
+	return nil
+}
+
+// load reads the keys in the key file, which are PEM encoded PKCS #8 private keys, newest first,
+// and the next key, if there's one marked with the Status header. Keys without a Created header are
+// taken to have been created when the file was last modified.
+func (r *signingKeyRing) load(modTime time.Time) ([]*signingKey, *signingKey, error) {
+	data, err := ioutil.ReadFile(r.keyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	var keys []*signingKey
+	var next *signingKey
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "PRIVATE KEY" {
+			continue
+		}
+		private, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := checkKeyType(r.scheme, private); err != nil {
+			return nil, nil, err
+		}
+		createdAt := modTime
+		if created, ok := block.Headers[keyCreatedHeader]; ok {
+			if createdAt, err = time.Parse(time.RFC3339, created); err != nil {
+				return nil, nil, fmt.Errorf("invalid %s header: %s", keyCreatedHeader, err)
+			}
+		}
+		key, err := newSigningKey(private.(crypto.Signer), createdAt)
+		if err != nil {
+			return nil, nil, err
+		}
+		if block.Headers[keyStatusHeader] == keyStatusNext {
+			next = key
+		} else {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return nil, nil, fmt.Errorf("no private keys found")
+	}
+	return keys, next, nil
+}
+
+func checkKeyType(scheme SigningScheme, private interface{}) error {
+	switch private.(type) {
+	case ed25519.PrivateKey:
+		if scheme == SigningSchemeEd25519 {
+			return nil
+		}
+	case *ecdsa.PrivateKey:
+		if scheme == SigningSchemeECDSA {
+			return nil
+		}
+	}
+	return fmt.Errorf("%T can't be used for the %s scheme", private, scheme)
+}
+
+// rotate makes the next key the current one, keeping the old one as the previous key, and
+// generates a new next key if keys are rotated, then saves the keys. Without a next key, it
+// generates one, and only generates a current key if there's none. It must be called with mu held.
+func (r *signingKeyRing) rotate() error {
+	keys, next := r.keys, r.next
+	if len(keys) == 0 {
+		key, err := generateSigningKey(r.scheme, r.now())
+		if err != nil {
+			return err
+		}
+		keys = []*signingKey{key}
+	} else if next != nil {
+		keys, next = []*signingKey{next, keys[0]}, nil
+	}
+	if next == nil && r.rotationPeriod > 0 {
+		var err error
+		if next, err = generateSigningKey(r.scheme, r.now()); err != nil {
+			return err
+		}
+	}
+	modTime, err := r.save(keys, next)
+	if err != nil {
+		return err
+	}
+	r.keys = keys
+	r.next = next
+	r.modTime = modTime
+	return nil
+}
+
+// save replaces the key file with next, if set, and keys. The file is written alongside and renamed
+// into place, so that a crash doesn't leave it half written.
+func (r *signingKeyRing) save(keys []*signingKey, next *signingKey) (time.Time, error) {
+	var data []byte
+	if next != nil {
+		keys = append([]*signingKey{next}, keys...)
+	}
+	for _, key := range keys {
+		der, err := x509.MarshalPKCS8PrivateKey(key.private)
+		if err != nil {
+			return time.Time{}, err
+		}
+		headers := map[string]string{keyCreatedHeader: key.createdAt.UTC().Format(time.RFC3339)}
+		if key == next {
+			headers[keyStatusHeader] = keyStatusNext
+		}
+		data = append(data, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Headers: headers, Bytes: der})...)
+	}
+	tmpFile := r.keyFile + ".tmp"
+	if err := ioutil.WriteFile(tmpFile, data, 0600); err != nil {
+		return time.Time{}, err
+	}
+	if err := os.Rename(tmpFile, r.keyFile); err != nil {
+		os.Remove(tmpFile)
+		return time.Time{}, err
+	}
+	info, err := os.Stat(r.keyFile)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return info.ModTime(), nil
+}
+
+// signingKeyRings holds the key rings for the asymmetric signing keys. It's owned by Proxy, so that
+// keys are rotated on schedule whether or not the config is reloaded.
+type signingKeyRings struct {
+	mu    sync.Mutex
+	rings map[string]*signingKeyRing
+
+	stopping chan struct{}
+	stopped  chan struct{}
+}
+
+func newSigningKeyRings() *signingKeyRings {
+	return &signingKeyRings{rings: make(map[string]*signingKeyRing), stopping: make(chan struct{}), stopped: make(chan struct{})}
+}
+
+// open returns the key rings for the asymmetric keys in configs, reusing the current ones where
+// their settings haven't changed. They aren't used until they're passed to set.
+func (k *signingKeyRings) open(configs map[string]SigningKeyConfig) (map[string]*signingKeyRing, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	rings := make(map[string]*signingKeyRing)
+	for alias, config := range configs {
+		if !config.Scheme.isAsymmetric() {
+			continue
+		}
+		ring := k.rings[alias]
+		if ring == nil || ring.scheme != config.Scheme || ring.keyFile != config.KeyFile || ring.rotationPeriod != config.RotationPeriod {
+			var err error
+			if ring, err = openSigningKeyRing(config); err != nil {
+				return nil, fmt.Errorf("Signing key %s: %s", alias, err)
+			}
+		}
+		rings[alias] = ring
+	}
+	return rings, nil
+}
+
+// set makes rings the ones that are rotated and published
+func (k *signingKeyRings) set(rings map[string]*signingKeyRing) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.rings = rings
+}
+
+// start begins rotating keys on schedule
+func (k *signingKeyRings) start() {
+	go func() {
+		defer close(k.stopped)
+		ticker := time.NewTicker(keyRingCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				k.check()
+			case <-k.stopping:
+				return
+			}
+		}
+	}()
+}
+
+func (k *signingKeyRings) check() {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	for alias, ring := range k.rings {
+		if err := ring.check(); err != nil {
+			log.Errorf("Signing key %s: %s\n", alias, err)
+		}
+	}
+}
+
+func (k *signingKeyRings) close() {
+	close(k.stopping)
+	<-k.stopped
+}
+
+// handleJWKS serves the public keys of every asymmetric signing key, next, current and previous, as
+// a JSON Web Key Set
+func (k *signingKeyRings) handleJWKS(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "The JWKS must be fetched with a GET", http.StatusMethodNotAllowed)
+		return
+	}
+	k.mu.Lock()
+	aliases := make([]string, 0, len(k.rings))
+	for alias := range k.rings {
+		aliases = append(aliases, alias)
+	}
+	sort.Strings(aliases)
+	keys := []*jsonWebKey{}
+	for _, alias := range aliases {
+		keys = append(keys, k.rings[alias].publicKeys()...)
+	}
+	k.mu.Unlock()
+	w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", int(jwksMaxAge.Seconds())))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string][]*jsonWebKey{"keys": keys})
+}
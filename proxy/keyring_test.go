@@ -0,0 +1,212 @@
+/**
+ * Copyright (c) 2020 Ameya Lokare
+ */
+package proxy
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJWKThumbprint(t *testing.T) {
+	// From RFC 8037, appendix A.3
+	jwk := &jsonWebKey{KeyType: "OKP", Curve: "Ed25519", X: "11qYAYKxCrfVS_7TyWQHOg7hcvPapiMlrwIaaPcHURo"}
+	assertEqual(t, "kPrK_qmxVWaYVA9wwBF6Iuo3vVzz7TxHCTwXBygrS4k", jwk.thumbprint())
+}
+
+func TestSigningKeyRing(t *testing.T) {
+	now := time.Now()
+	open := func(t *testing.T, config SigningKeyConfig) *signingKeyRing {
+		ring := &signingKeyRing{scheme: config.Scheme, keyFile: config.KeyFile, rotationPeriod: config.RotationPeriod, now: func() time.Time { return now }}
+		checkNoError(t, ring.check())
+		return ring
+	}
+
+	t.Run("Rotation", func(t *testing.T) {
+		config := SigningKeyConfig{Scheme: SigningSchemeEd25519, KeyFile: filepath.Join(t.TempDir(), "keys.pem"), RotationPeriod: time.Hour}
+		ring := open(t, config)
+		first := ring.current()
+		keys := ring.publicKeys()
+		assertEqual(t, 2, len(keys))
+		assertEqual(t, first.id, keys[1].KeyID)
+		// The next key is published before anything is signed with it
+		next := keys[0].KeyID
+		if next == first.id {
+			t.Fatalf("Expected a next key")
+		}
+		info, err := os.Stat(config.KeyFile)
+		checkNoError(t, err)
+		assertEqual(t, os.FileMode(0600), info.Mode().Perm())
+
+		now = now.Add(59 * time.Minute)
+		checkNoError(t, ring.check())
+		assertEqual(t, first.id, ring.current().id)
+
+		now = now.Add(time.Minute)
+		checkNoError(t, ring.check())
+		second := ring.current()
+		assertEqual(t, next, second.id)
+		keys = ring.publicKeys()
+		assertEqual(t, 3, len(keys))
+		assertEqual(t, second.id, keys[1].KeyID)
+		assertEqual(t, first.id, keys[2].KeyID)
+
+		now = now.Add(time.Hour)
+		checkNoError(t, ring.check())
+		keys = ring.publicKeys()
+		assertEqual(t, 3, len(keys))
+		assertEqual(t, keys[1].KeyID, ring.current().id)
+		assertEqual(t, second.id, keys[2].KeyID)
+
+		// The keys survive a restart
+		reopened := open(t, config)
+		assertEqual(t, ring.current().id, reopened.current().id)
+		assertEqual(t, 3, len(reopened.publicKeys()))
+		assertEqual(t, keys[0].KeyID, reopened.publicKeys()[0].KeyID)
+	})
+
+	t.Run("A next key is added to key files without one", func(t *testing.T) {
+		keyFile := filepath.Join(t.TempDir(), "keys.pem")
+		current := open(t, SigningKeyConfig{Scheme: SigningSchemeEd25519, KeyFile: keyFile}).current()
+		ring := open(t, SigningKeyConfig{Scheme: SigningSchemeEd25519, KeyFile: keyFile, RotationPeriod: time.Hour})
+		assertEqual(t, current.id, ring.current().id)
+		assertEqual(t, 2, len(ring.publicKeys()))
+	})
+
+	t.Run("Changes to the key file are picked up", func(t *testing.T) {
+		config := SigningKeyConfig{Scheme: SigningSchemeECDSA, KeyFile: filepath.Join(t.TempDir(), "keys.pem")}
+		ring := open(t, config)
+		other := open(t, SigningKeyConfig{Scheme: SigningSchemeECDSA, KeyFile: filepath.Join(t.TempDir(), "keys.pem")})
+		data, err := ioutil.ReadFile(other.keyFile)
+		checkNoError(t, err)
+		checkNoError(t, ioutil.WriteFile(config.KeyFile, data, 0600))
+		later := time.Now().Add(time.Minute)
+		checkNoError(t, os.Chtimes(config.KeyFile, later, later))
+		checkNoError(t, ring.check())
+		assertEqual(t, other.current().id, ring.current().id)
+	})
+
+	t.Run("Key type must match the scheme", func(t *testing.T) {
+		keyFile := filepath.Join(t.TempDir(), "keys.pem")
+		open(t, SigningKeyConfig{Scheme: SigningSchemeEd25519, KeyFile: keyFile})
+		_, err := openSigningKeyRing(SigningKeyConfig{Scheme: SigningSchemeECDSA, KeyFile: keyFile})
+		assertError(t, "can't be used for the ecdsa scheme", err)
+	})
+}
+
+// failingSigner is a private key that can't sign
+type failingSigner struct {
+	crypto.Signer
+}
+
+func TestAsymmetricSigning(t *testing.T) {
+	keyDir := t.TempDir()
+	config := NewDefaultConfig()
+	config.SigningKeys = map[string]SigningKeyConfig{
+		"ed": {Scheme: SigningSchemeEd25519, KeyFile: filepath.Join(keyDir, "ed.pem")},
+		"ec": {Scheme: SigningSchemeECDSA, KeyFile: filepath.Join(keyDir, "ec.pem"), Header: "Acme-Signature", KeyIDHeader: "Acme-Key-Id"},
+	}
+	checkNoError(t, config.validate())
+	p := NewProxy(config, "")
+	defer p.Shutdown(context.Background())
+
+	w := httptest.NewRecorder()
+	newAdminHandler(p).ServeHTTP(w, httptest.NewRequest("GET", jwksPath, nil))
+	assertEqual(t, http.StatusOK, w.Code)
+	var jwks struct {
+		Keys []*jsonWebKey `json:"keys"`
+	}
+	checkNoError(t, json.Unmarshal(w.Body.Bytes(), &jwks))
+	assertEqual(t, 2, len(jwks.Keys))
+	published := make(map[string]*jsonWebKey)
+	for _, key := range jwks.Keys {
+		published[key.KeyID] = key
+	}
+
+	signatureOf := func(t *testing.T, alias string, body string) (*jsonWebKey, string, []byte) {
+		signer := p.currentHandler().signers[alias]
+		h := http.Header{}
+		checkNoError(t, signer.sign(h, []byte(body), "rq-1", time.Unix(1600000000, 0)))
+		key := published[h.Get(signer.keyIDHeader)]
+		if key == nil {
+			t.Fatalf("Expected key %s to be published", h.Get(signer.keyIDHeader))
+		}
+		parts := strings.Split(h.Get(signer.header), ",")
+		assertEqual(t, 2, len(parts))
+		assertEqual(t, "t=1600000000", parts[0])
+		signature, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(parts[1], "v1="))
+		checkNoError(t, err)
+		return key, "1600000000." + body, signature
+	}
+	decode := func(t *testing.T, s string) []byte {
+		b, err := base64.RawURLEncoding.DecodeString(s)
+		checkNoError(t, err)
+		return b
+	}
+
+	t.Run("Ed25519", func(t *testing.T) {
+		key, signed, signature := signatureOf(t, "ed", `{"event": "paid"}`)
+		assertEqual(t, "EdDSA", key.Algorithm)
+		if !ed25519.Verify(ed25519.PublicKey(decode(t, key.X)), []byte(signed), signature) {
+			t.Fatalf("Expected the signature to verify with the published key")
+		}
+	})
+
+	t.Run("ECDSA", func(t *testing.T) {
+		key, signed, signature := signatureOf(t, "ec", `{"event": "paid"}`)
+		assertEqual(t, "ES256", key.Algorithm)
+		public := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(decode(t, key.X)), Y: new(big.Int).SetBytes(decode(t, key.Y))}
+		digest := sha256.Sum256([]byte(signed))
+		assertEqual(t, 64, len(signature))
+		r, s := new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])
+		if !ecdsa.Verify(public, digest[:], r, s) {
+			t.Fatalf("Expected the signature to verify with the published key")
+		}
+	})
+
+	t.Run("Requests aren't sent unsigned", func(t *testing.T) {
+		ring := p.currentHandler().signers["ed"].ring
+		ring.mu.Lock()
+		current := ring.keys[0]
+		ring.keys[0] = &signingKey{id: "broken", private: failingSigner{}}
+		ring.mu.Unlock()
+		defer func() {
+			ring.mu.Lock()
+			ring.keys[0] = current
+			ring.mu.Unlock()
+		}()
+		r := httptest.NewRequest("POST", "http://127.0.0.1:9/events", strings.NewReader(`{"event": "paid"}`))
+		r.Header.Set(SigningKeyHeader, "ed")
+		w := httptest.NewRecorder()
+		p.currentHandler().ServeHTTP(w, r)
+		assertEqual(t, http.StatusInternalServerError, w.Code)
+		assertEqual(t, strconv.Itoa(int(SigningFailed)), w.Header().Get(ReasonCodeHeader))
+	})
+
+	t.Run("Config", func(t *testing.T) {
+		_, err := UnmarshalConfig([]byte(`signingKeys: {acme: {scheme: ed25519}}`))
+		assertError(t, "keyFile must be set", err)
+		_, err = UnmarshalConfig([]byte(`signingKeys: {acme: {scheme: ecdsa, keyFile: /tmp/keys.pem, secrets: [abc]}}`))
+		assertError(t, "secrets and secretsFile can't be set", err)
+		_, err = UnmarshalConfig([]byte(`signingKeys: {acme: {scheme: ed25519, keyFile: /tmp/keys.pem, rotationPeriod: 1m}}`))
+		assertError(t, "rotationPeriod must be at least 5m0s", err)
+		_, err = UnmarshalConfig([]byte(`signingKeys: {acme: {scheme: stripe, secrets: [abc], rotationPeriod: 24h}}`))
+		assertError(t, "can only be set for the ed25519 and ecdsa schemes", err)
+	})
+}
@@ -0,0 +1,82 @@
+/**
+ * Copyright (c) 2020 Ameya Lokare
+ */
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"time"
+)
+
+const (
+	// MetadataHeader opts a request in to the connection metadata response headers below
+	MetadataHeader string = "X-WhSentry-Metadata"
+
+	UpstreamIPHeader      string = "X-WhSentry-Upstream-IP"
+	TLSVersionHeader      string = "X-WhSentry-TLS-Version"
+	TLSCipherHeader       string = "X-WhSentry-TLS-Cipher"
+	PeerCertSubjectHeader string = "X-WhSentry-Peer-Cert-Subject"
+	PeerCertExpiryHeader  string = "X-WhSentry-Peer-Cert-Expiry"
+)
+
+// connMetadata records the outbound connection a request was sent on
+type connMetadata struct {
+	conn net.Conn
+}
+
+// withConnMetadata returns a context that records the outbound connection in metadata once the
+// transport has got one
+func withConnMetadata(ctx context.Context, metadata *connMetadata) context.Context {
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			metadata.conn = info.Conn
+		},
+	})
+}
+
+var metadataHeaders = []string{UpstreamIPHeader, TLSVersionHeader, TLSCipherHeader, PeerCertSubjectHeader, PeerCertExpiryHeader}
+
+// writeHeaders sets the metadata headers in h, replacing any the target may have sent
+func (m *connMetadata) writeHeaders(h http.Header) {
+	for _, header := range metadataHeaders {
+		h.Del(header)
+	}
+	if m.conn == nil {
+		return
+	}
+	if tcpAddr, ok := m.conn.RemoteAddr().(*net.TCPAddr); ok {
+		h.Set(UpstreamIPHeader, tcpAddr.IP.String())
+	}
+	tlsConn, ok := m.conn.(*tls.Conn)
+	if !ok {
+		return
+	}
+	state := tlsConn.ConnectionState()
+	h.Set(TLSVersionHeader, tlsVersionName(state.Version))
+	h.Set(TLSCipherHeader, tls.CipherSuiteName(state.CipherSuite))
+	if len(state.PeerCertificates) > 0 {
+		peerCert := state.PeerCertificates[0]
+		h.Set(PeerCertSubjectHeader, peerCert.Subject.String())
+		h.Set(PeerCertExpiryHeader, peerCert.NotAfter.UTC().Format(time.RFC3339))
+	}
+}
+
+func tlsVersionName(version uint16) string {
+	switch version {
+	case tls.VersionTLS10:
+		return "TLS 1.0"
+	case tls.VersionTLS11:
+		return "TLS 1.1"
+	case tls.VersionTLS12:
+		return "TLS 1.2"
+	case tls.VersionTLS13:
+		return "TLS 1.3"
+	default:
+		return fmt.Sprintf("0x%04X", version)
+	}
+}
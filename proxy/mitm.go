@@ -28,6 +28,7 @@ type Mitmer struct {
 	issuerPrivateKey     crypto.PrivateKey
 	generatedCertKeyPair *rsa.PrivateKey
 	doTLSHandshake       func(conn net.Conn, hostname string, certAlias string) (net.Conn, error)
+	tunnels              *tunnelTracker
 }
 
 func NewMitmer() (*Mitmer, error) {
@@ -39,8 +40,10 @@ func NewMitmer() (*Mitmer, error) {
 }
 
 func (m *Mitmer) HandleHttpConnect(requestID string, w http.ResponseWriter, r *http.Request) {
+	m.tunnels.start()
+	defer m.tunnels.done()
 	// TODO: think about what context deadlines to set etc
-	outboundConn, err := m.dialContext(context.Background(), "tcp4", r.RequestURI)
+	outboundConn, err := m.dialContext(context.Background(), "tcp", r.RequestURI)
 	if err != nil {
 		responseCode, errorCode, errorMsg := mapError(requestID, err)
 		sendHTTPError(w, responseCode, errorCode, errorMsg)
@@ -58,6 +61,8 @@ func (m *Mitmer) HandleHttpConnect(requestID string, w http.ResponseWriter, r *h
 		return
 	}
 	defer inboundConn.Close()
+	m.tunnels.track(inboundConn)
+	defer m.tunnels.untrack(inboundConn)
 	bufrw.WriteString("HTTP/1.1 200 Connection Established\r\n")
 	bufrw.WriteString("Connection: Close\r\n")
 	bufrw.WriteString("\r\n")
@@ -0,0 +1,171 @@
+/**
+ * Copyright (c) 2020 Ameya Lokare
+ */
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// hostPolicy decides which destination hostnames may be connected to, before they are resolved.
+//
+// A pattern starting with a dot is a suffix match: ".example.com" matches example.com and all of
+// its subdomains. Any other pattern is a glob as understood by path.Match, e.g. "*.example.com" or
+// "api-?.example.com". Matching is case-insensitive.
+type hostPolicy struct {
+	allowList []string
+	denyList  []string
+}
+
+func newHostPolicy(allowList []string, denyList []string) *hostPolicy {
+	return &hostPolicy{
+		allowList: normalizeHostPatterns(allowList),
+		denyList:  normalizeHostPatterns(denyList),
+	}
+}
+
+// isAllowed is true if host isn't in the deny list and, when there is an allow list, is in it
+func (h *hostPolicy) isAllowed(host string) bool {
+	host = normalizeHost(host)
+	if matchesHostPattern(h.denyList, host) {
+		return false
+	}
+	if len(h.allowList) > 0 && !matchesHostPattern(h.allowList, host) {
+		return false
+	}
+	return true
+}
+
+func (s *safeDialer) checkHost(addr string) error {
+	if s.hostPolicy == nil {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if !s.hostPolicy.isAllowed(host) {
+		return &proxyError{statusCode: http.StatusForbidden, message: fmt.Sprintf("Host %s is blocked", host), errorCode: BlockedHostname}
+	}
+	return nil
+}
+
+func matchesHostPattern(patterns []string, host string) bool {
+	for _, pattern := range patterns {
+		if strings.HasPrefix(pattern, ".") {
+			if host == pattern[1:] || strings.HasSuffix(host, pattern) {
+				return true
+			}
+		} else if matched, _ := path.Match(pattern, host); matched {
+			return true
+		}
+	}
+	return false
+}
+
+func normalizeHostPatterns(patterns []string) []string {
+	var normalized []string
+	for _, pattern := range patterns {
+		normalized = append(normalized, normalizeHost(pattern))
+	}
+	return normalized
+}
+
+func normalizeHost(host string) string {
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+func validateHostPatterns(patterns []string) error {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("Invalid host pattern %s; %s", pattern, err)
+		}
+	}
+	return nil
+}
+
+// PortRange is a single port ("443") or an inclusive range of ports ("8000-8999")
+type PortRange struct {
+	From uint16
+	To   uint16
+}
+
+func (p *PortRange) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var portStr string
+	if err := unmarshal(&portStr); err != nil {
+		return err
+	}
+	portRange, err := parsePortRange(portStr)
+	if err != nil {
+		return err
+	}
+	*p = *portRange
+	return nil
+}
+
+func parsePortRange(portStr string) (*PortRange, error) {
+	fromStr, toStr := portStr, portStr
+	if i := strings.Index(portStr, "-"); i >= 0 {
+		fromStr, toStr = portStr[:i], portStr[i+1:]
+	}
+	from, err := strconv.ParseUint(strings.TrimSpace(fromStr), 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid port or port range %s", portStr)
+	}
+	to, err := strconv.ParseUint(strings.TrimSpace(toStr), 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid port or port range %s", portStr)
+	}
+	if from == 0 || from > to {
+		return nil, fmt.Errorf("Invalid port or port range %s", portStr)
+	}
+	return &PortRange{From: uint16(from), To: uint16(to)}, nil
+}
+
+func (p PortRange) contains(port uint16) bool {
+	return port >= p.From && port <= p.To
+}
+
+// portPolicy decides which destination ports may be connected to. Denied ports always win; an
+// empty allow list allows every port that isn't denied.
+type portPolicy struct {
+	allowed []PortRange
+	denied  []PortRange
+}
+
+func (p *portPolicy) isAllowed(port uint16) bool {
+	for _, portRange := range p.denied {
+		if portRange.contains(port) {
+			return false
+		}
+	}
+	if len(p.allowed) == 0 {
+		return true
+	}
+	for _, portRange := range p.allowed {
+		if portRange.contains(port) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *safeDialer) checkPort(addr string) error {
+	if s.portPolicy == nil {
+		return nil
+	}
+	_, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil || !s.portPolicy.isAllowed(uint16(port)) {
+		return &proxyError{statusCode: http.StatusForbidden, message: fmt.Sprintf("Port %s is not allowed", portStr), errorCode: PortNotAllowed}
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+/**
+ * Copyright (c) 2020 Ameya Lokare
+ */
+package proxy
+
+import (
+	"net"
+	"testing"
+)
+
+func TestHostPolicy(t *testing.T) {
+	t.Run("Deny list", func(t *testing.T) {
+		policy := newHostPolicy(nil, []string{".internal.example.com", "metadata.*", "*.local"})
+		for _, host := range []string{"internal.example.com", "db.internal.example.com", "METADATA.google.internal", "printer.local", "printer.local."} {
+			if policy.isAllowed(host) {
+				t.Errorf("Expected host %s to be blocked, but it was allowed", host)
+			}
+		}
+		for _, host := range []string{"example.com", "notinternal.example.com", "local"} {
+			if !policy.isAllowed(host) {
+				t.Errorf("Expected host %s to be allowed, but it was blocked", host)
+			}
+		}
+	})
+
+	t.Run("Allow list", func(t *testing.T) {
+		policy := newHostPolicy([]string{".partner.com", "hooks-?.example.com"}, []string{"legacy.partner.com"})
+		for _, host := range []string{"partner.com", "api.partner.com", "hooks-1.example.com"} {
+			if !policy.isAllowed(host) {
+				t.Errorf("Expected host %s to be allowed, but it was blocked", host)
+			}
+		}
+		for _, host := range []string{"legacy.partner.com", "example.com", "hooks-10.example.com"} {
+			if policy.isAllowed(host) {
+				t.Errorf("Expected host %s to be blocked, but it was allowed", host)
+			}
+		}
+	})
+
+	t.Run("Blocked hostname reason code", func(t *testing.T) {
+		config := NewDefaultConfig()
+		config.HostDenyList = []string{"*.example.com"}
+		sd := newSafeDialer(config)
+		_, errorCode, _ := mapError("test", sd.checkHost("www.example.com:443"))
+		if errorCode != BlockedHostname {
+			t.Errorf("Expected error code %d, got %d", BlockedHostname, errorCode)
+		}
+		if err := sd.checkHost("www.example.org:443"); err != nil {
+			t.Errorf("Expected no error, got %s", err)
+		}
+	})
+
+	t.Run("Invalid pattern", func(t *testing.T) {
+		assertError(t, "Invalid host pattern", validateHostPatterns([]string{"[a-"}))
+	})
+}
+
+func TestCidrAllowList(t *testing.T) {
+	config, err := UnmarshalConfig([]byte(`cidrAllowList: ["10.20.0.0/16", "fd12:3456::/32"]`))
+	checkNoError(t, err)
+	sd := newSafeDialer(config)
+	for _, ip := range []string{"10.20.1.1", "fd12:3456::1"} {
+		if sd.isBlocked(net.ParseIP(ip)) {
+			t.Errorf("Expected IP %s to be allowed, but it was blocked", ip)
+		}
+	}
+	for _, ip := range []string{"10.21.1.1", "127.0.0.1", "fd12:3457::1"} {
+		if !sd.isBlocked(net.ParseIP(ip)) {
+			t.Errorf("Expected IP %s to be blocked, but it was allowed", ip)
+		}
+	}
+}
+
+func TestPortPolicy(t *testing.T) {
+	config, err := UnmarshalConfig([]byte(`
+allowedPorts: [80, 443, "8000-8999"]
+deniedPorts: [8500]
+`))
+	checkNoError(t, err)
+	sd := newSafeDialer(config)
+	for _, addr := range []string{"example.com:80", "example.com:443", "example.com:8000", "example.com:8999"} {
+		checkNoError(t, sd.checkPort(addr))
+	}
+	for _, addr := range []string{"example.com:25", "example.com:6379", "example.com:8500", "example.com:9000"} {
+		_, errorCode, _ := mapError("test", sd.checkPort(addr))
+		if errorCode != PortNotAllowed {
+			t.Errorf("Expected error code %d for %s, got %d", PortNotAllowed, addr, errorCode)
+		}
+	}
+
+	t.Run("Defaults", func(t *testing.T) {
+		sd := newSafeDialer(NewDefaultConfig())
+		checkNoError(t, sd.checkPort("example.com:8443"))
+		assertError(t, "Port 25 is not allowed", sd.checkPort("example.com:25"))
+	})
+
+	t.Run("Empty allow list allows all ports", func(t *testing.T) {
+		config, err := UnmarshalConfig([]byte(`
+allowedPorts: []
+deniedPorts: [25]
+`))
+		checkNoError(t, err)
+		sd := newSafeDialer(config)
+		checkNoError(t, sd.checkPort("example.com:6379"))
+		assertError(t, "Port 25 is not allowed", sd.checkPort("example.com:25"))
+	})
+
+	t.Run("Invalid port range", func(t *testing.T) {
+		_, err := UnmarshalConfig([]byte(`allowedPorts: ["9000-8000"]`))
+		assertError(t, "Invalid port or port range 9000-8000", err)
+	})
+}
@@ -0,0 +1,631 @@
+/**
+ * Copyright (c) 2020 Ameya Lokare
+ */
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/http2"
+)
+
+var (
+	pooledConnectionsGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "pooled_connections",
+		Help: "Outbound connections held by the connection pool, by whether they're idle or in use",
+	}, []string{"state"})
+
+	pooledConnectionRequestsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "pooled_connection_requests",
+		Help: "Requests sent through the connection pool, by whether they got a new or reused connection",
+	}, []string{"connection"})
+
+	pooledConnectionsExpiredCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "pooled_connections_expired",
+		Help: "Pooled connections closed for reaching maxConnectionAge",
+	})
+
+	// poolSweepInterval is how often connections are checked against maxConnectionAge, and HTTP/2
+	// connections against idleTimeout
+	poolSweepInterval = 5 * time.Second
+)
+
+// ConnectionPoolConfig configures keeping outbound connections open to be reused
+type ConnectionPoolConfig struct {
+	// Enabled turns pooling on; otherwise every request gets a new connection
+	Enabled bool `yaml:"enabled"`
+	// MaxIdlePerHost is the most idle connections kept to any one address
+	MaxIdlePerHost int `yaml:"maxIdlePerHost"`
+	// IdleTimeout is how long an idle connection is kept open
+	IdleTimeout time.Duration `yaml:"idleTimeout"`
+	// MaxConnectionAge is how long after being opened a connection stops being reused, or 0 for no limit
+	MaxConnectionAge time.Duration `yaml:"maxConnectionAge"`
+}
+
+func validateConnectionPoolConfig(c ConnectionPoolConfig) error {
+	if c.MaxIdlePerHost <= 0 {
+		return fmt.Errorf("Connection pool maxIdlePerHost must be positive")
+	}
+	if c.IdleTimeout <= 0 {
+		return fmt.Errorf("Connection pool idleTimeout must be positive")
+	}
+	if c.MaxConnectionAge < 0 {
+		return fmt.Errorf("Connection pool maxConnectionAge can't be negative")
+	}
+	return nil
+}
+
+// transportKey is what a connection is set up with besides the address it's connected to
+type transportKey struct {
+	scheme string
+	// serverName is the SNI hostname, for HTTPS
+	serverName string
+	certAlias  string
+}
+
+// poolKey identifies the connections that are interchangeable with one another
+type poolKey struct {
+	transportKey
+	// addr is the resolved IP address and port
+	addr string
+}
+
+// connectionPool is the round tripper used when connection pooling is on. Connections are pooled by
+// the IP address they're connected to, the SNI hostname and the client certificate alias, so one is
+// only reused for a request that would have opened an identical connection.
+//
+// The target's hostname is resolved again for every request, and a connection is only reused if its
+// address is still among the allowed ones the hostname resolves to. A DNS change therefore can't
+// keep requests going to an address the target has moved away from, or that is now blocked.
+//
+// HTTP/1.1 connections are kept by an http.Transport for each transportKey, with the request's
+// host replaced by the resolved address so that the transport pools them by address. HTTP/2
+// connections are kept by the pool itself, rather than by the HTTP/2 transport, which would
+// pool them by hostname alone.
+type connectionPool struct {
+	dialer *safeDialer
+	config ConnectionPoolConfig
+	now    func() time.Time
+	// http2 creates the client for HTTP/2 connections, if HTTP/2 is offered to http2Hosts
+	http2      *http2.Transport
+	http2Hosts *hostPolicy
+
+	mu sync.Mutex
+	// transports has one transport for every transportKey, each pooling connections by address
+	transports map[transportKey]*http.Transport
+	// conns has every open connection, by the net.Conn its transport uses
+	conns map[net.Conn]*pooledConn
+	// idle counts the idle connections for each key
+	idle map[poolKey]int
+	// multiplexed has the HTTP/2 connections for each key
+	multiplexed map[poolKey][]*pooledConn
+	// closed is set by close, after which connections are closed once their request is done
+	// rather than kept for reuse
+	closed bool
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// pooledConn is a TCP connection opened by the pool. For HTTPS, the transport uses the TLS
+// connection on top of it, and closing either closes both.
+type pooledConn struct {
+	net.Conn
+	pool      *connectionPool
+	key       poolKey
+	outer     net.Conn
+	createdAt time.Time
+	// h2 is the client if HTTP/2 was negotiated
+	h2 *http2.ClientConn
+	// idle is guarded by pool.mu
+	idle bool
+}
+
+func (c *pooledConn) Close() error {
+	c.pool.forget(c)
+	return c.Conn.Close()
+}
+
+// dialedConn hands a connection opened ahead of a request to the transport, if the transport dials
+// for the request at all
+type dialedConn struct {
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+type dialedConnKey struct{}
+
+func (d *dialedConn) take() net.Conn {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	conn := d.conn
+	d.conn = nil
+	return conn
+}
+
+// discard closes the connection if the transport didn't take it
+func (d *dialedConn) discard() {
+	if conn := d.take(); conn != nil {
+		conn.Close()
+	}
+}
+
+func newConnectionPool(dialer *safeDialer, config ConnectionPoolConfig, http2Config HTTP2Config) *connectionPool {
+	c := &connectionPool{
+		dialer:      dialer,
+		config:      config,
+		now:         time.Now,
+		http2Hosts:  newHTTP2Policy(http2Config),
+		transports:  make(map[transportKey]*http.Transport),
+		conns:       make(map[net.Conn]*pooledConn),
+		idle:        make(map[poolKey]int),
+		multiplexed: make(map[poolKey][]*pooledConn),
+		stop:        make(chan struct{}),
+	}
+	if c.http2Hosts != nil {
+		// Idle HTTP/2 connections are closed by sweep
+		c.http2 = &http2.Transport{DisableCompression: true}
+	}
+	return c
+}
+
+// start sweeps the pool every poolSweepInterval, until close is called
+func (c *connectionPool) start() {
+	go func() {
+		ticker := time.NewTicker(poolSweepInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				c.sweep()
+			case <-c.stop:
+				return
+			}
+		}
+	}()
+}
+
+// close stops the sweeps and closes the idle connections. Connections still in use, and those
+// opened by requests still in flight, are closed once their request is done, and HTTP/2
+// connections once their streams are.
+func (c *connectionPool) close() {
+	c.stopOnce.Do(func() { close(c.stop) })
+	c.mu.Lock()
+	c.closed = true
+	c.mu.Unlock()
+	c.CloseIdleConnections()
+	c.mu.Lock()
+	var multiplexed []*http2.ClientConn
+	for _, conns := range c.multiplexed {
+		for _, conn := range conns {
+			multiplexed = append(multiplexed, conn.h2)
+		}
+	}
+	c.mu.Unlock()
+	for _, cc := range multiplexed {
+		go c.shutdownHTTP2(cc)
+	}
+}
+
+// shutdownHTTP2 closes cc once its streams are done, or after idleTimeout if they aren't by then
+func (c *connectionPool) shutdownHTTP2(cc *http2.ClientConn) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.config.IdleTimeout)
+	defer cancel()
+	if err := cc.Shutdown(ctx); err != nil {
+		cc.Close()
+	}
+}
+
+func (c *connectionPool) isClosed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closed
+}
+
+func (c *connectionPool) CloseIdleConnections() {
+	c.mu.Lock()
+	var transports []*http.Transport
+	for _, transport := range c.transports {
+		transports = append(transports, transport)
+	}
+	c.mu.Unlock()
+	for _, transport := range transports {
+		transport.CloseIdleConnections()
+	}
+}
+
+func (c *connectionPool) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	host := req.URL.Hostname()
+	port := req.URL.Port()
+	if port == "" {
+		port = "80"
+		if req.URL.Scheme == "https" {
+			port = "443"
+		}
+	}
+	addr := net.JoinHostPort(host, port)
+	key := transportKey{scheme: req.URL.Scheme}
+	if req.URL.Scheme == "https" {
+		key.serverName = host
+		if certAlias, ok := ctx.Value(clientCertKey).(string); ok {
+			if _, found := c.dialer.clientCerts[certAlias]; !found {
+				return nil, &proxyError{statusCode: http.StatusBadRequest, message: fmt.Sprintf("Cert with alias %s not found in certificate store", certAlias), errorCode: ClientCertNotFoundError}
+			}
+			key.certAlias = certAlias
+		}
+	}
+	if err := c.dialer.checkHost(addr); err != nil {
+		return nil, err
+	}
+	if err := c.dialer.checkPort(addr); err != nil {
+		return nil, err
+	}
+	ips, blocked, err := c.dialer.resolveAllowed(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if conn := c.multiplexedConn(key, ips, port); conn != nil {
+		resp, err := c.roundTripHTTP2(conn, c.outbound(ctx, req, conn.key.addr), true)
+		if err == nil || !unprocessedHTTP2Error(err) {
+			return resp, err
+		}
+		// The connection was going away, so the request goes on a new one
+		if req, err = rewind(req); err != nil {
+			return nil, err
+		}
+	}
+
+	target := c.idleAddr(key, ips, port)
+	if target == "" {
+		// Connect now rather than leave it to the transport, to find out which address the
+		// connection goes to, and so which pool it belongs in
+		conn, err := c.dialer.dialAllowed(ctx, addr, ips, blocked)
+		if err != nil {
+			return nil, err
+		}
+		pc, err := c.open(key, conn, c.offersHTTP2(key))
+		if err != nil {
+			return nil, err
+		}
+		if pc.h2 != nil {
+			resp, err := c.roundTripHTTP2(pc, c.outbound(ctx, req, pc.key.addr), false)
+			if c.isClosed() {
+				// The connection was opened after close shut the others down
+				go c.shutdownHTTP2(pc.h2)
+			}
+			return resp, err
+		}
+		target = pc.key.addr
+		dialed := &dialedConn{conn: pc.outer}
+		defer dialed.discard()
+		ctx = context.WithValue(ctx, dialedConnKey{}, dialed)
+	}
+	return c.transport(key).RoundTrip(c.outbound(ctx, req, target))
+}
+
+// outbound is req as it's sent on a connection to target, the resolved address
+func (c *connectionPool) outbound(ctx context.Context, req *http.Request, target string) *http.Request {
+	outbound := req.Clone(c.withTrace(ctx))
+	outbound.URL.Host = target
+	if outbound.Host == "" {
+		outbound.Host = req.URL.Host
+	}
+	return outbound
+}
+
+// roundTripHTTP2 sends req on the HTTP/2 connection conn. The HTTP/2 client only tells the
+// request's trace which connection it got when it's used through its Transport, so that's done
+// here, for the pool and the connection metadata.
+func (c *connectionPool) roundTripHTTP2(conn *pooledConn, req *http.Request, reused bool) (*http.Response, error) {
+	if trace := httptrace.ContextClientTrace(req.Context()); trace != nil && trace.GotConn != nil {
+		trace.GotConn(httptrace.GotConnInfo{Conn: conn.outer, Reused: reused})
+	}
+	return conn.h2.RoundTrip(req)
+}
+
+// rewind returns req with its body ready to be sent again
+func rewind(req *http.Request) (*http.Request, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return req, nil
+	}
+	if req.GetBody == nil {
+		return nil, fmt.Errorf("Request body can't be sent again")
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return nil, err
+	}
+	rewound := req.Clone(req.Context())
+	rewound.Body = body
+	return rewound, nil
+}
+
+// offersHTTP2 is true if HTTP/2 is offered to the target of requests with key
+func (c *connectionPool) offersHTTP2(key transportKey) bool {
+	return key.scheme == "https" && c.http2Hosts != nil && c.http2Hosts.isAllowed(key.serverName)
+}
+
+// multiplexedConn returns an HTTP/2 connection to one of ips with a stream reserved for another
+// request, or nil if there's none. The connection stays open until the stream is used, since sweep
+// leaves connections with reserved streams alone.
+func (c *connectionPool) multiplexedConn(key transportKey, ips []net.IP, port string) *pooledConn {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil
+	}
+	for _, ip := range ips {
+		for _, conn := range c.multiplexed[poolKey{transportKey: key, addr: net.JoinHostPort(ip.String(), port)}] {
+			if !c.expired(conn) && conn.h2.ReserveNewRequest() {
+				return conn
+			}
+		}
+	}
+	return nil
+}
+
+// expired is true if conn is past maxConnectionAge
+func (c *connectionPool) expired(conn *pooledConn) bool {
+	return c.config.MaxConnectionAge > 0 && c.now().Sub(conn.createdAt) >= c.config.MaxConnectionAge
+}
+
+// idleAddr returns the first of ips that key has an idle connection to, or empty if there's none
+func (c *connectionPool) idleAddr(key transportKey, ips []net.IP, port string) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, ip := range ips {
+		addr := net.JoinHostPort(ip.String(), port)
+		if c.idle[poolKey{transportKey: key, addr: addr}] > 0 {
+			return addr
+		}
+	}
+	return ""
+}
+
+// open adds conn to the pool, after the TLS handshake for HTTPS, in which HTTP/2 is offered if
+// offerHTTP2 is set
+func (c *connectionPool) open(key transportKey, conn net.Conn, offerHTTP2 bool) (*pooledConn, error) {
+	tcpAddr, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		conn.Close()
+		return nil, fmt.Errorf("Unexpected remote address %s", conn.RemoteAddr())
+	}
+	pc := &pooledConn{
+		Conn:      conn,
+		pool:      c,
+		key:       poolKey{transportKey: key, addr: net.JoinHostPort(tcpAddr.IP.String(), fmt.Sprint(tcpAddr.Port))},
+		createdAt: c.now(),
+	}
+	pc.outer = pc
+	if key.scheme == "https" {
+		var nextProtos []string
+		if offerHTTP2 {
+			nextProtos = []string{http2.NextProtoTLS, "http/1.1"}
+		}
+		tlsConn, err := c.dialer.tlsHandshake(pc, key.serverName, key.certAlias, nextProtos)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		pc.outer = tlsConn
+		if tlsConn.ConnectionState().NegotiatedProtocol == http2.NextProtoTLS {
+			if pc.h2, err = c.http2.NewClientConn(tlsConn); err != nil {
+				tlsConn.Close()
+				return nil, err
+			}
+		}
+	}
+	c.mu.Lock()
+	c.conns[pc.outer] = pc
+	if pc.h2 != nil && !c.closed {
+		c.multiplexed[pc.key] = append(c.multiplexed[pc.key], pc)
+	}
+	c.mu.Unlock()
+	pooledConnectionsGauge.With(prometheus.Labels{"state": "active"}).Inc()
+	return pc, nil
+}
+
+// forget removes conn from the pool when it's closed
+func (c *connectionPool) forget(conn *pooledConn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conns[conn.outer] != conn {
+		return
+	}
+	delete(c.conns, conn.outer)
+	if conn.h2 != nil {
+		c.unmultiplex(conn)
+	}
+	state := "active"
+	if conn.idle {
+		c.countIdle(conn.key, -1)
+		state = "idle"
+	}
+	pooledConnectionsGauge.With(prometheus.Labels{"state": state}).Dec()
+}
+
+// unmultiplex stops new requests being sent on the HTTP/2 connection conn; c.mu must be held
+func (c *connectionPool) unmultiplex(conn *pooledConn) {
+	conns := c.multiplexed[conn.key]
+	for i := range conns {
+		if conns[i] == conn {
+			conns = append(conns[:i], conns[i+1:]...)
+			break
+		}
+	}
+	if len(conns) == 0 {
+		delete(c.multiplexed, conn.key)
+	} else {
+		c.multiplexed[conn.key] = conns
+	}
+}
+
+// setIdle records whether the transport is holding conn for reuse; c.mu must be held
+func (c *connectionPool) setIdle(conn *pooledConn, idle bool) {
+	if conn.idle == idle {
+		return
+	}
+	conn.idle = idle
+	from, to := "active", "idle"
+	if idle {
+		c.countIdle(conn.key, 1)
+	} else {
+		c.countIdle(conn.key, -1)
+		from, to = to, from
+	}
+	pooledConnectionsGauge.With(prometheus.Labels{"state": from}).Dec()
+	pooledConnectionsGauge.With(prometheus.Labels{"state": to}).Inc()
+}
+
+func (c *connectionPool) countIdle(key poolKey, delta int) {
+	if c.idle[key] += delta; c.idle[key] <= 0 {
+		delete(c.idle, key)
+	}
+}
+
+// withTrace keeps track of which connections are idle, from the transport handing the request a
+// connection and then taking it back
+func (c *connectionPool) withTrace(ctx context.Context) context.Context {
+	var used net.Conn
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			used = info.Conn
+			if conn := c.conns[info.Conn]; conn != nil {
+				c.setIdle(conn, false)
+			}
+			connection := "new"
+			if info.Reused {
+				connection = "reused"
+			}
+			pooledConnectionRequestsCounter.With(prometheus.Labels{"connection": connection}).Inc()
+		},
+		PutIdleConn: func(err error) {
+			if err != nil {
+				return
+			}
+			c.mu.Lock()
+			conn := c.conns[used]
+			if conn != nil && !c.closed {
+				c.setIdle(conn, true)
+			}
+			closed := c.closed
+			c.mu.Unlock()
+			if conn != nil && closed {
+				// The transport notices the connection is closed and drops it
+				conn.outer.Close()
+			}
+		},
+	})
+}
+
+// transport returns the transport for key, creating it if needed
+func (c *connectionPool) transport(key transportKey) *http.Transport {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if transport, ok := c.transports[key]; ok {
+		return transport
+	}
+	dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return c.dial(ctx, key, addr)
+	}
+	transport := &http.Transport{
+		Proxy:               nil,
+		MaxIdleConnsPerHost: c.config.MaxIdlePerHost,
+		IdleConnTimeout:     c.config.IdleTimeout,
+		DisableCompression:  true,
+		DialContext:         dial,
+		DialTLSContext:      dial,
+	}
+	c.transports[key] = transport
+	return transport
+}
+
+// dial is the transports' dialer. It hands over the connection opened for the request if there is
+// one. Otherwise, the idle connection the request was going to reuse was taken by another request,
+// and it connects to the same address, which the target resolved to for this request and which was
+// checked against the deny list then.
+func (c *connectionPool) dial(ctx context.Context, key transportKey, addr string) (net.Conn, error) {
+	if dialed, ok := ctx.Value(dialedConnKey{}).(*dialedConn); ok {
+		if conn := dialed.take(); conn != nil {
+			return conn, nil
+		}
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if ip := net.ParseIP(host); ip == nil || c.dialer.isBlocked(ip) {
+		return nil, &proxyError{statusCode: http.StatusForbidden, message: fmt.Sprintf("IP %s is blocked", host), errorCode: BlockedIPAddress}
+	}
+	conn, err := c.dialer.dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	// HTTP/2 isn't offered, since the transport only speaks HTTP/1.1
+	pc, err := c.open(key, conn, false)
+	if err != nil {
+		return nil, err
+	}
+	return pc.outer, nil
+}
+
+// sweep closes idle connections past maxConnectionAge, and drops the transports that have no
+// connections left. HTTP/2 connections past maxConnectionAge get no new streams, and are closed
+// once the ones they have are done. HTTP/2 connections that have had no streams for idleTimeout
+// are closed too, since the HTTP/2 client doesn't close them itself.
+func (c *connectionPool) sweep() {
+	var expired, idleClosed []io.Closer
+	c.mu.Lock()
+	inUse := make(map[transportKey]bool)
+	for _, conn := range c.conns {
+		inUse[conn.key.transportKey] = true
+		if conn.h2 != nil {
+			state := conn.h2.State()
+			if state.StreamsActive > 0 || state.StreamsReserved > 0 || state.StreamsPending > 0 {
+				continue
+			}
+			idleSince := state.LastIdle
+			if idleSince.IsZero() {
+				idleSince = conn.createdAt
+			}
+			// No requests are sent on the connection once it's out of the multiplexed set, which
+			// multiplexedConn reserves streams in under c.mu
+			if c.expired(conn) {
+				c.unmultiplex(conn)
+				expired = append(expired, conn.h2)
+			} else if c.now().Sub(idleSince) >= c.config.IdleTimeout {
+				c.unmultiplex(conn)
+				idleClosed = append(idleClosed, conn.h2)
+			}
+		} else if conn.idle && c.expired(conn) {
+			expired = append(expired, conn.outer)
+		}
+	}
+	for key := range c.transports {
+		if !inUse[key] {
+			delete(c.transports, key)
+		}
+	}
+	c.mu.Unlock()
+	for _, conn := range expired {
+		// The transport notices the connection is closed and drops it. If it hands the connection
+		// to a request in the meantime, the write fails and it retries on a new connection.
+		conn.Close()
+		pooledConnectionsExpiredCounter.Inc()
+	}
+	for _, conn := range idleClosed {
+		conn.Close()
+	}
+}
@@ -0,0 +1,260 @@
+/**
+ * Copyright (c) 2020 Ameya Lokare
+ */
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type staticResolver struct {
+	mu  sync.Mutex
+	ips []net.IPAddr
+}
+
+func (r *staticResolver) set(ips ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.ips = nil
+	for _, ip := range ips {
+		r.ips = append(r.ips, net.IPAddr{IP: net.ParseIP(ip)})
+	}
+}
+
+func (r *staticResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.ips, nil
+}
+
+// connRecorder records the local address of every connection a test server accepts
+type connRecorder struct {
+	mu    sync.Mutex
+	addrs []string
+}
+
+func (c *connRecorder) connState(conn net.Conn, state http.ConnState) {
+	if state == http.StateNew {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		host, _, _ := net.SplitHostPort(conn.LocalAddr().String())
+		c.addrs = append(c.addrs, host)
+	}
+}
+
+func (c *connRecorder) accepted() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return strings.Join(c.addrs, " ")
+}
+
+// waitIdle waits for the transport to hand the connections it was using back to the pool
+func waitIdle(t *testing.T, pool *connectionPool, expected int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		pool.mu.Lock()
+		idle := 0
+		for _, count := range pool.idle {
+			idle += count
+		}
+		pool.mu.Unlock()
+		if idle == expected {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %d idle connections, got %d", expected, idle)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// waitClosed waits for every connection opened by the pool to be closed
+func waitClosed(t *testing.T, pool *connectionPool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		pool.mu.Lock()
+		open := len(pool.conns)
+		pool.mu.Unlock()
+		if open == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected no open connections, got %d", open)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestConnectionPool(t *testing.T) {
+	recorder := &connRecorder{}
+	target := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Write(body)
+	}))
+	listener, err := net.Listen("tcp", "0.0.0.0:0")
+	checkNoError(t, err)
+	target.Listener.Close()
+	target.Listener = listener
+	target.Config.ConnState = recorder.connState
+	target.Start()
+	defer target.Close()
+	port := strconv.Itoa(listener.Addr().(*net.TCPAddr).Port)
+
+	config, err := UnmarshalConfig([]byte(`
+cidrAllowList: ["127.0.0.1/32", "127.0.0.2/32"]
+allowedPorts: []
+connectionPool:
+  enabled: true
+  maxConnectionAge: 1m
+`))
+	checkNoError(t, err)
+	resolver := &staticResolver{}
+	resolver.set("127.0.0.1")
+	sd := newSafeDialer(config)
+	sd.resolver = resolver
+	pool := newConnectionPool(sd, config.ConnectionPool, config.HTTP2)
+	defer pool.close()
+	now := time.Now()
+	pool.now = func() time.Time { return now }
+
+	send := func(t *testing.T, idle int) {
+		req, err := http.NewRequest("POST", "http://webhooks.example.com:"+port+"/events", strings.NewReader("paid"))
+		checkNoError(t, err)
+		resp, err := pool.RoundTrip(req)
+		checkNoError(t, err)
+		body, err := ioutil.ReadAll(resp.Body)
+		checkNoError(t, err)
+		resp.Body.Close()
+		assertEqual(t, "paid", string(body))
+		waitIdle(t, pool, idle)
+	}
+
+	t.Run("Connections are reused", func(t *testing.T) {
+		for i := 0; i < 3; i++ {
+			send(t, 1)
+		}
+		assertEqual(t, "127.0.0.1", recorder.accepted())
+	})
+
+	t.Run("Not reused after the target moves", func(t *testing.T) {
+		resolver.set("127.0.0.2")
+		send(t, 2)
+		send(t, 2)
+		assertEqual(t, "127.0.0.1 127.0.0.2", recorder.accepted())
+	})
+
+	t.Run("Not reused once the target resolves to a blocked address", func(t *testing.T) {
+		resolver.set("10.1.2.3")
+		req, err := http.NewRequest("GET", "http://webhooks.example.com:"+port+"/events", nil)
+		checkNoError(t, err)
+		_, err = pool.RoundTrip(req)
+		statusCode, errorCode, _ := mapError("", err)
+		assertEqual(t, http.StatusForbidden, statusCode)
+		assertEqual(t, BlockedIPAddress, errorCode)
+	})
+
+	t.Run("Connections past maxConnectionAge are closed", func(t *testing.T) {
+		resolver.set("127.0.0.2")
+		now = now.Add(time.Minute)
+		pool.sweep()
+		waitIdle(t, pool, 0)
+		send(t, 1)
+		assertEqual(t, "127.0.0.1 127.0.0.2 127.0.0.2", recorder.accepted())
+	})
+
+	t.Run("Connections aren't kept once the pool is closed", func(t *testing.T) {
+		pool.close()
+		waitClosed(t, pool)
+		send(t, 0)
+		waitClosed(t, pool)
+		assertEqual(t, "127.0.0.1 127.0.0.2 127.0.0.2 127.0.0.2", recorder.accepted())
+	})
+}
+
+func TestConnectionPoolClientCerts(t *testing.T) {
+	recorder := &connRecorder{}
+	target := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	target.Config.ConnState = recorder.connState
+	target.StartTLS()
+	defer target.Close()
+
+	config := NewDefaultConfig()
+	config.InsecureSkipCidrDenyList = true
+	config.InsecureSkipCertVerification = true
+	config.AllowedPorts = nil
+	config.ConnectionPool.Enabled = true
+	config.ClientCerts = map[string]tls.Certificate{"acme": target.TLS.Certificates[0]}
+	p := NewProxy(config, "")
+	defer p.Shutdown(context.Background())
+	pool := p.currentHandler().pool
+
+	send := func(certAlias string, idle int) {
+		r := httptest.NewRequest("GET", target.URL, nil)
+		if certAlias != "" {
+			r.Header.Set("X-WhSentry-ClientCert", certAlias)
+		}
+		w := httptest.NewRecorder()
+		p.currentHandler().ServeHTTP(w, r)
+		assertEqual(t, http.StatusOK, w.Code)
+		waitIdle(t, pool, idle)
+	}
+	send("", 1)
+	send("", 1)
+	assertEqual(t, "127.0.0.1", recorder.accepted())
+	// A connection made with one client certificate isn't used for requests that asked for another
+	send("acme", 2)
+	send("acme", 2)
+	assertEqual(t, "127.0.0.1 127.0.0.1", recorder.accepted())
+
+	// Connections are closed once a reload replaces the pool
+	checkNoError(t, p.swapConfig(config))
+	waitIdle(t, pool, 0)
+}
+
+func TestConnectionPoolRequestBodies(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Write(body)
+	}))
+	defer target.Close()
+
+	config := NewDefaultConfig()
+	config.InsecureSkipCidrDenyList = true
+	config.AllowedPorts = nil
+	config.ConnectionPool.Enabled = true
+	config.MaxRequestBodySize = 16
+	p := NewProxy(config, "")
+	defer p.Shutdown(context.Background())
+
+	for _, body := range []string{"paid", strings.Repeat("paid", 100)} {
+		r := httptest.NewRequest("POST", target.URL, strings.NewReader(body))
+		w := httptest.NewRecorder()
+		p.currentHandler().ServeHTTP(w, r)
+		assertEqual(t, http.StatusOK, w.Code)
+		assertEqual(t, body, w.Body.String())
+	}
+
+	// Only bodies up to maxRequestBodySize are held in memory to be sent again
+	short, err := bufferOrStream(strings.NewReader("paid"), 16)
+	checkNoError(t, err)
+	_, rewindable := short.(*bytes.Reader)
+	assertEqual(t, true, rewindable)
+	long, err := bufferOrStream(strings.NewReader(strings.Repeat("paid", 100)), 16)
+	checkNoError(t, err)
+	_, rewindable = long.(*bytes.Reader)
+	assertEqual(t, false, rewindable)
+	streamed, err := ioutil.ReadAll(long)
+	checkNoError(t, err)
+	assertEqual(t, strings.Repeat("paid", 100), string(streamed))
+}
@@ -4,13 +4,17 @@
 package proxy
 
 import (
+	"bytes"
 	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"strconv"
 	"strings"
@@ -21,9 +25,10 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sirupsen/logrus"
+	"golang.org/x/net/http2"
 )
 
-var skipHeaders = []string{"Connection", "Proxy-Connection", "User-Agent"}
+var skipHeaders = []string{"Connection", "Proxy-Connection", "Proxy-Authorization", "User-Agent"}
 
 var accessLog = logrus.New()
 var log = logrus.New()
@@ -40,7 +45,7 @@ var (
 		Name:    "responses",
 		Help:    "Response time histogram",
 		Buckets: []float64{10, 100, 500, 1000, 5000, 10000},
-	}, []string{"error_code"})
+	}, []string{"error_code", "tenant"})
 )
 
 const (
@@ -58,6 +63,16 @@ const (
 	ResponseTooLarge           uint16 = 1008
 	InternalServerError        uint16 = 1009
 	ClientCertNotFoundError    uint16 = 1010
+	BlockedHostname            uint16 = 1011
+	PortNotAllowed             uint16 = 1012
+	ProxyAuthRequired          uint16 = 1013
+	RateLimited                uint16 = 1014
+	CircuitOpen                uint16 = 1015
+	SigningKeyNotFound         uint16 = 1016
+	TooManyRedirects           uint16 = 1017
+	RedirectNotAllowed         uint16 = 1018
+	SigningFailed              uint16 = 1019
+	RequestTooLarge            uint16 = 1020
 )
 
 
@@ -99,10 +114,27 @@ func SetupMetrics(metricsAddress string) {
 	}()
 	prometheus.MustRegister(connsGauge)
 	prometheus.MustRegister(responseHistogram)
+	prometheus.MustRegister(dnsLookupHistogram)
+	prometheus.MustRegister(dnsCacheCounter)
+	prometheus.MustRegister(configReloadCounter)
+	prometheus.MustRegister(destinationConcurrentGauge)
+	prometheus.MustRegister(destinationTokensGauge)
+	prometheus.MustRegister(circuitBreakerStateGauge)
+	prometheus.MustRegister(circuitBreakerTripCounter)
+	prometheus.MustRegister(pendingDeliveriesGauge)
+	prometheus.MustRegister(deliveryAttemptCounter)
+	prometheus.MustRegister(deadLettersGauge)
+	prometheus.MustRegister(receiptCounter)
+	prometheus.MustRegister(idempotentReplayCounter)
+	prometheus.MustRegister(idempotencyEntriesGauge)
+	prometheus.MustRegister(keyRotationCounter)
+	prometheus.MustRegister(pooledConnectionsGauge)
+	prometheus.MustRegister(pooledConnectionRequestsCounter)
+	prometheus.MustRegister(pooledConnectionsExpiredCounter)
 }
 
 func StartHTTPServer(listenAddress string, server *http.Server, wg *sync.WaitGroup) {
-	listener, err := net.Listen("tcp4", listenAddress)
+	listener, err := net.Listen(listenNetwork(listenAddress), listenAddress)
 	if err != nil {
 		log.Fatalf("Could not start egress proxy HTTP listener: %s\n", err)
 	}
@@ -115,7 +147,7 @@ func StartHTTPServer(listenAddress string, server *http.Server, wg *sync.WaitGro
 }
 
 func StartTLSServer(listenAddress, certFile, keyFile string, server *http.Server, wg *sync.WaitGroup) {
-	listener, err := net.Listen("tcp4", listenAddress)
+	listener, err := net.Listen(listenNetwork(listenAddress), listenAddress)
 	if err != nil {
 		log.Fatalf("Could not start egress proxy HTTPS listener: %s\n", err)
 	}
@@ -128,9 +160,14 @@ func StartTLSServer(listenAddress, certFile, keyFile string, server *http.Server
 }
 
 func CreateProxyServers(proxyConfig *ProxyConfig) []*http.Server {
+	return NewProxy(proxyConfig, "").Servers
+}
 
+// newProxyHTTPHandler creates a handler, and the dialer, transport and MITM issuer behind it, from
+// the parts of proxyConfig that can change without a restart
+func newProxyHTTPHandler(proxyConfig *ProxyConfig, tunnels *tunnelTracker, breakers *circuitBreakers, deliveries *deliveryQueue, idempotency *idempotencyCache, audit *auditSink, keyRings map[string]*signingKeyRing) (*ProxyHTTPHandler, error) {
 	sd := newSafeDialer(proxyConfig)
-	transport := &http.Transport{
+	var roundTripper http.RoundTripper = &http.Transport{
 		Proxy:              nil,
 		IdleConnTimeout:    time.Duration(20) * time.Second,
 		DisableKeepAlives:  true,
@@ -138,62 +175,189 @@ func CreateProxyServers(proxyConfig *ProxyConfig) []*http.Server {
 		DialContext:        sd.DialContext,
 		DialTLSContext:     sd.DialTLSContext,
 	}
+	var pool *connectionPool
+	if proxyConfig.ConnectionPool.Enabled {
+		pool = newConnectionPool(sd, proxyConfig.ConnectionPool, proxyConfig.HTTP2)
+		roundTripper = pool
+	}
+
+	signers, err := newWebhookSigners(proxyConfig.SigningKeys, keyRings)
+	if err != nil {
+		return nil, err
+	}
 
 	var mitmer *Mitmer
-	var err error
 	if proxyConfig.MitmIssuerCert != nil {
 		mitmer, err = NewMitmer()
 		if err != nil {
-			log.Fatalf("Fatal error trying to generate keys for MITM: %s", err)
+			return nil, fmt.Errorf("Error trying to generate keys for MITM: %s", err)
 		}
 		mitmer.dialContext = sd.DialContext
 		mitmer.doTLSHandshake = sd.doTLSHandshake
+		mitmer.tunnels = tunnels
 		mitmer.issuerPrivateKey = proxyConfig.MitmIssuerCert.PrivateKey
 		x509Cert, err := x509.ParseCertificate(proxyConfig.MitmIssuerCert.Certificate[0])
 		if err != nil {
-			log.Fatalf("Invalid X509 MITM issuer certificate: %s\n", err)
+			return nil, fmt.Errorf("Invalid X509 MITM issuer certificate: %s", err)
 		}
 		mitmer.issuerCertificate = x509Cert
 	}
 
-	var proxyServers []*http.Server
-	for _, listenerConfig := range proxyConfig.Listeners {
-		listenerConnsGauge := connsGauge.With(prometheus.Labels{"listener": listenerConfig.Address})
-		proxyServers = append(proxyServers, newProxyServer(listenerConfig, proxyConfig, sd, transport, mitmer, listenerConnsGauge))
-	}
-	return proxyServers
-}
-
-func newProxyServer(listenerConfig ListenerConfig, proxyConfig *ProxyConfig, sd *safeDialer, rt http.RoundTripper, mitmer *Mitmer, connsGauge prometheus.Gauge) *http.Server {
 	handler := &ProxyHTTPHandler{
-		roundTripper:               rt,
+		roundTripper:               roundTripper,
 		outboundConnectionLifetime: proxyConfig.ConnectionLifetime,
 		idleReadTimeout:            proxyConfig.ReadTimeout,
 		maxContentLength:           proxyConfig.MaxResponseBodySize,
-		currentInboundConnsGauge:   connsGauge,
+		maxRequestBodySize:         proxyConfig.MaxRequestBodySize,
 		mitmer:                     mitmer,
-		requestIDHeader: proxyConfig.RequestIDHeader,
+		requestIDHeader:            proxyConfig.RequestIDHeader,
+		authenticator:              newProxyAuthenticator(proxyConfig.ProxyAuth),
+		limiter:                    newDestinationLimiter(proxyConfig.RateLimits),
+		breakers:                   breakers,
+		signers:                    signers,
+		deliveries:                 deliveries,
+		idempotency:                idempotency,
+		audit:                      audit,
+		redirects:                  proxyConfig.Redirects,
+		pool:                       pool,
+	}
+	if len(proxyConfig.Tenants) > 0 {
+		handler.tenantSelector = newTenantSelector(proxyConfig.Tenants)
+		handler.tenants = make(map[string]*ProxyHTTPHandler)
+		for name, tenant := range proxyConfig.Tenants {
+			tenantHandler, err := newProxyHTTPHandler(proxyConfig.forTenant(tenant), tunnels, breakers, deliveries, idempotency, audit, keyRings)
+			if err != nil {
+				handler.close()
+				return nil, fmt.Errorf("Tenant %s: %s", name, err)
+			}
+			if tenant.RateLimits == nil {
+				// Tenants without limits of their own count against the same limits as everyone else
+				tenantHandler.limiter = handler.limiter
+			}
+			handler.tenants[name] = tenantHandler
+		}
+	}
+	return handler, nil
+}
+
+func newProxyServer(listenerConfig ListenerConfig, p *Proxy, connsGauge prometheus.Gauge) *http.Server {
+	handler := &listenerHandler{
+		proxy:                    p,
+		currentInboundConnsGauge: connsGauge,
+	}
+	tlsConfig, err := listenerTLSConfig(listenerConfig)
+	if err != nil {
+		log.Fatalf("Invalid TLS configuration for listener %s: %s\n", listenerConfig.Address, err)
 	}
 	return &http.Server{
 		Addr:           listenerConfig.Address,
 		Handler:        handler,
 		ConnState:      handler.connStateCallback,
 		MaxHeaderBytes: 1 << 20,
+		TLSConfig:      tlsConfig,
 	}
 }
 
+// listenerHandler hands requests on a listener to whichever ProxyHTTPHandler is current
+type listenerHandler struct {
+	proxy                    *Proxy
+	currentInboundConnsGauge prometheus.Gauge
+}
+
+func (l *listenerHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	l.proxy.currentHandler().ServeHTTP(w, r)
+}
+
+func (l *listenerHandler) connStateCallback(conn net.Conn, connState http.ConnState) {
+	// NOTE: Hijacked connections do not transition to closed
+	if connState == http.StateNew {
+		l.incrementInboundConns()
+	} else if connState == http.StateClosed {
+		l.decrementInboundConns()
+	}
+}
+
+func (l *listenerHandler) incrementInboundConns() {
+	l.currentInboundConnsGauge.Inc()
+}
+
+func (l *listenerHandler) decrementInboundConns() {
+	l.currentInboundConnsGauge.Dec()
+}
+
 // ProxyHTTPHandler some struct
 type ProxyHTTPHandler struct {
 	roundTripper               http.RoundTripper
 	outboundConnectionLifetime time.Duration
 	idleReadTimeout            time.Duration
-	currentInboundConnsGauge   prometheus.Gauge
 	maxContentLength           uint32
+	maxRequestBodySize         uint32
 	mitmer                     *Mitmer
-	requestIDHeader string
+	requestIDHeader            string
+	authenticator              *proxyAuthenticator
+	tenantSelector             *tenantSelector
+	limiter                    *destinationLimiter
+	breakers                   *circuitBreakers
+	signers                    map[string]*webhookSigner
+	deliveries                 *deliveryQueue
+	idempotency                *idempotencyCache
+	audit                      *auditSink
+	redirects                  RedirectConfig
+	// tenants handles requests assigned to each tenant, with the tenant's settings
+	tenants map[string]*ProxyHTTPHandler
+	// pool is the round tripper if connection pooling is on
+	pool *connectionPool
+}
+
+// start starts the sweeps of p's connection pools and its tenants', once p is in use. They aren't
+// started as p is created, so that nothing is left running if a tenant's handler can't be created.
+func (p *ProxyHTTPHandler) start() {
+	if p.pool != nil {
+		p.pool.start()
+	}
+	for _, tenant := range p.tenants {
+		tenant.start()
+	}
+}
+
+// close releases the outbound connections kept open by p and its tenants, once p has been replaced
+// by a reload or the proxy is shutting down. Requests still in flight are left to finish.
+func (p *ProxyHTTPHandler) close() {
+	if p.pool != nil {
+		p.pool.close()
+	} else if transport, ok := p.roundTripper.(*http.Transport); ok {
+		transport.CloseIdleConnections()
+	}
+	for _, tenant := range p.tenants {
+		tenant.close()
+	}
 }
 
 func (p *ProxyHTTPHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var principal string
+	if p.authenticator != nil {
+		var ok bool
+		if principal, ok = p.authenticator.authenticate(r); !ok {
+			p.authenticator.challenge(w)
+			return
+		}
+	}
+	identity := newRequestIdentity(r, principal)
+	handler := p
+	if p.tenantSelector != nil {
+		if tenant := p.tenantSelector.selectTenant(identity); tenant != "" {
+			identity.tenant = tenant
+			handler = p.tenants[tenant]
+		}
+	}
+	if p.deliveries != nil && isDeliveriesRequest(r) {
+		p.deliveries.serveAPI(w, r, identity, p.idempotency)
+		return
+	}
+	handler.serveProxy(w, r, identity)
+}
+
+func (p *ProxyHTTPHandler) serveProxy(w http.ResponseWriter, r *http.Request, identity *requestIdentity) {
 	if r.Method == http.MethodConnect {
 		// We only allow CONNECT if we have a configured MITM issuer certificate
 		if p.mitmer == nil {
@@ -201,64 +365,103 @@ func (p *ProxyHTTPHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		p.mitmer.HandleHttpConnect(uuid.New().String(), w, r)
+	} else if key := p.idempotency.key(r, identity.tenant, r.URL); key != "" {
+		p.serveIdempotent(w, r, identity, key)
 	} else {
-		requestID := r.Header.Get(p.requestIDHeader)
-		if requestID == "" {
-			requestID = uuid.New().String()
-		}
-		ctx, cancel := context.WithTimeout(context.TODO(), p.outboundConnectionLifetime)
-		defer cancel()
-		start := time.Now()
-		resp, err := p.doProxy(ctx, r)
-		if resp != nil {
-			defer resp.Body.Close()
-		}
-		var responseCode int
-		var errorCode uint16
-		var errorMessage string
-		if err != nil {
-			responseCode, errorCode, errorMessage = mapError(requestID, err)
-		} else if resp.ContentLength > 0 && uint32(resp.ContentLength) > p.maxContentLength {
-			responseCode = http.StatusBadGateway
-			errorCode = ResponseTooLarge
-			errorMessage = "Response exceeds max content length"
-		} else {
-			responseCode = resp.StatusCode
-			writeResponseHeaders(w, resp)
-			p.writeResponseBody(requestID, w, resp, cancel)
-		}
-
-		if errorCode != 0 {
-			sendHTTPError(w, responseCode, errorCode, errorMessage)
-		}
+		p.proxyRequest(w, r, identity)
+	}
+}
 
-		duration := time.Now().Sub(start)
-		if errorCode == InternalServerError {
-			logError(requestID, "Unexpected error while proxying request", err)
+// proxyRequest proxies r to its target and returns the response code sent to the client, along
+// with the reason code and message if the proxy couldn't get a response from the target
+func (p *ProxyHTTPHandler) proxyRequest(w http.ResponseWriter, r *http.Request, identity *requestIdentity) (int, uint16, string) {
+	requestID := r.Header.Get(p.requestIDHeader)
+	if requestID == "" {
+		requestID = uuid.New().String()
+	}
+	ctx, cancel := context.WithTimeout(context.TODO(), p.outboundConnectionLifetime)
+	defer cancel()
+	// The connection is recorded for the metadata headers and the audit trail
+	var metadata *connMetadata
+	sendMetadata := isTruish(r.Header.Get(MetadataHeader))
+	if sendMetadata || p.audit != nil {
+		metadata = &connMetadata{}
+		ctx = withConnMetadata(ctx, metadata)
+	}
+	start := time.Now()
+	var record *auditRecord
+	if p.audit != nil {
+		record = &auditRecord{Time: start, RequestID: requestID, ClientAddr: r.RemoteAddr, Principal: identity.principal,
+			Tenant: identity.tenant, Method: r.Method, URL: loggedURL(r)}
+		ctx = withAuditRecord(ctx, record)
+	}
+	var redirects *redirectChain
+	if p.followsRedirects(r) {
+		redirects = &redirectChain{maxHops: p.redirects.MaxHops}
+		ctx = withRedirectChain(ctx, redirects)
+	}
+	var resp *http.Response
+	release := func() {}
+	report, retryAfter, err := p.breakers.allow(r.URL.Hostname())
+	if err == nil {
+		release, retryAfter, err = p.limiter.acquire(identity.tenant, r.URL.Hostname())
+	}
+	if err != nil {
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfterSeconds(retryAfter)))
+	} else {
+		defer release()
+		resp, err = p.doProxy(ctx, r, requestID)
+	}
+	if resp != nil {
+		defer resp.Body.Close()
+	}
+	var responseCode int
+	var errorCode uint16
+	var errorMessage string
+	if err != nil {
+		responseCode, errorCode, errorMessage = mapError(requestID, err)
+	} else if resp.ContentLength > 0 && uint32(resp.ContentLength) > p.maxContentLength {
+		responseCode = http.StatusBadGateway
+		errorCode = ResponseTooLarge
+		errorMessage = "Response exceeds max content length"
+	} else {
+		responseCode = resp.StatusCode
+		if sendMetadata {
+			writeResponseHeaders(w, resp, metadata, redirects)
+		} else {
+			writeResponseHeaders(w, resp, nil, redirects)
 		}
-		logRequest(r, requestID, responseCode, duration)
-		updateMetrics(duration, errorCode)
+		p.writeResponseBody(requestID, w, resp, cancel)
 	}
-}
 
-func (p *ProxyHTTPHandler) connStateCallback(conn net.Conn, connState http.ConnState) {
-	// NOTE: Hijacked connections do not transition to closed
-	if connState == http.StateNew {
-		p.incrementInboundConns()
-	} else if connState == http.StateClosed {
-		p.decrementInboundConns()
+	if report != nil {
+		report(errorCode)
 	}
-}
 
-func (p *ProxyHTTPHandler) incrementInboundConns() {
-	p.currentInboundConnsGauge.Inc()
-}
+	if errorCode != 0 {
+		// The redirects followed before the error help explain it
+		redirects.writeHeaders(w.Header())
+		sendHTTPError(w, responseCode, errorCode, errorMessage)
+	}
 
-func (p *ProxyHTTPHandler) decrementInboundConns() {
-	p.currentInboundConnsGauge.Dec()
+	duration := time.Now().Sub(start)
+	if errorCode == InternalServerError {
+		logError(requestID, "Unexpected error while proxying request", err)
+	}
+	var protocol string
+	if resp != nil {
+		protocol = resp.Proto
+	}
+	logRequest(r, requestID, identity, redirects, protocol, responseCode, duration)
+	if record != nil {
+		record.FinalURL, record.Redirects = redirects.finalURL(), redirects.hopValues()
+		p.audit.finish(record, responseCode, errorCode, errorMessage, metadata, duration)
+	}
+	updateMetrics(duration, errorCode, identity.tenant)
+	return responseCode, errorCode, errorMessage
 }
 
-func writeResponseHeaders(w http.ResponseWriter, resp *http.Response) {
+func writeResponseHeaders(w http.ResponseWriter, resp *http.Response, metadata *connMetadata, redirects *redirectChain) {
 	for k, values := range resp.Header {
 		w.Header().Set(k, values[0])
 		for _, v := range values[1:] {
@@ -270,6 +473,11 @@ func writeResponseHeaders(w http.ResponseWriter, resp *http.Response) {
 			w.Header().Add("Transfer-Encoding", t)
 		}
 	}
+	// Written last so that the target can't spoof them
+	if metadata != nil {
+		metadata.writeHeaders(w.Header())
+	}
+	redirects.writeHeaders(w.Header())
 	w.WriteHeader(resp.StatusCode)
 }
 
@@ -312,29 +520,98 @@ type key int
 
 const clientCertKey key = 0
 
-func (p ProxyHTTPHandler) doProxy(ctx context.Context, r *http.Request) (*http.Response, error) {
+func (p ProxyHTTPHandler) doProxy(ctx context.Context, r *http.Request, requestID string) (*http.Response, error) {
 	if !r.URL.IsAbs() {
 		return nil, &proxyError{statusCode: http.StatusBadRequest, message: "Request URI must be absolute", errorCode: InvalidRequestURI}
 	}
-	if r.URL.Scheme != "http" {
-		return nil, &proxyError{statusCode: http.StatusBadRequest, message: "URL scheme must be HTTP", errorCode: InvalidUrlScheme}
-	}
-	//fmt.Fprintf(w, "Hello Go HTTP")
-	var outboundUri = r.RequestURI
-	if isTLS(r.Header) {
-		outboundUri = strings.Replace(outboundUri, "http", "https", 1)
+	if r.URL.Scheme != "http" && r.URL.Scheme != "https" {
+		return nil, &proxyError{statusCode: http.StatusBadRequest, message: "URL scheme must be HTTP or HTTPS", errorCode: InvalidUrlScheme}
 	}
 	clientCert, ok := r.Header["X-Whsentry-Clientcert"]
 	if ok && len(clientCert) > 0 {
 		ctx = context.WithValue(ctx, clientCertKey, clientCert[0])
 	}
-	outboundRequest, err := http.NewRequestWithContext(ctx, r.Method, outboundUri, r.Body)
+	var body io.Reader = r.Body
+	var signer *webhookSigner
+	var signedBody []byte
+	if alias := r.Header.Get(SigningKeyHeader); alias != "" {
+		if signer = p.signers[alias]; signer == nil {
+			return nil, &proxyError{statusCode: http.StatusBadRequest, message: fmt.Sprintf("Signing key with alias %s not found", alias), errorCode: SigningKeyNotFound}
+		}
+		// The whole body is needed to sign it, so it can't be streamed
+		var err error
+		if signedBody, err = readBody(r.Body, p.maxRequestBodySize); err != nil {
+			return nil, err
+		}
+		body = bytes.NewReader(signedBody)
+	} else if redirectChainFrom(ctx) != nil && r.Body != nil {
+		// Redirects that keep the method send the body again
+		bufferedBody, err := readBody(r.Body, p.maxRequestBodySize)
+		if err != nil {
+			return nil, err
+		}
+		body = bytes.NewReader(bufferedBody)
+	} else if p.pool != nil && r.Body != nil {
+		// A retry on a new connection, when a pooled one turns out to have been closed, sends the body
+		// again, but only if it's short enough to hold in memory
+		var err error
+		if body, err = bufferOrStream(r.Body, p.maxRequestBodySize); err != nil {
+			return nil, err
+		}
+	}
+	outboundRequest, err := http.NewRequestWithContext(ctx, r.Method, outboundURL(r).String(), body)
 	if err != nil {
 		return nil, err
 	}
 	copyHeaders(r.Header, outboundRequest.Header)
 	outboundRequest.Header["User-Agent"] = []string{"Webhook Sentry/0.1"}
-	return p.roundTripper.RoundTrip(outboundRequest)
+	if signer != nil {
+		if err := signer.sign(outboundRequest.Header, signedBody, requestID, time.Now()); err != nil {
+			logError(requestID, "Signing error", err)
+			return nil, &proxyError{statusCode: http.StatusInternalServerError, message: "Unable to sign request", errorCode: SigningFailed}
+		}
+	}
+	record := auditRecordFrom(ctx)
+	if record != nil {
+		p.audit.captureRequest(record, outboundRequest)
+	}
+	var resp *http.Response
+	if redirects := redirectChainFrom(ctx); redirects != nil {
+		redirects.private = p.privateHeaders(signer)
+		resp, err = p.followRedirects(outboundRequest, redirects)
+	} else {
+		resp, err = p.roundTripper.RoundTrip(outboundRequest)
+	}
+	if record != nil && err == nil {
+		p.audit.captureResponse(record, resp)
+	}
+	return resp, err
+}
+
+// readBody reads the whole of a request body that has to be held in memory, unless it's longer
+// than maxSize
+func readBody(body io.Reader, maxSize uint32) ([]byte, error) {
+	b, err := ioutil.ReadAll(io.LimitReader(body, int64(maxSize)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) > int(maxSize) {
+		return nil, &proxyError{statusCode: http.StatusRequestEntityTooLarge, message: fmt.Sprintf("Request body exceeds max size of %d bytes", maxSize), errorCode: RequestTooLarge}
+	}
+	return b, nil
+}
+
+// bufferOrStream returns the body read into memory, so that it can be sent again, if it's at most
+// maxSize long. Otherwise it returns a reader that streams it, having only read maxSize+1 bytes.
+func bufferOrStream(body io.Reader, maxSize uint32) (io.Reader, error) {
+	b, err := ioutil.ReadAll(io.LimitReader(body, int64(maxSize)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) > int(maxSize) {
+		return io.MultiReader(bytes.NewReader(b), body), nil
+	}
+	return bytes.NewReader(b), nil
 }
 
 func sendHTTPError(w http.ResponseWriter, statusCode int, errorCode uint16, errorMessage string) {
@@ -347,8 +624,19 @@ func mapError(requestID string, err error) (int, uint16, string) {
 	switch v := err.(type) {
 	case *proxyError:
 		return int(v.statusCode), v.errorCode, v.message
+	case *connectError:
+		if len(v.failed) == 0 {
+			return http.StatusForbidden, BlockedIPAddress, v.Error()
+		}
+		logWarn(requestID, "TCP connection error", err)
+		if v.timedOut() {
+			return http.StatusBadGateway, RequestTimedOut, v.Error()
+		}
+		return http.StatusBadGateway, TCPConnectionError, v.Error()
 	case *net.DNSError:
 		return http.StatusBadGateway, UnableToResolveIP, err.Error()
+	case http2.StreamError, http2.GoAwayError, http2.ConnectionError:
+		return mapHTTP2Error(requestID, err)
 	case net.Error:
 		if v.Timeout() {
 			return http.StatusBadGateway, RequestTimedOut, "Request to target timed out"
@@ -356,13 +644,31 @@ func mapError(requestID string, err error) (int, uint16, string) {
 		if opErr, ok := v.(*net.OpError); ok {
 			return mapNetOpError(requestID, *opErr)
 		}
-	case x509.CertificateInvalidError, x509.HostnameError, x509.UnknownAuthorityError:
-		logWarn(requestID, "Certificate validation error", err)
-		return http.StatusBadGateway, CertificateValidationError, v.Error()
+	}
+	if certErr := unwrapCertificateError(err); certErr != nil {
+		logWarn(requestID, "Certificate validation error", certErr)
+		return http.StatusBadGateway, CertificateValidationError, certErr.Error()
 	}
 	return http.StatusInternalServerError, InternalServerError, "Internal Server Error"
 }
 
+// unwrapCertificateError returns the x509 validation error behind err, if any. Newer TLS stacks
+// wrap these, so a plain type switch isn't enough.
+func unwrapCertificateError(err error) error {
+	var invalidErr x509.CertificateInvalidError
+	var hostnameErr x509.HostnameError
+	var unknownAuthorityErr x509.UnknownAuthorityError
+	switch {
+	case errors.As(err, &invalidErr):
+		return invalidErr
+	case errors.As(err, &hostnameErr):
+		return hostnameErr
+	case errors.As(err, &unknownAuthorityErr):
+		return unknownAuthorityErr
+	}
+	return nil
+}
+
 func mapNetOpError(requestID string, err net.OpError) (int, uint16, string) {
 	wrapped := err.Unwrap()
 	// This is hacky, but the TLS alert errors aren't exported
@@ -379,16 +685,35 @@ func mapNetOpError(requestID string, err net.OpError) (int, uint16, string) {
 	return http.StatusInternalServerError, InternalServerError, "Internal Server Error"
 }
 
-func logRequest(r *http.Request, requestID string, responseCode int, responseTime time.Duration) {
-	url := r.RequestURI
-	if isTLS(r.Header) {
-		url = strings.Replace(url, "http:", "https:", 1)
+// logRequest records r in the access log. protocol is the protocol of the target's response, if
+// there was one.
+func logRequest(r *http.Request, requestID string, identity *requestIdentity, redirects *redirectChain, protocol string, responseCode int, responseTime time.Duration) {
+	fields := logrus.Fields{"rq_id": requestID, "client_addr": r.RemoteAddr, "method": r.Method, "url": loggedURL(r), "response_code": responseCode,
+		"response_time": responseTime}
+	if protocol != "" {
+		fields["protocol"] = protocol
 	}
-	requestLogger := accessLog.WithFields(logrus.Fields{"rq_id": requestID, "client_addr": r.RemoteAddr, "method": r.Method, "url": url, "response_code": responseCode,
-		"response_time": responseTime})
+	identity.addLogFields(fields)
+	redirects.addLogFields(fields)
+	requestLogger := accessLog.WithFields(fields)
 	requestLogger.Info()
 }
 
+// loggedURL is the URL r is sent to, as recorded in the access log and audit trail
+func loggedURL(r *http.Request) string {
+	return outboundURL(r).String()
+}
+
+// outboundURL is the URL r is sent to. Requests for http URLs with the X-WhSentry-TLS header are
+// sent over HTTPS.
+func outboundURL(r *http.Request) *url.URL {
+	u := *r.URL
+	if u.Scheme == "http" && isTLS(r.Header) {
+		u.Scheme = "https"
+	}
+	return &u
+}
+
 func logWarn(requestID string, message string, err error) {
 	doLog(requestID, message, err, logrus.WarnLevel)
 }
@@ -406,8 +731,8 @@ func doLog(requestID string, message string, err error, level logrus.Level) {
 	logger.Log(level, message)
 }
 
-func updateMetrics(duration time.Duration, errorCode uint16) {
-	responseHistogram.With(prometheus.Labels{"error_code": strconv.Itoa(int(errorCode))}).Observe(float64(duration.Milliseconds()))
+func updateMetrics(duration time.Duration, errorCode uint16, tenant string) {
+	responseHistogram.With(prometheus.Labels{"error_code": strconv.Itoa(int(errorCode)), "tenant": tenant}).Observe(float64(duration.Milliseconds()))
 }
 
 func isTLS(h http.Header) bool {
@@ -445,7 +770,13 @@ func copyHeaders(inHeader http.Header, outHeader http.Header) {
 
 type safeDialer struct {
 	dialer                     *net.Dialer
+	dialMode                   DialMode
+	resolver                   ipResolver
+	dnsTimeout                 time.Duration
 	cidrBlacklist              []net.IPNet
+	cidrWhitelist              []net.IPNet
+	hostPolicy                 *hostPolicy
+	portPolicy                 *portPolicy
 	clientCerts                map[string]tls.Certificate
 	skipServerCertVerification bool
 	rootCerts                  *x509.CertPool
@@ -462,10 +793,23 @@ func newSafeDialer(config *ProxyConfig) *safeDialer {
 		for _, cidr := range config.CidrDenyList {
 			cidrDenyList = append(cidrDenyList, net.IPNet(cidr))
 		}
+		for _, cidr := range config.IPv6CidrDenyList {
+			cidrDenyList = append(cidrDenyList, net.IPNet(cidr))
+		}
+	}
+	var cidrAllowList []net.IPNet
+	for _, cidr := range config.CidrAllowList {
+		cidrAllowList = append(cidrAllowList, net.IPNet(cidr))
 	}
 	return &safeDialer{
 		dialer:                     dialer,
+		dialMode:                   config.DialMode,
+		resolver:                   newResolver(config.DNS),
+		dnsTimeout:                 config.DNS.Timeout,
 		cidrBlacklist:              cidrDenyList,
+		cidrWhitelist:              cidrAllowList,
+		hostPolicy:                 newHostPolicy(config.HostAllowList, config.HostDenyList),
+		portPolicy:                 &portPolicy{allowed: config.AllowedPorts, denied: config.DeniedPorts},
 		skipServerCertVerification: config.InsecureSkipCertVerification,
 		clientCerts:                config.ClientCerts,
 		rootCerts:                  config.RootCACerts,
@@ -473,11 +817,7 @@ func newSafeDialer(config *ProxyConfig) *safeDialer {
 }
 
 func (s *safeDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
-	ipPort, err := s.resolveIPPort(ctx, addr)
-	if err != nil {
-		return nil, err
-	}
-	return s.dialer.DialContext(ctx, "tcp4", ipPort)
+	return s.dialTCP(ctx, addr)
 }
 
 func (s *safeDialer) resolveIPPort(ctx context.Context, addr string) (string, error) {
@@ -485,21 +825,25 @@ func (s *safeDialer) resolveIPPort(ctx context.Context, addr string) (string, er
 	if err != nil {
 		return "", err
 	}
-	ips, err := s.dialer.Resolver.LookupIPAddr(ctx, host)
+	ips, err := s.lookupIPAddr(ctx, host)
 	if err != nil {
 		return "", err
 	}
+	// Prefer IPv4 when the target has both A and AAAA records
 	var chosenIP net.IP = nil
 	for _, ip := range ips {
-		if strings.Count(ip.IP.String(), ":") < 2 {
+		if ip.IP.To4() != nil {
 			chosenIP = ip.IP
 			break
 		}
 	}
+	if chosenIP == nil && len(ips) > 0 {
+		chosenIP = ips[0].IP
+	}
 	if chosenIP == nil {
-		return "", &proxyError{statusCode: http.StatusBadRequest, message: fmt.Sprintf("Target %s did not resolve to a valid IPv4 address", addr), errorCode: UnableToResolveIP}
+		return "", &proxyError{statusCode: http.StatusBadRequest, message: fmt.Sprintf("Target %s did not resolve to a valid IP address", addr), errorCode: UnableToResolveIP}
 	}
-	if isBlacklisted(s.cidrBlacklist, chosenIP) {
+	if s.isBlocked(chosenIP) {
 		return "", &proxyError{statusCode: http.StatusForbidden, message: fmt.Sprintf("IP %s is blocked", chosenIP.String()), errorCode: BlockedIPAddress}
 	}
 
@@ -513,17 +857,13 @@ func (s *safeDialer) DialTLSContext(ctx context.Context, network, addr string) (
 		return nil, err
 	}
 
-	ipPort, err := s.resolveIPPort(ctx, addr)
-	if err != nil {
-		return nil, err
-	}
 	certAlias, ok := ctx.Value(clientCertKey).(string)
 	if ok {
 		if _, found := s.clientCerts[certAlias]; !found {
 			return nil, &proxyError{statusCode: http.StatusBadRequest, message: fmt.Sprintf("Cert with alias %s not found in certificate store", certAlias), errorCode: ClientCertNotFoundError}
 		}
 	}
-	conn, err := s.dialer.DialContext(ctx, "tcp4", ipPort)
+	conn, err := s.dialTCP(ctx, addr)
 	if err != nil {
 		return nil, err
 	}
@@ -531,6 +871,15 @@ func (s *safeDialer) DialTLSContext(ctx context.Context, network, addr string) (
 }
 
 func (s *safeDialer) doTLSHandshake(conn net.Conn, hostname string, certAlias string) (net.Conn, error) {
+	tlsConn, err := s.tlsHandshake(conn, hostname, certAlias, nil)
+	if err != nil {
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// tlsHandshake is doTLSHandshake, offering the application protocols in nextProtos by ALPN
+func (s *safeDialer) tlsHandshake(conn net.Conn, hostname string, certAlias string, nextProtos []string) (*tls.Conn, error) {
 	var clientCert tls.Certificate
 	if certAlias == "" {
 		certAlias = "default"
@@ -549,7 +898,8 @@ func (s *safeDialer) doTLSHandshake(conn net.Conn, hostname string, certAlias st
 			}
 			return &clientCert, nil
 		},
-		RootCAs: s.rootCerts,
+		RootCAs:    s.rootCerts,
+		NextProtos: nextProtos,
 	}
 	tlsConn := tls.Client(conn, tlsConfig)
 	// NOTE: this effectively makes the total timeout for a TLS conn (2 * Config.Timeout)
@@ -561,18 +911,61 @@ func (s *safeDialer) doTLSHandshake(conn net.Conn, hostname string, certAlias st
 	return tlsConn, nil
 }
 
+var (
+	nat64Prefix     = net.IPNet{IP: net.ParseIP("64:ff9b::"), Mask: net.CIDRMask(96, 128)}
+	sixToFourPrefix = net.IPNet{IP: net.ParseIP("2002::"), Mask: net.CIDRMask(16, 128)}
+)
+
+// isBlocked is true if ip is in the deny list, unless the allow list punches a hole for it
+func (s *safeDialer) isBlocked(ip net.IP) bool {
+	return isBlacklisted(s.cidrBlacklist, ip) && !isBlacklisted(s.cidrWhitelist, ip)
+}
+
+// isBlacklisted is true if ip, or the IPv4 address embedded in it, is in one of the given ranges
 func isBlacklisted(cidrBlacklist []net.IPNet, ip net.IP) bool {
 	if cidrBlacklist == nil {
 		return false
 	}
 	for _, cidr := range cidrBlacklist {
-		if cidr.Contains(ip) {
+		if cidrContains(cidr, ip) {
 			return true
 		}
 	}
+	// An IPv6 address with an IPv4 address embedded in it must not be a way around the IPv4 rules
+	if embeddedIP := embeddedIPv4(ip); embeddedIP != nil {
+		return isBlacklisted(cidrBlacklist, embeddedIP)
+	}
 	return false
 }
 
+// cidrContains is like net.IPNet.Contains, except that IPv4 ranges only match IPv4 addresses and
+// IPv6 ranges only match IPv6 addresses. net.IP can't tell an IPv4-mapped IPv6 address apart from
+// an IPv4 address, so those are always checked against the IPv4 ranges; without this, an IPv6 range
+// like ::ffff:0:0/96 would block every IPv4 address.
+func cidrContains(cidr net.IPNet, ip net.IP) bool {
+	isIPv4Range := len(cidr.Mask) == net.IPv4len
+	isIPv4 := ip.To4() != nil
+	if isIPv4Range != isIPv4 {
+		return false
+	}
+	return cidr.Contains(ip)
+}
+
+// embeddedIPv4 returns the IPv4 address embedded in a NAT64 (64:ff9b::/96) or 6to4 (2002::/16)
+// address, or nil if there isn't one
+func embeddedIPv4(ip net.IP) net.IP {
+	if ip.To4() != nil || len(ip) != net.IPv6len {
+		return nil
+	}
+	if nat64Prefix.Contains(ip) {
+		return net.IPv4(ip[12], ip[13], ip[14], ip[15])
+	}
+	if sixToFourPrefix.Contains(ip) {
+		return net.IPv4(ip[2], ip[3], ip[4], ip[5])
+	}
+	return nil
+}
+
 type proxyError struct {
 	statusCode uint
 	message    string
@@ -597,8 +990,26 @@ func (f *AccessLogTextFormatter) Format(entry *logrus.Entry) ([]byte, error) {
 	fields := entry.Data
 	ts := entry.Time.Format(time.RFC3339)
 	responseTime := fields["response_time"].(time.Duration)
-	logLine := fmt.Sprintf("[%s] %s %s %s %s %d %dms\n", ts, fields["rq_id"], fields["client_addr"], fields["method"], fields["url"], fields["response_code"], responseTime.Milliseconds())
-	return []byte(logLine), nil
+	logLine := fmt.Sprintf("[%s] %s %s %s %s %d %dms", ts, fields["rq_id"], fields["client_addr"], fields["method"], fields["url"], fields["response_code"], responseTime.Milliseconds())
+	if principal, ok := fields["principal"]; ok {
+		logLine += fmt.Sprintf(" principal=%s", principal)
+	}
+	if subject, ok := fields["client_cert_subject"]; ok {
+		logLine += fmt.Sprintf(" client_cert_subject=%q", subject)
+	}
+	if sans, ok := fields["client_cert_san"]; ok {
+		logLine += fmt.Sprintf(" client_cert_san=%s", sans)
+	}
+	if tenant, ok := fields["tenant"]; ok {
+		logLine += fmt.Sprintf(" tenant=%s", tenant)
+	}
+	if finalURL, ok := fields["final_url"]; ok {
+		logLine += fmt.Sprintf(" final_url=%s redirect_chain=%q", finalURL, fields["redirect_chain"])
+	}
+	if protocol, ok := fields["protocol"]; ok {
+		logLine += fmt.Sprintf(" protocol=%s", protocol)
+	}
+	return []byte(logLine + "\n"), nil
 }
 
 type ProxyLogTextFormatter struct {
@@ -612,6 +1023,11 @@ func (f *ProxyLogTextFormatter) Format(entry *logrus.Entry) ([]byte, error) {
 		errorStr = err.(string)
 		errorStr = ": " + errorStr
 	}
-	logLine := fmt.Sprintf("[%s] %s %s %s%s\n", ts, fields["rq_id"], strings.ToUpper(entry.Level.String()), entry.Message, errorStr)
+	// Entries logged outside of a request, like config reloads, don't have a request ID
+	var requestIDStr string
+	if requestID, ok := fields["rq_id"]; ok {
+		requestIDStr = fmt.Sprintf(" %s", requestID)
+	}
+	logLine := fmt.Sprintf("[%s]%s %s %s%s\n", ts, requestIDStr, strings.ToUpper(entry.Level.String()), strings.TrimSuffix(entry.Message, "\n"), errorStr)
 	return []byte(logLine), nil
 }
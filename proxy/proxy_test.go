@@ -4,7 +4,13 @@
 package proxy
 
 import (
+	"context"
+	"errors"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
 	"testing"
 )
 
@@ -88,3 +94,201 @@ func TestIsTLS(t *testing.T) {
 		}
 	})
 }
+
+func TestOutboundURL(t *testing.T) {
+	tests := []struct {
+		requestURI string
+		tlsHeader  string
+		expected   string
+	}{
+		{"http://example.com/hooks?next=http://other.com", "", "http://example.com/hooks?next=http://other.com"},
+		{"http://example.com/hooks?next=http://other.com", "true", "https://example.com/hooks?next=http://other.com"},
+		{"HTTP://example.com:8443/hooks", "true", "https://example.com:8443/hooks"},
+		{"https://example.com/hooks", "", "https://example.com/hooks"},
+		{"https://example.com/hooks", "false", "https://example.com/hooks"},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("POST", test.requestURI, nil)
+		if test.tlsHeader != "" {
+			r.Header.Set("X-WhSentry-TLS", test.tlsHeader)
+		}
+		if u := outboundURL(r).String(); u != test.expected {
+			t.Errorf("Expected %s with X-WhSentry-TLS %q to be sent to %s, got %s", test.requestURI, test.tlsHeader, test.expected, u)
+		}
+	}
+}
+
+func TestHTTPSRequestURI(t *testing.T) {
+	target := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("Hello from target HTTPS"))
+	}))
+	defer target.Close()
+
+	config := NewDefaultConfig()
+	config.InsecureSkipCidrDenyList = true
+	config.InsecureSkipCertVerification = true
+	config.AllowedPorts = nil
+	p := NewProxy(config, "")
+	defer p.Shutdown(context.Background())
+
+	for _, uri := range []string{target.URL + "/target", strings.Replace(target.URL, "https:", "http:", 1) + "/target"} {
+		r := httptest.NewRequest("GET", uri, nil)
+		if strings.HasPrefix(uri, "http:") {
+			r.Header.Set("X-WhSentry-TLS", "true")
+		}
+		r.Header.Set(MetadataHeader, "true")
+		w := httptest.NewRecorder()
+		p.currentHandler().ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status code 200 for %s, got %d: %s", uri, w.Code, w.Header().Get(ReasonHeader))
+		}
+		if w.Body.String() != "Hello from target HTTPS" {
+			t.Errorf("Unexpected response body %s", w.Body.String())
+		}
+		if w.Header().Get(TLSVersionHeader) == "" {
+			t.Errorf("Expected %s to be sent over TLS", uri)
+		}
+	}
+
+	r := httptest.NewRequest("GET", "ftp://example.com/file", nil)
+	w := httptest.NewRecorder()
+	p.currentHandler().ServeHTTP(w, r)
+	if code := w.Header().Get(ReasonCodeHeader); code != strconv.Itoa(int(InvalidUrlScheme)) {
+		t.Errorf("Expected reason code %d for an ftp URL, got %s", InvalidUrlScheme, code)
+	}
+}
+
+func TestIsBlacklisted(t *testing.T) {
+	config := NewDefaultConfig()
+	denyList := newSafeDialer(config).cidrBlacklist
+
+	blocked := []string{
+		"127.0.0.1",
+		"10.1.1.1",
+		"::1",
+		"fe80::1",
+		"fd00::1",
+		"::ffff:127.0.0.1",
+		"::ffff:10.1.1.1",
+		"64:ff9b::a01:101",
+		"2002:a01:101::1",
+	}
+	for _, ip := range blocked {
+		if !isBlacklisted(denyList, net.ParseIP(ip)) {
+			t.Errorf("Expected IP %s to be blocked, but it was not", ip)
+		}
+	}
+
+	allowed := []string{
+		"1.1.1.1",
+		"::ffff:1.1.1.1",
+		"2606:4700:4700::1111",
+	}
+	for _, ip := range allowed {
+		if isBlacklisted(denyList, net.ParseIP(ip)) {
+			t.Errorf("Expected IP %s to be allowed, but it was blocked", ip)
+		}
+	}
+
+	t.Run("Embedded IPv4 checked even if IPv6 prefix is not in the deny list", func(t *testing.T) {
+		_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+		denyList := []net.IPNet{*loopback}
+		if !isBlacklisted(denyList, net.ParseIP("64:ff9b::7f00:1")) {
+			t.Error("Expected NAT64 address embedding 127.0.0.1 to be blocked, but it was not")
+		}
+		if isBlacklisted(denyList, net.ParseIP("64:ff9b::101:101")) {
+			t.Error("Expected NAT64 address embedding 1.1.1.1 to be allowed, but it was blocked")
+		}
+	})
+}
+
+func TestInterleaveFamilies(t *testing.T) {
+	ips := []net.IP{
+		net.ParseIP("2001:db8::1"),
+		net.ParseIP("2001:db8::2"),
+		net.ParseIP("192.0.2.1"),
+		net.ParseIP("2001:db8::3"),
+		net.ParseIP("192.0.2.2"),
+	}
+	expected := []string{"2001:db8::1", "192.0.2.1", "2001:db8::2", "192.0.2.2", "2001:db8::3"}
+	interleaved := interleaveFamilies(ips)
+	if len(interleaved) != len(expected) {
+		t.Fatalf("Expected %d addresses, got %d", len(expected), len(interleaved))
+	}
+	for i, ip := range interleaved {
+		if ip.String() != expected[i] {
+			t.Errorf("Expected %s at position %d, got %s", expected[i], i, ip)
+		}
+	}
+}
+
+func TestDialAllResolvedAddresses(t *testing.T) {
+	listener, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %s", err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+
+	config := NewDefaultConfig()
+	config.AllowedPorts = nil
+	sd := newSafeDialer(config)
+	// Nothing listens on 127.0.0.2, so the connection is refused
+	ips := []net.IP{net.ParseIP("127.0.0.2"), net.ParseIP("127.0.0.1")}
+
+	t.Run("Sequential", func(t *testing.T) {
+		conn, failed := sd.dialSerial(context.Background(), ips, port)
+		if conn == nil {
+			t.Fatalf("Expected a connection, got failures %v", failed)
+		}
+		defer conn.Close()
+		if remoteIP := conn.RemoteAddr().(*net.TCPAddr).IP; !remoteIP.Equal(ips[1]) {
+			t.Errorf("Expected connection to %s, got %s", ips[1], remoteIP)
+		}
+	})
+
+	t.Run("Happy eyeballs", func(t *testing.T) {
+		conn, failed := sd.dialParallel(context.Background(), ips, port)
+		if conn == nil {
+			t.Fatalf("Expected a connection, got failures %v", failed)
+		}
+		conn.Close()
+	})
+
+	t.Run("All addresses blocked", func(t *testing.T) {
+		sd.dialMode = DialSequential
+		_, err := sd.dialTCP(context.Background(), net.JoinHostPort("127.0.0.1", port))
+		_, errorCode, message := mapError("test", err)
+		if errorCode != BlockedIPAddress {
+			t.Errorf("Expected error code %d, got %d", BlockedIPAddress, errorCode)
+		}
+		if message != "IP 127.0.0.1 is blocked" {
+			t.Errorf("Unexpected error message '%s'", message)
+		}
+	})
+
+	t.Run("Unreachable and blocked addresses reported", func(t *testing.T) {
+		err := &connectError{
+			addr:    "example.com:443",
+			blocked: []net.IP{net.ParseIP("10.0.0.1")},
+			failed:  []dialAttempt{{ip: net.ParseIP("192.0.2.1"), err: errors.New("connect: connection refused")}},
+		}
+		_, errorCode, message := mapError("test", err)
+		if errorCode != TCPConnectionError {
+			t.Errorf("Expected error code %d, got %d", TCPConnectionError, errorCode)
+		}
+		expected := "Could not connect to example.com:443; unreachable: 192.0.2.1 (connect: connection refused); blocked: 10.0.0.1"
+		if message != expected {
+			t.Errorf("Expected error message '%s', got '%s'", expected, message)
+		}
+	})
+}
@@ -0,0 +1,233 @@
+/**
+ * Copyright (c) 2020 Ameya Lokare
+ */
+package proxy
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// maxIdleDestinations is how many destinations the limiter tracks before it forgets the idle ones
+const maxIdleDestinations = 10000
+
+var (
+	destinationConcurrentGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "destination_concurrent_requests",
+		Help: "The number of requests currently in flight to a destination host",
+	}, []string{"destination", "tenant"})
+
+	destinationTokensGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "destination_rate_limit_tokens",
+		Help: "The number of requests a destination host's rate limit allows right now",
+	}, []string{"destination", "tenant"})
+)
+
+// RateLimitConfig limits the requests made to each destination host. Zero means unlimited.
+type RateLimitConfig struct {
+	RequestsPerSecond float64 `yaml:"requestsPerSecond"`
+	// Burst is how many requests can be made at once before RequestsPerSecond kicks in; defaults
+	// to RequestsPerSecond rounded up
+	Burst         int `yaml:"burst"`
+	MaxConcurrent int `yaml:"maxConcurrent"`
+	// PerTenant keeps separate limits for each tenant, instead of one shared by all requests to a host
+	PerTenant bool                `yaml:"perTenant"`
+	Overrides []RateLimitOverride `yaml:"overrides"`
+}
+
+// RateLimitOverride sets different limits for hosts matching one of Hosts, which uses the same
+// patterns as hostDenyList. Limits an override leaves out are inherited.
+type RateLimitOverride struct {
+	Hosts             []string `yaml:"hosts"`
+	RequestsPerSecond float64  `yaml:"requestsPerSecond"`
+	Burst             int      `yaml:"burst"`
+	MaxConcurrent     int      `yaml:"maxConcurrent"`
+}
+
+func (c RateLimitConfig) enabled() bool {
+	if c.RequestsPerSecond > 0 || c.MaxConcurrent > 0 {
+		return true
+	}
+	for _, override := range c.Overrides {
+		if override.RequestsPerSecond > 0 || override.MaxConcurrent > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func validateRateLimits(c RateLimitConfig) error {
+	if c.RequestsPerSecond < 0 || c.Burst < 0 || c.MaxConcurrent < 0 {
+		return fmt.Errorf("Rate limits must not be negative")
+	}
+	for _, override := range c.Overrides {
+		if len(override.Hosts) == 0 {
+			return fmt.Errorf("Rate limit override must specify hosts")
+		}
+		if err := validateHostPatterns(override.Hosts); err != nil {
+			return err
+		}
+		if override.RequestsPerSecond < 0 || override.Burst < 0 || override.MaxConcurrent < 0 {
+			return fmt.Errorf("Rate limits must not be negative")
+		}
+	}
+	return nil
+}
+
+type destinationLimits struct {
+	requestsPerSecond float64
+	burst             float64
+	maxConcurrent     int
+}
+
+// destinationState is a token bucket plus a count of requests in flight for one destination
+type destinationState struct {
+	limits     destinationLimits
+	tokens     float64
+	lastRefill time.Time
+	inFlight   int
+}
+
+func (d *destinationState) refill(now time.Time) {
+	if d.limits.requestsPerSecond <= 0 {
+		return
+	}
+	d.tokens = math.Min(d.limits.burst, d.tokens+now.Sub(d.lastRefill).Seconds()*d.limits.requestsPerSecond)
+	d.lastRefill = now
+}
+
+func (d *destinationState) idle() bool {
+	return d.inFlight == 0 && (d.limits.requestsPerSecond <= 0 || d.tokens >= d.limits.burst)
+}
+
+type destinationLimiter struct {
+	config       RateLimitConfig
+	mu           sync.Mutex
+	destinations map[destinationKey]*destinationState
+	now          func() time.Time
+}
+
+type destinationKey struct {
+	host   string
+	tenant string
+}
+
+// newDestinationLimiter returns nil if no limits are configured
+func newDestinationLimiter(config RateLimitConfig) *destinationLimiter {
+	if !config.enabled() {
+		return nil
+	}
+	return &destinationLimiter{
+		config:       config,
+		destinations: make(map[destinationKey]*destinationState),
+		now:          time.Now,
+	}
+}
+
+func (l *destinationLimiter) limitsFor(host string) destinationLimits {
+	requestsPerSecond, burst, maxConcurrent := l.config.RequestsPerSecond, l.config.Burst, l.config.MaxConcurrent
+	for _, override := range l.config.Overrides {
+		if matchesHostPattern(normalizeHostPatterns(override.Hosts), host) {
+			if override.RequestsPerSecond > 0 {
+				// A burst sized for the inherited rate would be wrong for this one
+				requestsPerSecond = override.RequestsPerSecond
+				burst = override.Burst
+			}
+			if override.Burst > 0 {
+				burst = override.Burst
+			}
+			if override.MaxConcurrent > 0 {
+				maxConcurrent = override.MaxConcurrent
+			}
+			break
+		}
+	}
+	if burst <= 0 {
+		burst = int(math.Ceil(requestsPerSecond))
+	}
+	return destinationLimits{requestsPerSecond: requestsPerSecond, burst: float64(burst), maxConcurrent: maxConcurrent}
+}
+
+// acquire takes a token and a concurrency slot for a request to host. The returned func releases
+// the slot once the request is done. If either limit is reached, the error says so and retryAfter
+// is how long to wait before trying again.
+func (l *destinationLimiter) acquire(tenant string, host string) (release func(), retryAfter time.Duration, err error) {
+	if l == nil || host == "" {
+		return func() {}, 0, nil
+	}
+	host = normalizeHost(host)
+	key := destinationKey{host: host}
+	if l.config.PerTenant {
+		key.tenant = tenant
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	d, ok := l.destinations[key]
+	if !ok {
+		if len(l.destinations) >= maxIdleDestinations {
+			l.forgetIdle(now)
+		}
+		limits := l.limitsFor(host)
+		d = &destinationState{limits: limits, tokens: limits.burst, lastRefill: now}
+		l.destinations[key] = d
+	}
+	d.refill(now)
+
+	if d.limits.maxConcurrent > 0 && d.inFlight >= d.limits.maxConcurrent {
+		return nil, time.Second, &proxyError{statusCode: http.StatusTooManyRequests, message: fmt.Sprintf("Too many concurrent requests to %s", host), errorCode: RateLimited}
+	}
+	if d.limits.requestsPerSecond > 0 {
+		if d.tokens < 1 {
+			retryAfter = time.Duration((1 - d.tokens) / d.limits.requestsPerSecond * float64(time.Second))
+			return nil, retryAfter, &proxyError{statusCode: http.StatusTooManyRequests, message: fmt.Sprintf("Rate limit exceeded for %s", host), errorCode: RateLimited}
+		}
+		d.tokens--
+	}
+	d.inFlight++
+	l.updateGauges(key, d)
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			d.inFlight--
+			d.refill(l.now())
+			l.updateGauges(key, d)
+		})
+	}, 0, nil
+}
+
+func (l *destinationLimiter) updateGauges(key destinationKey, d *destinationState) {
+	labels := prometheus.Labels{"destination": key.host, "tenant": key.tenant}
+	destinationConcurrentGauge.With(labels).Set(float64(d.inFlight))
+	if d.limits.requestsPerSecond > 0 {
+		destinationTokensGauge.With(labels).Set(math.Floor(d.tokens))
+	}
+}
+
+// forgetIdle drops destinations with nothing in flight and a full bucket, since tracking them
+// any longer makes no difference
+func (l *destinationLimiter) forgetIdle(now time.Time) {
+	for key, d := range l.destinations {
+		d.refill(now)
+		if d.idle() {
+			delete(l.destinations, key)
+			destinationConcurrentGauge.DeleteLabelValues(key.host, key.tenant)
+			destinationTokensGauge.DeleteLabelValues(key.host, key.tenant)
+		}
+	}
+}
+
+// retryAfterSeconds rounds up, since Retry-After is in whole seconds and rounding down to 0 would
+// invite an immediate retry
+func retryAfterSeconds(retryAfter time.Duration) int {
+	return int(math.Ceil(retryAfter.Seconds()))
+}
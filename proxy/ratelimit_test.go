@@ -0,0 +1,122 @@
+/**
+ * Copyright (c) 2020 Ameya Lokare
+ */
+package proxy
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDestinationLimiter(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	newLimiter := func(config RateLimitConfig) *destinationLimiter {
+		l := newDestinationLimiter(config)
+		l.now = func() time.Time { return now }
+		return l
+	}
+
+	t.Run("Token bucket", func(t *testing.T) {
+		l := newLimiter(RateLimitConfig{RequestsPerSecond: 2, Burst: 3})
+		for i := 0; i < 3; i++ {
+			_, _, err := l.acquire("", "example.com")
+			checkNoError(t, err)
+		}
+		_, retryAfter, err := l.acquire("", "example.com")
+		assertError(t, "Rate limit exceeded for example.com", err)
+		assertEqual(t, 500*time.Millisecond, retryAfter)
+		assertEqual(t, 1, retryAfterSeconds(retryAfter))
+
+		// Other hosts have their own bucket
+		_, _, err = l.acquire("", "other.example.com")
+		checkNoError(t, err)
+
+		now = now.Add(500 * time.Millisecond)
+		_, _, err = l.acquire("", "EXAMPLE.com.")
+		checkNoError(t, err)
+	})
+
+	t.Run("Concurrency cap", func(t *testing.T) {
+		l := newLimiter(RateLimitConfig{MaxConcurrent: 1})
+		release, _, err := l.acquire("", "example.com")
+		checkNoError(t, err)
+		_, _, err = l.acquire("", "example.com")
+		assertError(t, "Too many concurrent requests to example.com", err)
+		release()
+		release()
+		release, _, err = l.acquire("", "example.com")
+		checkNoError(t, err)
+		_, _, err = l.acquire("", "example.com")
+		assertError(t, "Too many concurrent requests to example.com", err)
+	})
+
+	t.Run("Overrides", func(t *testing.T) {
+		l := newLimiter(RateLimitConfig{
+			RequestsPerSecond: 10,
+			MaxConcurrent:     5,
+			Overrides: []RateLimitOverride{
+				{Hosts: []string{".slow.com"}, RequestsPerSecond: 1},
+			},
+		})
+		assertEqual(t, destinationLimits{requestsPerSecond: 10, burst: 10, maxConcurrent: 5}, l.limitsFor("example.com"))
+		assertEqual(t, destinationLimits{requestsPerSecond: 1, burst: 1, maxConcurrent: 5}, l.limitsFor("api.slow.com"))
+	})
+
+	t.Run("Per tenant", func(t *testing.T) {
+		l := newLimiter(RateLimitConfig{MaxConcurrent: 1, PerTenant: true})
+		_, _, err := l.acquire("billing", "example.com")
+		checkNoError(t, err)
+		_, _, err = l.acquire("search", "example.com")
+		checkNoError(t, err)
+		_, _, err = l.acquire("billing", "example.com")
+		assertError(t, "Too many concurrent requests to example.com", err)
+	})
+
+	t.Run("Idle destinations are forgotten", func(t *testing.T) {
+		l := newLimiter(RateLimitConfig{RequestsPerSecond: 1})
+		release, _, err := l.acquire("", "example.com")
+		checkNoError(t, err)
+		release()
+		release, _, err = l.acquire("", "other.example.com")
+		checkNoError(t, err)
+		now = now.Add(time.Second)
+		l.forgetIdle(now)
+		assertEqual(t, 1, len(l.destinations))
+		release()
+	})
+
+	t.Run("Disabled", func(t *testing.T) {
+		if newDestinationLimiter(NewDefaultConfig().RateLimits) != nil {
+			t.Fatalf("Expected no limiter by default")
+		}
+		var l *destinationLimiter
+		_, _, err := l.acquire("", "example.com")
+		checkNoError(t, err)
+	})
+}
+
+func TestRateLimitValidation(t *testing.T) {
+	t.Run("Negative limit", func(t *testing.T) {
+		_, err := UnmarshalConfig([]byte(`rateLimits: {requestsPerSecond: -1}`))
+		assertError(t, "Rate limits must not be negative", err)
+	})
+
+	t.Run("Override without hosts", func(t *testing.T) {
+		_, err := UnmarshalConfig([]byte(`rateLimits: {overrides: [{maxConcurrent: 1}]}`))
+		assertError(t, "Rate limit override must specify hosts", err)
+	})
+
+	t.Run("Tenant limits", func(t *testing.T) {
+		config, err := UnmarshalConfig([]byte(`
+rateLimits: {requestsPerSecond: 10}
+tenants:
+  billing:
+    principals: [billing-service]
+    rateLimits: {maxConcurrent: 2}
+`))
+		checkNoError(t, err)
+		billing := config.forTenant(config.Tenants["billing"])
+		assertEqual(t, float64(0), billing.RateLimits.RequestsPerSecond)
+		assertEqual(t, 2, billing.RateLimits.MaxConcurrent)
+	})
+}
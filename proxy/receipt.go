@@ -0,0 +1,160 @@
+/**
+ * Copyright (c) 2020 Ameya Lokare
+ */
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var receiptCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "delivery_receipts",
+	Help: "Delivery receipts posted to the receipt URL, by result",
+}, []string{"result"})
+
+// ReceiptConfig configures the receipts posted when asynchronous deliveries finish
+type ReceiptConfig struct {
+	// URL receipts are posted to. It's configured by the operator, so unlike delivery targets it
+	// isn't subject to the deny lists, and can be an internal address.
+	URL     string        `yaml:"url"`
+	Timeout time.Duration `yaml:"timeout"`
+	Retry   RetryPolicy   `yaml:"retry"`
+	// SigningKey is the alias of the signing key receipts are signed with, if any
+	SigningKey string `yaml:"signingKey"`
+}
+
+func validateReceiptConfig(c ReceiptConfig, signingKeys map[string]SigningKeyConfig) error {
+	if c.URL == "" {
+		return nil
+	}
+	target, err := url.Parse(c.URL)
+	if err != nil {
+		return fmt.Errorf("Invalid delivery receipt url: %s", err)
+	}
+	if (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		return fmt.Errorf("Delivery receipt url must be an absolute http or https URL")
+	}
+	if c.Timeout <= 0 {
+		return fmt.Errorf("Delivery receipt timeout must be positive")
+	}
+	if err := validateRetryPolicy(c.Retry); err != nil {
+		return fmt.Errorf("Delivery receipt retry policy: %s", err)
+	}
+	if _, ok := signingKeys[c.SigningKey]; c.SigningKey != "" && !ok {
+		return fmt.Errorf("Delivery receipt signing key %s is not configured", c.SigningKey)
+	}
+	return nil
+}
+
+// deliveryReceipt is the body of a receipt
+type deliveryReceipt struct {
+	DeliveryID string         `json:"deliveryId"`
+	Tenant     string         `json:"tenant,omitempty"`
+	URL        string         `json:"url"`
+	Status     DeliveryStatus `json:"status"`
+	StatusCode int            `json:"statusCode,omitempty"`
+	Attempts   int            `json:"attempts"`
+	// LatencyMs is how long the final attempt took
+	LatencyMs  int64     `json:"latencyMs"`
+	UpstreamIP string    `json:"upstreamIP,omitempty"`
+	ReasonCode uint16    `json:"reasonCode,omitempty"`
+	Reason     string    `json:"reason,omitempty"`
+	CreatedAt  time.Time `json:"createdAt"`
+	FinishedAt time.Time `json:"finishedAt"`
+}
+
+func newDeliveryReceipt(d *Delivery) *deliveryReceipt {
+	return &deliveryReceipt{
+		DeliveryID: d.ID,
+		Tenant:     d.Tenant,
+		URL:        d.URL,
+		Status:     d.Status,
+		StatusCode: d.LastStatusCode,
+		Attempts:   d.Attempts,
+		LatencyMs:  d.LastDuration.Milliseconds(),
+		UpstreamIP: d.LastUpstreamIP,
+		ReasonCode: d.LastErrorCode,
+		Reason:     d.LastError,
+		CreatedAt:  d.CreatedAt,
+		FinishedAt: *d.FinishedAt,
+	}
+}
+
+// sendReceipt posts a receipt for the finished delivery d in the background. Receipts are retried,
+// but not kept across restarts; GET /deliveries/{id} remains the source of truth.
+func (q *deliveryQueue) sendReceipt(d *Delivery) {
+	if q.config.Receipts.URL == "" {
+		return
+	}
+	body, err := json.Marshal(newDeliveryReceipt(d))
+	if err != nil {
+		logError(d.ID, "Error encoding delivery receipt", err)
+		return
+	}
+	q.receipts.Add(1)
+	go func() {
+		defer q.receipts.Done()
+		retry := q.config.Receipts.Retry
+		for attempts := 1; ; attempts++ {
+			err := q.postReceipt(d.ID, body)
+			if err == nil {
+				receiptCounter.With(prometheus.Labels{"result": "sent"}).Inc()
+				return
+			}
+			if attempts >= retry.MaxAttempts {
+				logWarn(d.ID, "Giving up on delivery receipt", err)
+				receiptCounter.With(prometheus.Labels{"result": "failed"}).Inc()
+				return
+			}
+			q.mu.Lock()
+			backoff := retry.backoff(attempts, q.random)
+			q.mu.Unlock()
+			timer := time.NewTimer(backoff)
+			select {
+			case <-timer.C:
+			case <-q.stopping:
+				timer.Stop()
+				logWarn(d.ID, "Dropping delivery receipt on shutdown", err)
+				receiptCounter.With(prometheus.Labels{"result": "failed"}).Inc()
+				return
+			}
+		}
+	}()
+}
+
+func (q *deliveryQueue) postReceipt(id string, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, q.config.Receipts.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Webhook Sentry/0.1")
+	handler := q.handler()
+	req.Header.Set(handler.requestIDHeader, id)
+	if alias := q.config.Receipts.SigningKey; alias != "" {
+		// The key was checked when the config was loaded, but may since have been removed by a reload
+		signer := handler.signers[alias]
+		if signer == nil {
+			return fmt.Errorf("Signing key with alias %s not found", alias)
+		}
+		if err := signer.sign(req.Header, body, id, time.Now()); err != nil {
+			return err
+		}
+	}
+	resp, err := q.receiptClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("Receipt URL responded with %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+/**
+ * Copyright (c) 2020 Ameya Lokare
+ */
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDeliveryReceipts(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer target.Close()
+
+	receipts := make(chan *deliveryReceipt, 10)
+	signatures := make(chan string, 10)
+	var failures int32
+	callback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The first receipt is retried
+		if atomic.AddInt32(&failures, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		receipt := &deliveryReceipt{}
+		if err := json.NewDecoder(r.Body).Decode(receipt); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		signatures <- r.Header.Get("Webhook-Signature")
+		receipts <- receipt
+	}))
+	defer callback.Close()
+
+	waitForReceipt := func(t *testing.T) *deliveryReceipt {
+		select {
+		case receipt := <-receipts:
+			return receipt
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for a delivery receipt")
+		}
+		return nil
+	}
+
+	config := NewDefaultConfig()
+	config.AllowedPorts = nil
+	config.Delivery.StoreFile = filepath.Join(t.TempDir(), "deliveries.db")
+	config.Delivery.Retry = RetryPolicy{MaxAttempts: 3, InitialBackoff: 10 * time.Millisecond, MaxBackoff: 20 * time.Millisecond, Multiplier: 2}
+	config.Delivery.Receipts.URL = callback.URL
+	config.Delivery.Receipts.Retry = RetryPolicy{MaxAttempts: 2, InitialBackoff: 10 * time.Millisecond, MaxBackoff: 10 * time.Millisecond, Multiplier: 1}
+	config.Delivery.Receipts.SigningKey = "receipts"
+	config.SigningKeys = map[string]SigningKeyConfig{"receipts": {Scheme: SigningSchemeStandardWebhooks, Secrets: []Secret{"whsec_MfKQ9r8GKYqrTwjUPD8ILPZIo2LaLaSw"}}}
+	checkNoError(t, config.validate())
+
+	t.Run("Sent despite the deny list", func(t *testing.T) {
+		// The target is on a loopback address, so the delivery is blocked, but the receipt URL is
+		// exempt
+		p := NewProxy(config, "")
+		defer p.deliveries.stop(context.Background())
+		id := submitDelivery(t, p, `{"url": "`+target.URL+`"}`)
+		receipt := waitForReceipt(t)
+		assertEqual(t, id, receipt.DeliveryID)
+		assertEqual(t, DeliveryFailed, receipt.Status)
+		assertEqual(t, 1, receipt.Attempts)
+		assertEqual(t, BlockedIPAddress, receipt.ReasonCode)
+		assertEqual(t, "", receipt.UpstreamIP)
+		if sig := <-signatures; sig == "" {
+			t.Fatalf("Expected the receipt to be signed")
+		}
+	})
+
+	t.Run("Delivered", func(t *testing.T) {
+		allowed := *config
+		allowed.Delivery.StoreFile = filepath.Join(t.TempDir(), "deliveries.db")
+		allowed.InsecureSkipCidrDenyList = true
+		p := NewProxy(&allowed, "")
+		defer p.deliveries.stop(context.Background())
+		id := submitDelivery(t, p, `{"url": "`+target.URL+`"}`)
+		receipt := waitForReceipt(t)
+		<-signatures
+		assertEqual(t, id, receipt.DeliveryID)
+		assertEqual(t, target.URL, receipt.URL)
+		assertEqual(t, DeliveryDelivered, receipt.Status)
+		assertEqual(t, http.StatusCreated, receipt.StatusCode)
+		assertEqual(t, 1, receipt.Attempts)
+		assertEqual(t, uint16(0), receipt.ReasonCode)
+		assertEqual(t, "127.0.0.1", receipt.UpstreamIP)
+
+		d := waitForDelivery(t, p, id, DeliveryDelivered)
+		assertEqual(t, "127.0.0.1", d.LastUpstreamIP)
+	})
+
+	t.Run("Invalid config", func(t *testing.T) {
+		invalid := *config
+		invalid.Delivery.Receipts.SigningKey = "missing"
+		assertError(t, "signing key missing is not configured", invalid.validate())
+		invalid.Delivery.Receipts.URL = "/receipts"
+		assertError(t, "must be an absolute http or https URL", invalid.validate())
+	})
+}
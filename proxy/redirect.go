@@ -0,0 +1,256 @@
+/**
+ * Copyright (c) 2020 Ameya Lokare
+ */
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// FollowRedirectsHeader turns redirect following on or off for a request, overriding the config
+	FollowRedirectsHeader string = "X-WhSentry-Follow-Redirects"
+	// FinalURLHeader is the URL the response came from, set when a redirect was followed
+	FinalURLHeader string = "X-WhSentry-Final-URL"
+	// RedirectChainHeader has a value for each redirect followed, of the form "301 <url>", where
+	// the URL is the one that responded with the redirect
+	RedirectChainHeader string = "X-WhSentry-Redirect-Chain"
+
+	// maxRedirectBodyDrain bounds how much of a redirect response's body is read before it's discarded
+	maxRedirectBodyDrain = 4096
+)
+
+// RedirectConfig configures following redirects from the target
+type RedirectConfig struct {
+	// Follow turns redirect following on for requests that don't say otherwise with the
+	// X-WhSentry-Follow-Redirects header
+	Follow bool `yaml:"follow"`
+	// MaxHops is the most redirects followed for a request
+	MaxHops int `yaml:"maxHops"`
+}
+
+func validateRedirectConfig(c RedirectConfig) error {
+	if c.MaxHops <= 0 {
+		return fmt.Errorf("Redirects maxHops must be positive")
+	}
+	return nil
+}
+
+type redirectHop struct {
+	statusCode int
+	url        string
+}
+
+// redirectChain records the redirects followed for a request
+type redirectChain struct {
+	maxHops int
+	hops    []redirectHop
+	final   string
+	// private are the headers that aren't passed on to another origin
+	private []string
+}
+
+type redirectChainKey struct{}
+
+func withRedirectChain(ctx context.Context, chain *redirectChain) context.Context {
+	return context.WithValue(ctx, redirectChainKey{}, chain)
+}
+
+// redirectChainFrom returns the chain for the request ctx belongs to, if redirects are followed for it
+func redirectChainFrom(ctx context.Context) *redirectChain {
+	chain, _ := ctx.Value(redirectChainKey{}).(*redirectChain)
+	return chain
+}
+
+// followsRedirects says whether redirects are followed for r
+func (p *ProxyHTTPHandler) followsRedirects(r *http.Request) bool {
+	if value := r.Header.Get(FollowRedirectsHeader); value != "" {
+		return isTruish(value)
+	}
+	return p.redirects.Follow
+}
+
+// finalURL is the URL the response came from, or empty if no redirects were followed
+func (c *redirectChain) finalURL() string {
+	if c == nil || len(c.hops) == 0 {
+		return ""
+	}
+	return c.final
+}
+
+func (c *redirectChain) hopValues() []string {
+	if c == nil {
+		return nil
+	}
+	var values []string
+	for _, hop := range c.hops {
+		values = append(values, strconv.Itoa(hop.statusCode)+" "+hop.url)
+	}
+	return values
+}
+
+// writeHeaders sets the redirect headers in h, replacing any the target may have sent
+func (c *redirectChain) writeHeaders(h http.Header) {
+	if c == nil {
+		return
+	}
+	h.Del(FinalURLHeader)
+	h.Del(RedirectChainHeader)
+	if len(c.hops) == 0 {
+		return
+	}
+	h.Set(FinalURLHeader, c.final)
+	for _, value := range c.hopValues() {
+		h.Add(RedirectChainHeader, value)
+	}
+}
+
+func (c *redirectChain) addLogFields(fields logrus.Fields) {
+	if c == nil || len(c.hops) == 0 {
+		return
+	}
+	fields["final_url"] = c.final
+	fields["redirect_chain"] = strings.Join(c.hopValues(), ", ")
+}
+
+// followRedirects sends req, and then a request to wherever each redirect response points, until
+// it gets a response that isn't a redirect. Every hop is dialed by the safe dialer, so redirects
+// are subject to the same host, port and IP checks as the original request.
+func (p *ProxyHTTPHandler) followRedirects(req *http.Request, chain *redirectChain) (*http.Response, error) {
+	for {
+		resp, err := p.roundTripper.RoundTrip(req)
+		if err != nil {
+			return nil, err
+		}
+		next, err := nextRedirectRequest(req, resp, chain.private)
+		if next == nil && err == nil {
+			return resp, nil
+		}
+		io.Copy(ioutil.Discard, io.LimitReader(resp.Body, maxRedirectBodyDrain))
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		if len(chain.hops) == chain.maxHops {
+			return nil, &proxyError{statusCode: http.StatusBadGateway, message: fmt.Sprintf("Stopped after %d redirects", chain.maxHops), errorCode: TooManyRedirects}
+		}
+		chain.hops = append(chain.hops, redirectHop{statusCode: resp.StatusCode, url: req.URL.String()})
+		chain.final = next.URL.String()
+		req = next
+	}
+}
+
+// nextRedirectRequest returns the request to follow resp with, or nil if it isn't a redirect. As
+// RFC 9110 allows, and as browsers do, a POST redirected by a 301 or 302 is followed with a GET, as
+// is anything but a HEAD redirected by a 303. 307 and 308 keep the method and body. A request to
+// another origin is sent without the private headers, and without the client certificate.
+func nextRedirectRequest(req *http.Request, resp *http.Response, private []string) (*http.Request, error) {
+	switch resp.StatusCode {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+	default:
+		return nil, nil
+	}
+	location := resp.Header.Get("Location")
+	if location == "" {
+		// Nothing to follow, so the client gets the response as it is
+		return nil, nil
+	}
+	target, err := req.URL.Parse(location)
+	if err != nil {
+		return nil, &proxyError{statusCode: http.StatusBadGateway, message: fmt.Sprintf("Invalid redirect location %q", location), errorCode: RedirectNotAllowed}
+	}
+	if target.Scheme != "http" && target.Scheme != "https" {
+		return nil, &proxyError{statusCode: http.StatusBadGateway, message: fmt.Sprintf("Redirect to %s: URL scheme must be HTTP or HTTPS", target), errorCode: RedirectNotAllowed}
+	}
+	if req.URL.Scheme == "https" && target.Scheme == "http" {
+		return nil, &proxyError{statusCode: http.StatusForbidden, message: fmt.Sprintf("Redirect from HTTPS to HTTP (%s) is not allowed", target), errorCode: RedirectNotAllowed}
+	}
+
+	method := req.Method
+	keepBody := true
+	switch resp.StatusCode {
+	case http.StatusMovedPermanently, http.StatusFound:
+		if method == http.MethodPost {
+			method, keepBody = http.MethodGet, false
+		}
+	case http.StatusSeeOther:
+		if method != http.MethodHead {
+			method, keepBody = http.MethodGet, false
+		}
+	}
+	crossOrigin := origin(req.URL) != origin(target)
+	ctx := req.Context()
+	if crossOrigin {
+		ctx = withoutClientCert{ctx}
+	}
+	next, err := http.NewRequestWithContext(ctx, method, target.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	next.Header = req.Header.Clone()
+	if keepBody && req.GetBody != nil {
+		if next.Body, err = req.GetBody(); err != nil {
+			return nil, err
+		}
+		next.GetBody = req.GetBody
+		next.ContentLength = req.ContentLength
+	} else {
+		for _, header := range []string{"Content-Type", "Content-Length", "Content-Encoding", "Content-Language"} {
+			next.Header.Del(header)
+		}
+	}
+	if crossOrigin {
+		// Credentials meant for one site aren't passed on to another
+		for _, header := range private {
+			next.Header.Del(header)
+		}
+	}
+	return next, nil
+}
+
+// privateHeaders are the headers of a request signed by signer, if any, that are meant for its
+// target alone: credentials, the idempotency key, and the signature the proxy made for the target
+func (p *ProxyHTTPHandler) privateHeaders(signer *webhookSigner) []string {
+	headers := []string{"Authorization", "Cookie", "Idempotency-Key"}
+	if p.idempotency != nil {
+		headers = append(headers, p.idempotency.config.Header)
+	}
+	if signer != nil {
+		headers = append(headers, signer.headers()...)
+	}
+	return headers
+}
+
+// withoutClientCert hides the client certificate alias in a request's context, so that the
+// certificate isn't presented to another origin
+type withoutClientCert struct {
+	context.Context
+}
+
+func (c withoutClientCert) Value(key interface{}) interface{} {
+	if key == clientCertKey {
+		return nil
+	}
+	return c.Context.Value(key)
+}
+
+// origin is the scheme, host and port of u, with the default port filled in
+func origin(u *url.URL) string {
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	return u.Scheme + "://" + strings.ToLower(u.Hostname()) + ":" + port
+}
@@ -0,0 +1,198 @@
+/**
+ * Copyright (c) 2020 Ameya Lokare
+ */
+package proxy
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestFollowRedirects(t *testing.T) {
+	type received struct {
+		method         string
+		body           string
+		contentType    string
+		authorization  string
+		signature      string
+		idempotencyKey string
+	}
+	requests := make(chan received, 10)
+	final := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		requests <- received{method: r.Method, body: string(body), contentType: r.Header.Get("Content-Type"), authorization: r.Header.Get("Authorization"),
+			signature: r.Header.Get("X-Hub-Signature-256"), idempotencyKey: r.Header.Get("Idempotency-Key")}
+		w.Write([]byte("final"))
+	}))
+	defer final.Close()
+	// The same server by another name is another origin
+	otherOrigin := strings.Replace(final.URL, "127.0.0.1", "localhost", 1)
+	redirector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/loop":
+			http.Redirect(w, r, "/loop", http.StatusFound)
+		case "/internal":
+			http.Redirect(w, r, "http://169.254.169.254/latest/meta-data/", http.StatusFound)
+		case "/relative":
+			http.Redirect(w, r, "/"+r.URL.Query().Get("code"), http.StatusMovedPermanently)
+		default:
+			code, _ := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/"))
+			http.Redirect(w, r, otherOrigin+"/events", code)
+		}
+	}))
+	defer redirector.Close()
+
+	config, err := UnmarshalConfig([]byte(`
+cidrAllowList: ["127.0.0.1/32"]
+allowedPorts: []
+redirects:
+  maxHops: 3
+signingKeys:
+  github: {scheme: hubSignature256, secrets: ["It's a Secret to Everybody"]}
+`))
+	checkNoError(t, err)
+	p := NewProxy(config, "")
+	defer p.Shutdown(context.Background())
+
+	send := func(method string, url string, follow string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, url, strings.NewReader(`{"event": "paid"}`))
+		r.Header.Set("Content-Type", "application/json")
+		r.Header.Set("Authorization", "Bearer secret")
+		r.Header.Set("Idempotency-Key", "9f1c2e4a")
+		r.Header.Set(SigningKeyHeader, "github")
+		if follow != "" {
+			r.Header.Set(FollowRedirectsHeader, follow)
+		}
+		w := httptest.NewRecorder()
+		p.currentHandler().ServeHTTP(w, r)
+		return w
+	}
+
+	t.Run("Not followed by default", func(t *testing.T) {
+		w := send("POST", redirector.URL+"/302", "")
+		assertEqual(t, http.StatusFound, w.Code)
+		assertEqual(t, "", w.Header().Get(FinalURLHeader))
+	})
+
+	t.Run("Method and body", func(t *testing.T) {
+		for _, test := range []struct {
+			code     int
+			method   string
+			expected string
+		}{
+			{http.StatusMovedPermanently, "POST", "GET"},
+			{http.StatusFound, "POST", "GET"},
+			{http.StatusFound, "PUT", "PUT"},
+			{http.StatusSeeOther, "PUT", "GET"},
+			{http.StatusTemporaryRedirect, "POST", "POST"},
+			{http.StatusPermanentRedirect, "POST", "POST"},
+		} {
+			w := send(test.method, redirector.URL+"/"+strconv.Itoa(test.code), "true")
+			assertEqual(t, http.StatusOK, w.Code)
+			assertEqual(t, "final", w.Body.String())
+			got := <-requests
+			assertEqual(t, test.expected, got.method)
+			if test.expected == test.method {
+				assertEqual(t, `{"event": "paid"}`, got.body)
+				assertEqual(t, "application/json", got.contentType)
+			} else {
+				assertEqual(t, "", got.body)
+				assertEqual(t, "", got.contentType)
+			}
+			// Credentials and signatures aren't passed on to another origin
+			assertEqual(t, "", got.authorization)
+			assertEqual(t, "", got.signature)
+			assertEqual(t, "", got.idempotencyKey)
+		}
+	})
+
+	t.Run("Chain headers", func(t *testing.T) {
+		w := send("POST", redirector.URL+"/relative?code=307", "1")
+		assertEqual(t, http.StatusOK, w.Code)
+		<-requests
+		assertEqual(t, otherOrigin+"/events", w.Header().Get(FinalURLHeader))
+		chain := w.Header().Values(RedirectChainHeader)
+		assertEqual(t, 2, len(chain))
+		assertEqual(t, "301 "+redirector.URL+"/relative?code=307", chain[0])
+		assertEqual(t, "307 "+redirector.URL+"/307", chain[1])
+	})
+
+	t.Run("Too many redirects", func(t *testing.T) {
+		w := send("GET", redirector.URL+"/loop", "true")
+		assertEqual(t, http.StatusBadGateway, w.Code)
+		assertEqual(t, strconv.Itoa(int(TooManyRedirects)), w.Header().Get(ReasonCodeHeader))
+		assertEqual(t, 3, len(w.Header().Values(RedirectChainHeader)))
+	})
+
+	t.Run("Redirects to internal IPs are blocked", func(t *testing.T) {
+		w := send("GET", redirector.URL+"/internal", "true")
+		assertEqual(t, http.StatusForbidden, w.Code)
+		assertEqual(t, strconv.Itoa(int(BlockedIPAddress)), w.Header().Get(ReasonCodeHeader))
+		assertEqual(t, "http://169.254.169.254/latest/meta-data/", w.Header().Get(FinalURLHeader))
+	})
+
+	t.Run("Bodies too long to send again", func(t *testing.T) {
+		config.MaxRequestBodySize = 8
+		defer func() {
+			config.MaxRequestBodySize = NewDefaultConfig().MaxRequestBodySize
+			p.swapConfig(config)
+		}()
+		checkNoError(t, p.swapConfig(config))
+		w := send("POST", redirector.URL+"/307", "true")
+		assertEqual(t, http.StatusRequestEntityTooLarge, w.Code)
+		assertEqual(t, strconv.Itoa(int(RequestTooLarge)), w.Header().Get(ReasonCodeHeader))
+	})
+
+	t.Run("Header turns following off", func(t *testing.T) {
+		config.Redirects.Follow = true
+		defer func() { config.Redirects.Follow = false }()
+		checkNoError(t, p.swapConfig(config))
+		w := send("GET", redirector.URL+"/302", "false")
+		assertEqual(t, http.StatusFound, w.Code)
+		w = send("GET", redirector.URL+"/302", "")
+		assertEqual(t, http.StatusOK, w.Code)
+		<-requests
+	})
+}
+
+func TestRedirectDowngrade(t *testing.T) {
+	target := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "http://"+r.Host+"/insecure", http.StatusPermanentRedirect)
+	}))
+	defer target.Close()
+
+	config := NewDefaultConfig()
+	config.InsecureSkipCidrDenyList = true
+	config.InsecureSkipCertVerification = true
+	config.AllowedPorts = nil
+	config.Redirects.Follow = true
+	p := NewProxy(config, "")
+	defer p.Shutdown(context.Background())
+
+	r := httptest.NewRequest("GET", strings.Replace(target.URL, "https:", "http:", 1), nil)
+	r.Header.Set("X-WhSentry-TLS", "true")
+	w := httptest.NewRecorder()
+	p.currentHandler().ServeHTTP(w, r)
+	assertEqual(t, http.StatusForbidden, w.Code)
+	assertEqual(t, strconv.Itoa(int(RedirectNotAllowed)), w.Header().Get(ReasonCodeHeader))
+}
+
+func TestRedirectClientCert(t *testing.T) {
+	ctx := context.WithValue(context.Background(), clientCertKey, "acme")
+	req := httptest.NewRequest("POST", "https://webhooks.example.com/events", nil).WithContext(ctx)
+	redirect := func(location string) *http.Request {
+		resp := &http.Response{StatusCode: http.StatusTemporaryRedirect, Header: http.Header{"Location": {location}}}
+		next, err := nextRedirectRequest(req, resp, nil)
+		checkNoError(t, err)
+		return next
+	}
+	assertEqual(t, "acme", redirect("/v2/events").Context().Value(clientCertKey))
+	// The certificate chosen for one site isn't presented to another
+	next := redirect("https://attacker.example.net/events")
+	assertEqual(t, nil, next.Context().Value(clientCertKey))
+}
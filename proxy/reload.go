@@ -0,0 +1,191 @@
+/**
+ * Copyright (c) 2020 Ameya Lokare
+ */
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"sync"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	configReloadCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "config_reloads",
+		Help: "Configuration reloads, by result",
+	}, []string{"result"})
+)
+
+// Proxy is the set of proxy servers created from a config. Everything except the listeners,
+// logging, and the metrics and admin addresses can be changed at runtime with Reload; requests
+// already in flight finish with the settings they started with.
+type Proxy struct {
+	Servers    []*http.Server
+	configFile string
+	handler    atomic.Value // *ProxyHTTPHandler
+	tunnels    *tunnelTracker
+	breakers   *circuitBreakers
+	deliveries *deliveryQueue
+	// idempotency is nil unless deduplication is enabled
+	idempotency *idempotencyCache
+	// audit is nil unless the audit trail is enabled
+	audit *auditSink
+	// keyRings rotates and publishes the keys of the asymmetric signing schemes
+	keyRings *signingKeyRings
+	// reloadLock serializes reloads
+	reloadLock sync.Mutex
+	config     *ProxyConfig
+}
+
+// NewProxy creates the proxy servers for config. configFile is where Reload reads the config from;
+// if empty, the default config is used.
+func NewProxy(config *ProxyConfig, configFile string) *Proxy {
+	p := &Proxy{
+		configFile: configFile,
+		config:     config,
+		tunnels:    newTunnelTracker(),
+		breakers:   newCircuitBreakers(config.CircuitBreaker),
+		keyRings:   newSigningKeyRings(),
+	}
+	if config.Idempotency.Window > 0 {
+		idempotency, err := newIdempotencyCache(config.Idempotency)
+		if err != nil {
+			log.Fatalf("Fatal error setting up idempotency cache: %s\n", err)
+		}
+		p.idempotency = idempotency
+		idempotency.start()
+	}
+	if config.Audit.File != "" {
+		audit, err := newAuditSink(config.Audit)
+		if err != nil {
+			log.Fatalf("Fatal error setting up audit trail: %s\n", err)
+		}
+		p.audit = audit
+	}
+	if config.Delivery.StoreFile != "" {
+		deliveries, err := newDeliveryQueue(config.Delivery, p.currentHandler)
+		if err != nil {
+			log.Fatalf("Fatal error setting up asynchronous delivery: %s\n", err)
+		}
+		p.deliveries = deliveries
+	}
+	rings, err := p.keyRings.open(config.SigningKeys)
+	if err != nil {
+		log.Fatalf("Fatal error loading signing keys: %s\n", err)
+	}
+	handler, err := newProxyHTTPHandler(config, p.tunnels, p.breakers, p.deliveries, p.idempotency, p.audit, rings)
+	if err != nil {
+		log.Fatalf("Fatal error creating proxy handler: %s\n", err)
+	}
+	p.handler.Store(handler)
+	handler.start()
+	p.keyRings.set(rings)
+	p.keyRings.start()
+	if p.deliveries != nil {
+		p.deliveries.start()
+	}
+	for _, listenerConfig := range config.Listeners {
+		listenerConnsGauge := connsGauge.With(prometheus.Labels{"listener": listenerConfig.Address})
+		p.Servers = append(p.Servers, newProxyServer(listenerConfig, p, listenerConnsGauge))
+	}
+	return p
+}
+
+func (p *Proxy) currentHandler() *ProxyHTTPHandler {
+	return p.handler.Load().(*ProxyHTTPHandler)
+}
+
+// Reload re-reads the config file and, if it is valid, swaps in a handler built from it. If it
+// isn't, the current config stays in effect.
+func (p *Proxy) Reload() error {
+	p.reloadLock.Lock()
+	defer p.reloadLock.Unlock()
+
+	config, err := p.loadConfig()
+	if err == nil {
+		err = p.swapConfig(config)
+	}
+	if err != nil {
+		configReloadCounter.With(prometheus.Labels{"result": "failure"}).Inc()
+		log.Errorf("Rejected new configuration, keeping the current one: %s\n", err)
+		return err
+	}
+	configReloadCounter.With(prometheus.Labels{"result": "success"}).Inc()
+	log.Infof("Reloaded configuration\n")
+	return nil
+}
+
+func (p *Proxy) loadConfig() (*ProxyConfig, error) {
+	if p.configFile == "" {
+		return InitDefaultConfig()
+	}
+	return UnmarshalConfigFromFile(p.configFile)
+}
+
+func (p *Proxy) swapConfig(config *ProxyConfig) error {
+	rings, err := p.keyRings.open(config.SigningKeys)
+	if err != nil {
+		return err
+	}
+	handler, err := newProxyHTTPHandler(config, p.tunnels, p.breakers, p.deliveries, p.idempotency, p.audit, rings)
+	if err != nil {
+		return err
+	}
+	for _, key := range restartRequired(p.config, config) {
+		log.Warnf("Ignoring change to %s; it only takes effect after a restart\n", key)
+	}
+	p.breakers.configure(config.CircuitBreaker)
+	old := p.currentHandler()
+	p.handler.Store(handler)
+	handler.start()
+	p.keyRings.set(rings)
+	p.config = config
+	old.close()
+	return nil
+}
+
+// restartRequired lists the settings that differ between old and new but can't be changed at runtime
+func restartRequired(old *ProxyConfig, new *ProxyConfig) []string {
+	var keys []string
+	if !reflect.DeepEqual(old.Listeners, new.Listeners) {
+		keys = append(keys, "listeners")
+	}
+	if old.AccessLog != new.AccessLog {
+		keys = append(keys, "accessLog")
+	}
+	if old.ProxyLog != new.ProxyLog {
+		keys = append(keys, "proxyLog")
+	}
+	if old.MetricsAddress != new.MetricsAddress {
+		keys = append(keys, "metricsAddress")
+	}
+	if old.AdminAddress != new.AdminAddress {
+		keys = append(keys, "adminAddress")
+	}
+	if old.Delivery != new.Delivery {
+		keys = append(keys, "delivery")
+	}
+	if old.Idempotency != new.Idempotency {
+		keys = append(keys, "idempotency")
+	}
+	if !reflect.DeepEqual(old.Audit, new.Audit) {
+		keys = append(keys, "audit")
+	}
+	return keys
+}
+
+func (p *Proxy) handleReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Reload must be a POST", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := p.Reload(); err != nil {
+		http.Error(w, fmt.Sprintf("Rejected new configuration: %s", err), http.StatusUnprocessableEntity)
+		return
+	}
+	fmt.Fprintln(w, "Configuration reloaded")
+}
@@ -0,0 +1,71 @@
+/**
+ * Copyright (c) 2020 Ameya Lokare
+ */
+package proxy
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func TestReload(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "config.yaml")
+	writeConfig := func(data string) {
+		checkNoError(t, ioutil.WriteFile(configFile, []byte(data), 0600))
+	}
+	writeConfig("maxResponseBodySize: 1024")
+	config, err := UnmarshalConfigFromFile(configFile)
+	checkNoError(t, err)
+	p := NewProxy(config, configFile)
+	assertEqual(t, uint32(1024), p.currentHandler().maxContentLength)
+
+	t.Run("Valid config is swapped in", func(t *testing.T) {
+		original := p.currentHandler()
+		writeConfig("maxResponseBodySize: 2048\nreadTimeout: 3s")
+		checkNoError(t, p.Reload())
+		assertEqual(t, uint32(2048), p.currentHandler().maxContentLength)
+		if p.currentHandler() == original {
+			t.Fatalf("Expected a new handler after reload")
+		}
+	})
+
+	t.Run("Invalid config is rejected", func(t *testing.T) {
+		original := p.currentHandler()
+		writeConfig("dialMode: fastest")
+		assertError(t, "Invalid dial mode fastest", p.Reload())
+		if p.currentHandler() != original {
+			t.Fatalf("Expected the current handler to be kept after a failed reload")
+		}
+	})
+
+	t.Run("Listeners require a restart", func(t *testing.T) {
+		writeConfig("listeners: [{type: http, address: ':19090'}]")
+		checkNoError(t, p.Reload())
+		assertEqual(t, 1, len(p.Servers))
+		assertEqual(t, ":9090", p.Servers[0].Addr)
+	})
+
+	t.Run("Admin endpoint", func(t *testing.T) {
+		admin := httptest.NewServer(newAdminHandler(p))
+		defer admin.Close()
+
+		writeConfig("maxResponseBodySize: 4096")
+		resp, err := http.Post(admin.URL+"/reload", "text/plain", nil)
+		checkNoError(t, err)
+		assertEqual(t, http.StatusOK, resp.StatusCode)
+		assertEqual(t, uint32(4096), p.currentHandler().maxContentLength)
+
+		writeConfig("maxResponseBodySize: -1")
+		resp, err = http.Post(admin.URL+"/reload", "text/plain", nil)
+		checkNoError(t, err)
+		assertEqual(t, http.StatusUnprocessableEntity, resp.StatusCode)
+		assertEqual(t, uint32(4096), p.currentHandler().maxContentLength)
+
+		resp, err = http.Get(admin.URL + "/reload")
+		checkNoError(t, err)
+		assertEqual(t, http.StatusMethodNotAllowed, resp.StatusCode)
+	})
+}
@@ -0,0 +1,104 @@
+/**
+ * Copyright (c) 2020 Ameya Lokare
+ */
+package proxy
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+const rotatedFileTimeFormat = "20060102T150405.000"
+
+// rotatingFile is a file that is moved aside, to the same path with a timestamp appended, once it
+// would grow past maxSize bytes or has been written to for maxAge. Zero limits are ignored. Only
+// the newest maxBackups rotated files are kept, unless it's zero. It isn't safe for concurrent use.
+type rotatingFile struct {
+	path       string
+	maxSize    int64
+	maxAge     time.Duration
+	maxBackups int
+	now        func() time.Time
+
+	file     *os.File
+	size     int64
+	openedAt time.Time
+}
+
+func openRotatingFile(path string, maxSize int64, maxAge time.Duration, maxBackups int) (*rotatingFile, error) {
+	f := &rotatingFile{path: path, maxSize: maxSize, maxAge: maxAge, maxBackups: maxBackups, now: time.Now}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file = file
+	f.size = info.Size()
+	f.openedAt = f.now()
+	return nil
+}
+
+func (f *rotatingFile) Write(b []byte) (int, error) {
+	tooBig := f.maxSize > 0 && f.size > 0 && f.size+int64(len(b)) > f.maxSize
+	tooOld := f.maxAge > 0 && f.now().Sub(f.openedAt) >= f.maxAge
+	if tooBig || tooOld {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(b)
+	f.size += int64(n)
+	return n, err
+}
+
+// rotate moves the file aside while it's still open, so that if that or opening the new file
+// fails, writes carry on to the old one
+func (f *rotatingFile) rotate() error {
+	if err := os.Rename(f.path, f.path+"."+f.now().UTC().Format(rotatedFileTimeFormat)); err != nil {
+		return err
+	}
+	rotated := f.file
+	if err := f.open(); err != nil {
+		return err
+	}
+	if err := rotated.Close(); err != nil {
+		log.Warnf("Error closing rotated file %s: %s\n", rotated.Name(), err)
+	}
+	f.removeOldBackups()
+	return nil
+}
+
+func (f *rotatingFile) removeOldBackups() {
+	if f.maxBackups <= 0 {
+		return
+	}
+	backups, err := filepath.Glob(f.path + ".*")
+	if err != nil {
+		return
+	}
+	// The timestamps sort in the order the files were rotated
+	sort.Strings(backups)
+	for len(backups) > f.maxBackups {
+		if err := os.Remove(backups[0]); err != nil {
+			log.Warnf("Error removing rotated file %s: %s\n", backups[0], err)
+		}
+		backups = backups[1:]
+	}
+}
+
+func (f *rotatingFile) Close() error {
+	return f.file.Close()
+}
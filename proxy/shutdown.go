@@ -0,0 +1,115 @@
+/**
+ * Copyright (c) 2020 Ameya Lokare
+ */
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ShutdownTimeout is how long Shutdown should be given to drain, as currently configured
+func (p *Proxy) ShutdownTimeout() time.Duration {
+	p.reloadLock.Lock()
+	defer p.reloadLock.Unlock()
+	return p.config.ShutdownTimeout
+}
+
+// Shutdown stops every proxy server from accepting connections, then waits for in-flight requests,
+// CONNECT tunnels and delivery attempts to finish. If ctx is done first, whatever is left is closed
+// and ctx's error is returned. Either way, the stores and the audit trail are closed.
+func (p *Proxy) Shutdown(ctx context.Context) error {
+	var wg sync.WaitGroup
+	for _, server := range p.Servers {
+		wg.Add(1)
+		go func(server *http.Server) {
+			server.Shutdown(ctx)
+			wg.Done()
+		}(server)
+	}
+	wg.Wait()
+
+	err := p.tunnels.wait(ctx)
+	if err != nil {
+		for _, server := range p.Servers {
+			server.Close()
+		}
+		p.tunnels.closeAll()
+	}
+	if p.deliveries != nil {
+		// Deliveries that are cut short are left pending, and attempted again on restart. The
+		// store is closed once the attempts in progress are.
+		if stopErr := p.deliveries.stop(ctx); err == nil {
+			err = stopErr
+		}
+	}
+	if p.idempotency != nil {
+		p.idempotency.close()
+	}
+	if p.audit != nil {
+		p.audit.close()
+	}
+	p.keyRings.close()
+	p.currentHandler().close()
+	return err
+}
+
+// tunnelTracker keeps track of CONNECT tunnels. Their connections are hijacked, so http.Server
+// forgets about them and Shutdown doesn't wait for them.
+type tunnelTracker struct {
+	wg    sync.WaitGroup
+	mu    sync.Mutex
+	conns map[net.Conn]struct{}
+}
+
+func newTunnelTracker() *tunnelTracker {
+	return &tunnelTracker{conns: make(map[net.Conn]struct{})}
+}
+
+// start is called when a CONNECT request arrives, before its connection is hijacked, so that
+// Shutdown can't miss it
+func (t *tunnelTracker) start() {
+	t.wg.Add(1)
+}
+
+func (t *tunnelTracker) done() {
+	t.wg.Done()
+}
+
+func (t *tunnelTracker) track(conn net.Conn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.conns[conn] = struct{}{}
+}
+
+func (t *tunnelTracker) untrack(conn net.Conn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.conns, conn)
+}
+
+// wait blocks until every tunnel has finished, or ctx is done
+func (t *tunnelTracker) wait(ctx context.Context) error {
+	finished := make(chan struct{})
+	go func() {
+		t.wg.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (t *tunnelTracker) closeAll() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for conn := range t.conns {
+		conn.Close()
+	}
+}
@@ -0,0 +1,76 @@
+/**
+ * Copyright (c) 2020 Ameya Lokare
+ */
+package proxy
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestShutdown(t *testing.T) {
+	t.Run("Waits for tunnels to finish", func(t *testing.T) {
+		p := NewProxy(NewDefaultConfig(), "")
+		p.tunnels.start()
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			p.tunnels.done()
+		}()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		start := time.Now()
+		checkNoError(t, p.Shutdown(ctx))
+		if time.Since(start) < 50*time.Millisecond {
+			t.Fatalf("Expected shutdown to wait for the tunnel to finish")
+		}
+	})
+
+	t.Run("Closes tunnels still open after the timeout", func(t *testing.T) {
+		p := NewProxy(NewDefaultConfig(), "")
+		inbound, client := net.Pipe()
+		defer client.Close()
+		p.tunnels.start()
+		p.tunnels.track(inbound)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		err := p.Shutdown(ctx)
+		assertEqual(t, context.DeadlineExceeded, err)
+		if _, err := client.Read(make([]byte, 1)); err == nil {
+			t.Fatalf("Expected the tunnel connection to be closed")
+		}
+	})
+
+	t.Run("Closes the stores and audit trail after the timeout", func(t *testing.T) {
+		dir := t.TempDir()
+		config := NewDefaultConfig()
+		config.Idempotency.Window = time.Hour
+		config.Idempotency.StoreFile = filepath.Join(dir, "idempotency.db")
+		config.Delivery.StoreFile = filepath.Join(dir, "deliveries.db")
+		config.Audit.File = filepath.Join(dir, "audit.log")
+		checkNoError(t, config.validate())
+		p := NewProxy(config, "")
+		inbound, client := net.Pipe()
+		defer client.Close()
+		p.tunnels.start()
+		p.tunnels.track(inbound)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		assertEqual(t, context.DeadlineExceeded, p.Shutdown(ctx))
+		for _, storeFile := range []string{config.Idempotency.StoreFile, config.Delivery.StoreFile} {
+			// Only one process can open a store at a time
+			db, err := bolt.Open(storeFile, 0600, &bolt.Options{Timeout: time.Second})
+			checkNoError(t, err)
+			db.Close()
+		}
+		if _, err := p.audit.file.Write([]byte("{}\n")); err == nil {
+			t.Fatalf("Expected the audit file to be closed")
+		}
+	})
+}
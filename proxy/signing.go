@@ -0,0 +1,298 @@
+/**
+ * Copyright (c) 2020 Ameya Lokare
+ */
+package proxy
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// SigningKeyHeader selects the signing key, by alias, the proxy signs the request body with
+	SigningKeyHeader string = "X-WhSentry-Signing-Key"
+
+	defaultStripeSignatureHeader = "Stripe-Signature"
+	defaultHubSignatureHeader    = "X-Hub-Signature-256"
+	defaultSignatureHeader       = "X-Webhook-Signature"
+	defaultKeyIDHeader           = "X-Webhook-Key-Id"
+)
+
+type SigningScheme string
+
+const (
+	// SigningSchemeStripe signs "timestamp.body" and sends t=timestamp,v1=signature
+	SigningSchemeStripe SigningScheme = "stripe"
+	// SigningSchemeStandardWebhooks follows https://www.standardwebhooks.com
+	SigningSchemeStandardWebhooks SigningScheme = "standardWebhooks"
+	// SigningSchemeHubSignature256 signs the body and sends sha256=signature, like GitHub
+	SigningSchemeHubSignature256 SigningScheme = "hubSignature256"
+	// SigningSchemeEd25519 signs "timestamp.body" with an Ed25519 key the proxy generates and
+	// publishes, and sends t=timestamp,v1=signature along with the key's ID
+	SigningSchemeEd25519 SigningScheme = "ed25519"
+	// SigningSchemeECDSA is like SigningSchemeEd25519, with an ECDSA P-256 key (ES256)
+	SigningSchemeECDSA SigningScheme = "ecdsa"
+)
+
+// isAsymmetric says whether scheme signs with a private key rather than a shared secret
+func (s SigningScheme) isAsymmetric() bool {
+	return s == SigningSchemeEd25519 || s == SigningSchemeECDSA
+}
+
+// Secret is a string that isn't printed, so that it doesn't end up in logs
+type Secret string
+
+func (s Secret) String() string {
+	return "REDACTED"
+}
+
+func (s Secret) GoString() string {
+	return "REDACTED"
+}
+
+// SigningKeyConfig is a secret the proxy signs request bodies with. While a secret is being
+// rotated, all of its versions are listed and requests are signed with each one; schemes that
+// only carry one signature use the first. The ed25519 and ecdsa schemes use a key pair kept in
+// KeyFile instead, whose public keys are published as a JWKS.
+type SigningKeyConfig struct {
+	Scheme SigningScheme `yaml:"scheme"`
+	// Header the signature is sent in, for every scheme but standardWebhooks
+	Header  string   `yaml:"header"`
+	Secrets []Secret `yaml:"secrets"`
+	// SecretsFile holds one secret per line, which are used after Secrets
+	SecretsFile string `yaml:"secretsFile"`
+	// FileSecrets are the secrets loaded from SecretsFile
+	FileSecrets []Secret `yaml:"-"`
+	// KeyFile holds the current and previous private keys for the ed25519 and ecdsa schemes. It's
+	// created with a new key if it doesn't exist.
+	KeyFile string `yaml:"keyFile"`
+	// RotationPeriod is how long a key is used before the proxy replaces it; 0 never rotates
+	RotationPeriod time.Duration `yaml:"rotationPeriod"`
+	// KeyIDHeader is the header the ID of the signing key is sent in, for the ed25519 and ecdsa schemes
+	KeyIDHeader string `yaml:"keyIdHeader"`
+}
+
+func (k SigningKeyConfig) allSecrets() []Secret {
+	return append(append([]Secret(nil), k.Secrets...), k.FileSecrets...)
+}
+
+func validateSigningKeys(keys map[string]SigningKeyConfig) error {
+	for alias, key := range keys {
+		switch key.Scheme {
+		case SigningSchemeStripe, SigningSchemeHubSignature256:
+		case SigningSchemeStandardWebhooks:
+			if key.Header != "" {
+				return fmt.Errorf("Signing key %s: header can't be set for the standardWebhooks scheme", alias)
+			}
+		case SigningSchemeEd25519, SigningSchemeECDSA:
+		default:
+			return fmt.Errorf("Signing key %s: invalid scheme %q; must be one of 'stripe', 'standardWebhooks', 'hubSignature256', 'ed25519' or 'ecdsa'", alias, key.Scheme)
+		}
+		if key.Scheme.isAsymmetric() {
+			if err := validateAsymmetricKey(key); err != nil {
+				return fmt.Errorf("Signing key %s: %s", alias, err)
+			}
+			continue
+		}
+		if key.KeyFile != "" || key.RotationPeriod != 0 || key.KeyIDHeader != "" {
+			return fmt.Errorf("Signing key %s: keyFile, rotationPeriod and keyIdHeader can only be set for the ed25519 and ecdsa schemes", alias)
+		}
+		if len(key.Secrets) == 0 && key.SecretsFile == "" {
+			return fmt.Errorf("Signing key %s must specify secrets or secretsFile", alias)
+		}
+		if _, err := decodeSecrets(key.Scheme, key.Secrets); err != nil {
+			return fmt.Errorf("Signing key %s: %s", alias, err)
+		}
+	}
+	return nil
+}
+
+func validateAsymmetricKey(key SigningKeyConfig) error {
+	if key.KeyFile == "" {
+		return fmt.Errorf("keyFile must be set for the %s scheme", key.Scheme)
+	}
+	if len(key.Secrets) > 0 || key.SecretsFile != "" {
+		return fmt.Errorf("secrets and secretsFile can't be set for the %s scheme", key.Scheme)
+	}
+	if key.RotationPeriod < 0 {
+		return fmt.Errorf("rotationPeriod must not be negative")
+	}
+	if key.RotationPeriod > 0 && key.RotationPeriod < jwksMaxAge {
+		// The next key is published for a rotation period, which has to be long enough for every
+		// cached JWKS to have expired
+		return fmt.Errorf("rotationPeriod must be at least %s, how long the JWKS may be cached", jwksMaxAge)
+	}
+	return nil
+}
+
+func (p *ProxyConfig) loadSigningSecrets() error {
+	for alias, key := range p.SigningKeys {
+		if key.SecretsFile == "" {
+			continue
+		}
+		secrets, err := loadSecretsFile(key.SecretsFile)
+		if err != nil {
+			return fmt.Errorf("Error loading secrets file for signing key %s: %s", alias, err)
+		}
+		if len(secrets) == 0 {
+			return fmt.Errorf("Secrets file for signing key %s has no secrets", alias)
+		}
+		if _, err := decodeSecrets(key.Scheme, secrets); err != nil {
+			return fmt.Errorf("Signing key %s: %s", alias, err)
+		}
+		key.FileSecrets = secrets
+		p.SigningKeys[alias] = key
+	}
+	return nil
+}
+
+func loadSecretsFile(secretsFile string) ([]Secret, error) {
+	f, err := os.Open(secretsFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var secrets []Secret
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		secrets = append(secrets, Secret(line))
+	}
+	return secrets, scanner.Err()
+}
+
+// decodeSecrets returns the HMAC keys for secrets. Standard Webhooks secrets are base64, with an
+// optional whsec_ prefix; the other schemes use secrets as they are.
+func decodeSecrets(scheme SigningScheme, secrets []Secret) ([][]byte, error) {
+	keys := make([][]byte, 0, len(secrets))
+	for i, secret := range secrets {
+		if secret == "" {
+			return nil, fmt.Errorf("secret %d is empty", i+1)
+		}
+		if scheme != SigningSchemeStandardWebhooks {
+			keys = append(keys, []byte(secret))
+			continue
+		}
+		key, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(string(secret), "whsec_"))
+		if err != nil {
+			return nil, fmt.Errorf("secret %d is not valid base64", i+1)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+type webhookSigner struct {
+	scheme SigningScheme
+	header string
+	keys   [][]byte
+	// ring and keyIDHeader are set for the asymmetric schemes
+	ring        *signingKeyRing
+	keyIDHeader string
+}
+
+// newWebhookSigners creates the signers for configs. The asymmetric schemes sign with the key
+// ring for their alias in rings.
+func newWebhookSigners(configs map[string]SigningKeyConfig, rings map[string]*signingKeyRing) (map[string]*webhookSigner, error) {
+	signers := make(map[string]*webhookSigner)
+	for alias, config := range configs {
+		if config.Scheme.isAsymmetric() {
+			ring := rings[alias]
+			if ring == nil {
+				return nil, fmt.Errorf("Signing key %s has no key ring", alias)
+			}
+			signer := &webhookSigner{scheme: config.Scheme, header: config.Header, ring: ring, keyIDHeader: config.KeyIDHeader}
+			if signer.header == "" {
+				signer.header = defaultSignatureHeader
+			}
+			if signer.keyIDHeader == "" {
+				signer.keyIDHeader = defaultKeyIDHeader
+			}
+			signers[alias] = signer
+			continue
+		}
+		keys, err := decodeSecrets(config.Scheme, config.allSecrets())
+		if err != nil {
+			return nil, fmt.Errorf("Signing key %s: %s", alias, err)
+		}
+		header := config.Header
+		if header == "" {
+			if config.Scheme == SigningSchemeStripe {
+				header = defaultStripeSignatureHeader
+			} else {
+				header = defaultHubSignatureHeader
+			}
+		}
+		signers[alias] = &webhookSigner{scheme: config.Scheme, header: header, keys: keys}
+	}
+	return signers, nil
+}
+
+// sign adds the signature headers for body to h. messageID identifies the message for the
+// standardWebhooks scheme, unless the client already sent a webhook-id. If signing fails, h is left
+// as it was, and the request mustn't be sent.
+func (s *webhookSigner) sign(h http.Header, body []byte, messageID string, now time.Time) error {
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	switch s.scheme {
+	case SigningSchemeStripe:
+		signed := []byte(timestamp + "." + string(body))
+		parts := []string{"t=" + timestamp}
+		for _, key := range s.keys {
+			parts = append(parts, "v1="+hex.EncodeToString(hmacSHA256(key, signed)))
+		}
+		h.Set(s.header, strings.Join(parts, ","))
+	case SigningSchemeStandardWebhooks:
+		if id := h.Get("Webhook-Id"); id != "" {
+			messageID = id
+		}
+		signed := []byte(messageID + "." + timestamp + "." + string(body))
+		var signatures []string
+		for _, key := range s.keys {
+			signatures = append(signatures, "v1,"+base64.StdEncoding.EncodeToString(hmacSHA256(key, signed)))
+		}
+		h.Set("Webhook-Id", messageID)
+		h.Set("Webhook-Timestamp", timestamp)
+		h.Set("Webhook-Signature", strings.Join(signatures, " "))
+	case SigningSchemeHubSignature256:
+		h.Set(s.header, "sha256="+hex.EncodeToString(hmacSHA256(s.keys[0], body)))
+	case SigningSchemeEd25519, SigningSchemeECDSA:
+		key := s.ring.current()
+		signature, err := key.sign([]byte(timestamp + "." + string(body)))
+		if err != nil {
+			// Signing only fails if the system's source of randomness does
+			return fmt.Errorf("Error signing with key %s: %s", key.id, err)
+		}
+		h.Set(s.header, "t="+timestamp+",v1="+base64.RawURLEncoding.EncodeToString(signature))
+		h.Set(s.keyIDHeader, key.id)
+	}
+	return nil
+}
+
+// headers are the headers sign sets
+func (s *webhookSigner) headers() []string {
+	switch s.scheme {
+	case SigningSchemeStandardWebhooks:
+		return []string{"Webhook-Id", "Webhook-Timestamp", "Webhook-Signature"}
+	case SigningSchemeEd25519, SigningSchemeECDSA:
+		return []string{s.header, s.keyIDHeader}
+	}
+	return []string{s.header}
+}
+
+func hmacSHA256(key []byte, data []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
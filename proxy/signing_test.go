@@ -0,0 +1,97 @@
+/**
+ * Copyright (c) 2020 Ameya Lokare
+ */
+package proxy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWebhookSigner(t *testing.T) {
+	sign := func(config SigningKeyConfig, body string, h http.Header, now time.Time) http.Header {
+		signers, err := newWebhookSigners(map[string]SigningKeyConfig{"key": config}, nil)
+		checkNoError(t, err)
+		checkNoError(t, signers["key"].sign(h, []byte(body), "rq-1", now))
+		return h
+	}
+
+	t.Run("Standard Webhooks", func(t *testing.T) {
+		h := http.Header{}
+		h.Set("Webhook-Id", "msg_p5jXN8AQM9LWM0D4loKWxJek")
+		config := SigningKeyConfig{Scheme: SigningSchemeStandardWebhooks, Secrets: []Secret{"whsec_MfKQ9r8GKYqrTwjUPD8ILPZIo2LaLaSw"}}
+		sign(config, `{"test": 2432232314}`, h, time.Unix(1614265330, 0))
+		assertEqual(t, "msg_p5jXN8AQM9LWM0D4loKWxJek", h.Get("Webhook-Id"))
+		assertEqual(t, "1614265330", h.Get("Webhook-Timestamp"))
+		assertEqual(t, "v1,g0hM9SsE+OTPJTGt/tmIKtSyZlE3uFJELVlNIOLJ1OE=", h.Get("Webhook-Signature"))
+	})
+
+	t.Run("Standard Webhooks uses the request ID without a webhook-id", func(t *testing.T) {
+		config := SigningKeyConfig{Scheme: SigningSchemeStandardWebhooks, Secrets: []Secret{"whsec_MfKQ9r8GKYqrTwjUPD8ILPZIo2LaLaSw", "c2Vjb25k"}}
+		h := sign(config, "{}", http.Header{}, time.Unix(1614265330, 0))
+		assertEqual(t, "rq-1", h.Get("Webhook-Id"))
+		assertEqual(t, 2, len(strings.Split(h.Get("Webhook-Signature"), " ")))
+	})
+
+	t.Run("Hub signature", func(t *testing.T) {
+		config := SigningKeyConfig{Scheme: SigningSchemeHubSignature256, Secrets: []Secret{"It's a Secret to Everybody", "old secret"}}
+		h := sign(config, "Hello, World!", http.Header{}, time.Now())
+		assertEqual(t, "sha256=757107ea0eb2509fc211221cce984b8a37570b6d7586c22c46f4379c8b043e17", h.Get("X-Hub-Signature-256"))
+	})
+
+	t.Run("Stripe", func(t *testing.T) {
+		config := SigningKeyConfig{Scheme: SigningSchemeStripe, Header: "Acme-Signature", Secrets: []Secret{"new", "old"}}
+		h := sign(config, "Hello, World!", http.Header{}, time.Unix(1600000000, 0))
+		parts := strings.Split(h.Get("Acme-Signature"), ",")
+		assertEqual(t, 3, len(parts))
+		assertEqual(t, "t=1600000000", parts[0])
+		assertEqual(t, "v1=", parts[1][:3])
+		if parts[1] == parts[2] {
+			t.Fatalf("Expected a different signature for each secret")
+		}
+		assertEqual(t, "", h.Get(defaultStripeSignatureHeader))
+	})
+}
+
+func TestSigningKeyConfig(t *testing.T) {
+	t.Run("Secrets aren't printed", func(t *testing.T) {
+		config := SigningKeyConfig{Scheme: SigningSchemeStripe, Secrets: []Secret{"sk_live_123"}}
+		for _, format := range []string{"%v", "%+v", "%#v", "%s"} {
+			if strings.Contains(fmt.Sprintf(format, config), "sk_live_123") {
+				t.Fatalf("Expected secret to be redacted with %s", format)
+			}
+		}
+	})
+
+	t.Run("Secrets file", func(t *testing.T) {
+		secretsFile := filepath.Join(t.TempDir(), "secrets")
+		checkNoError(t, ioutil.WriteFile(secretsFile, []byte("# rotated 2020-10-01\nnew-secret\n\nold-secret\n"), 0600))
+		config, err := UnmarshalConfig([]byte(fmt.Sprintf("signingKeys: {acme: {scheme: stripe, secrets: [inline], secretsFile: %s}}", secretsFile)))
+		checkNoError(t, err)
+		checkNoError(t, InitConfig(config))
+		secrets := config.SigningKeys["acme"].allSecrets()
+		assertEqual(t, 3, len(secrets))
+		assertEqual(t, Secret("inline"), secrets[0])
+		assertEqual(t, Secret("old-secret"), secrets[2])
+	})
+
+	t.Run("Invalid scheme", func(t *testing.T) {
+		_, err := UnmarshalConfig([]byte(`signingKeys: {acme: {scheme: md5, secrets: [abc]}}`))
+		assertError(t, "Signing key acme: invalid scheme", err)
+	})
+
+	t.Run("No secrets", func(t *testing.T) {
+		_, err := UnmarshalConfig([]byte(`signingKeys: {acme: {scheme: stripe}}`))
+		assertError(t, "Signing key acme must specify secrets or secretsFile", err)
+	})
+
+	t.Run("Standard Webhooks secret that isn't base64", func(t *testing.T) {
+		_, err := UnmarshalConfig([]byte(`signingKeys: {acme: {scheme: standardWebhooks, secrets: ["whsec_not base64!"]}}`))
+		assertError(t, "secret 1 is not valid base64", err)
+	})
+}
@@ -0,0 +1,200 @@
+/**
+ * Copyright (c) 2020 Ameya Lokare
+ */
+package proxy
+
+import (
+	"crypto/tls"
+	"fmt"
+	"time"
+)
+
+// TenantConfig is a named policy profile. Requests are assigned to a tenant by the principal they
+// authenticated as or the client certificate they presented, and then proxied with the tenant's
+// settings instead of the top level ones. Settings a tenant leaves out are inherited. A tenant's
+// deny lists are added to the top level ones rather than replacing them, so that a tenant blocking
+// a range of its own can't unblock the private and reserved ranges by accident.
+type TenantConfig struct {
+	Principals         []string `yaml:"principals"`
+	ClientCertSubjects []string `yaml:"clientCertSubjects"`
+	ClientCertSANs     []string `yaml:"clientCertSANs"`
+
+	CidrDenyList        []Cidr                      `yaml:"cidrDenyList"`
+	IPv6CidrDenyList    []Cidr                      `yaml:"ipv6CidrDenyList"`
+	CidrAllowList       []Cidr                      `yaml:"cidrAllowList"`
+	HostAllowList       []string                    `yaml:"hostAllowList"`
+	HostDenyList        []string                    `yaml:"hostDenyList"`
+	AllowedPorts        []PortRange                 `yaml:"allowedPorts"`
+	DeniedPorts         []PortRange                 `yaml:"deniedPorts"`
+	ConnectTimeout      time.Duration               `yaml:"connectTimeout"`
+	ConnectionLifetime  time.Duration               `yaml:"connectionLifetime"`
+	ReadTimeout         time.Duration               `yaml:"readTimeout"`
+	MaxResponseBodySize uint32                      `yaml:"maxResponseBodySize"`
+	ClientCertConfigs   map[string]ClientCertConfig `yaml:"clientCerts"`
+	ClientCerts         map[string]tls.Certificate  `yaml:"-"`
+	// RateLimits replaces the top level rate limits as a whole, and are counted separately
+	RateLimits *RateLimitConfig `yaml:"rateLimits"`
+}
+
+// forTenant returns the config requests assigned to tenant are proxied with
+func (p *ProxyConfig) forTenant(tenant TenantConfig) *ProxyConfig {
+	config := *p
+	config.Tenants = nil
+	if tenant.CidrDenyList != nil {
+		config.CidrDenyList = append(append([]Cidr(nil), p.CidrDenyList...), tenant.CidrDenyList...)
+	}
+	if tenant.IPv6CidrDenyList != nil {
+		config.IPv6CidrDenyList = append(append([]Cidr(nil), p.IPv6CidrDenyList...), tenant.IPv6CidrDenyList...)
+	}
+	if tenant.CidrAllowList != nil {
+		config.CidrAllowList = tenant.CidrAllowList
+	}
+	if tenant.HostAllowList != nil {
+		config.HostAllowList = tenant.HostAllowList
+	}
+	if tenant.HostDenyList != nil {
+		config.HostDenyList = tenant.HostDenyList
+	}
+	if tenant.AllowedPorts != nil {
+		config.AllowedPorts = tenant.AllowedPorts
+	}
+	if tenant.DeniedPorts != nil {
+		config.DeniedPorts = tenant.DeniedPorts
+	}
+	if tenant.ConnectTimeout != 0 {
+		config.ConnectTimeout = tenant.ConnectTimeout
+	}
+	if tenant.ConnectionLifetime != 0 {
+		config.ConnectionLifetime = tenant.ConnectionLifetime
+	}
+	if tenant.ReadTimeout != 0 {
+		config.ReadTimeout = tenant.ReadTimeout
+	}
+	if tenant.MaxResponseBodySize != 0 {
+		config.MaxResponseBodySize = tenant.MaxResponseBodySize
+	}
+	if tenant.RateLimits != nil {
+		config.RateLimits = *tenant.RateLimits
+	}
+	if len(tenant.ClientCerts) > 0 {
+		// A tenant's own client certs are added to the shared ones, and aren't visible to other tenants
+		config.ClientCerts = make(map[string]tls.Certificate)
+		for alias, cert := range p.ClientCerts {
+			config.ClientCerts[alias] = cert
+		}
+		for alias, cert := range tenant.ClientCerts {
+			config.ClientCerts[alias] = cert
+		}
+	}
+	return &config
+}
+
+func validateTenants(tenants map[string]TenantConfig) error {
+	principals := make(map[string]string)
+	subjects := make(map[string]string)
+	sans := make(map[string]string)
+	for name, tenant := range tenants {
+		if name == "" {
+			return fmt.Errorf("Tenant name must not be empty")
+		}
+		if len(tenant.Principals) == 0 && len(tenant.ClientCertSubjects) == 0 && len(tenant.ClientCertSANs) == 0 {
+			return fmt.Errorf("Tenant %s must specify at least one of principals, clientCertSubjects or clientCertSANs", name)
+		}
+		if err := addTenantSelectors(principals, tenant.Principals, name, "Principal"); err != nil {
+			return err
+		}
+		if err := addTenantSelectors(subjects, tenant.ClientCertSubjects, name, "Client certificate subject"); err != nil {
+			return err
+		}
+		if err := addTenantSelectors(sans, tenant.ClientCertSANs, name, "Client certificate SAN"); err != nil {
+			return err
+		}
+		if err := validateHostPatterns(tenant.HostAllowList); err != nil {
+			return fmt.Errorf("Tenant %s: %s", name, err)
+		}
+		if err := validateHostPatterns(tenant.HostDenyList); err != nil {
+			return fmt.Errorf("Tenant %s: %s", name, err)
+		}
+		if err := validateClientCertConfigs(tenant.ClientCertConfigs); err != nil {
+			return fmt.Errorf("Tenant %s: %s", name, err)
+		}
+		if tenant.RateLimits != nil {
+			if err := validateRateLimits(*tenant.RateLimits); err != nil {
+				return fmt.Errorf("Tenant %s: %s", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+func addTenantSelectors(selectors map[string]string, values []string, tenant string, kind string) error {
+	for _, value := range values {
+		if other, found := selectors[value]; found && other != tenant {
+			return fmt.Errorf("%s %s is assigned to both tenant %s and tenant %s", kind, value, other, tenant)
+		}
+		selectors[value] = tenant
+	}
+	return nil
+}
+
+func (p *ProxyConfig) loadTenantClientCerts() error {
+	for name, tenant := range p.Tenants {
+		tenant.ClientCerts = make(map[string]tls.Certificate)
+		for alias, certConfig := range tenant.ClientCertConfigs {
+			cert, err := loadClientCert(alias, certConfig)
+			if err != nil {
+				return fmt.Errorf("Tenant %s: %s", name, err)
+			}
+			if err := checkNotExpired(cert, alias); err != nil {
+				return fmt.Errorf("Tenant %s: %s", name, err)
+			}
+			tenant.ClientCerts[alias] = *cert
+		}
+		p.Tenants[name] = tenant
+	}
+	return nil
+}
+
+// tenantSelector assigns requests to tenants. The principal is checked first, then the client
+// certificate subject, then its SANs.
+type tenantSelector struct {
+	principals map[string]string
+	subjects   map[string]string
+	sans       map[string]string
+}
+
+func newTenantSelector(tenants map[string]TenantConfig) *tenantSelector {
+	selector := &tenantSelector{
+		principals: make(map[string]string),
+		subjects:   make(map[string]string),
+		sans:       make(map[string]string),
+	}
+	for name, tenant := range tenants {
+		for _, principal := range tenant.Principals {
+			selector.principals[principal] = name
+		}
+		for _, subject := range tenant.ClientCertSubjects {
+			selector.subjects[subject] = name
+		}
+		for _, san := range tenant.ClientCertSANs {
+			selector.sans[san] = name
+		}
+	}
+	return selector
+}
+
+// selectTenant returns the name of the tenant identity belongs to, or "" if it doesn't belong to any
+func (t *tenantSelector) selectTenant(identity *requestIdentity) string {
+	if tenant, ok := t.principals[identity.principal]; ok && identity.principal != "" {
+		return tenant
+	}
+	if tenant, ok := t.subjects[identity.clientCertSubject]; ok && identity.clientCertSubject != "" {
+		return tenant
+	}
+	for _, san := range identity.clientCertSANs {
+		if tenant, ok := t.sans[san]; ok {
+			return tenant
+		}
+	}
+	return ""
+}
@@ -0,0 +1,81 @@
+/**
+ * Copyright (c) 2020 Ameya Lokare
+ */
+package proxy
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTenantConfig(t *testing.T) {
+	var data = `
+maxResponseBodySize: 1024
+hostDenyList: [".internal"]
+tenants:
+  billing:
+    principals: [billing-service]
+    maxResponseBodySize: 4096
+    readTimeout: 2s
+    hostDenyList: []
+    cidrDenyList: ["203.0.113.0/24"]
+    ipv6CidrDenyList: ["2001:db8:1::/48"]
+  search:
+    clientCertSANs: ["spiffe://example.org/search"]
+    hostAllowList: [".partner.com"]
+`
+	config, err := UnmarshalConfig([]byte(data))
+	checkNoError(t, err)
+	assertEqual(t, 2, len(config.Tenants))
+
+	t.Run("Overrides", func(t *testing.T) {
+		billing := config.forTenant(config.Tenants["billing"])
+		assertEqual(t, uint32(4096), billing.MaxResponseBodySize)
+		assertEqual(t, 2*time.Second, billing.ReadTimeout)
+		assertEqual(t, 0, len(billing.HostDenyList))
+		// Deny lists are added to, so the default ranges are still blocked
+		dialer := newSafeDialer(billing)
+		for _, ip := range []string{"203.0.113.7", "169.254.169.254", "10.1.2.3", "2001:db8:1::1", "fe80::1", "64:ff9b::a9fe:a9fe"} {
+			assertEqual(t, true, dialer.isBlocked(net.ParseIP(ip)))
+		}
+		assertEqual(t, false, dialer.isBlocked(net.ParseIP("198.51.100.7")))
+		assertEqual(t, len(config.CidrDenyList)+1, len(billing.CidrDenyList))
+		if billing.Tenants != nil {
+			t.Fatalf("Expected tenant config not to have tenants of its own")
+		}
+	})
+
+	t.Run("Inherited settings", func(t *testing.T) {
+		search := config.forTenant(config.Tenants["search"])
+		assertEqual(t, uint32(1024), search.MaxResponseBodySize)
+		assertEqual(t, config.ReadTimeout, search.ReadTimeout)
+		assertEqual(t, ".internal", search.HostDenyList[0])
+		assertEqual(t, ".partner.com", search.HostAllowList[0])
+	})
+
+	t.Run("Selection", func(t *testing.T) {
+		selector := newTenantSelector(config.Tenants)
+		assertEqual(t, "billing", selector.selectTenant(&requestIdentity{principal: "billing-service"}))
+		assertEqual(t, "search", selector.selectTenant(&requestIdentity{clientCertSANs: []string{"search.internal", "spiffe://example.org/search"}}))
+		assertEqual(t, "", selector.selectTenant(&requestIdentity{principal: "someone-else"}))
+		assertEqual(t, "", selector.selectTenant(&requestIdentity{}))
+	})
+}
+
+func TestTenantValidation(t *testing.T) {
+	t.Run("Tenant needs a selector", func(t *testing.T) {
+		_, err := UnmarshalConfig([]byte(`tenants: {billing: {maxResponseBodySize: 4096}}`))
+		assertError(t, "Tenant billing must specify at least one of principals, clientCertSubjects or clientCertSANs", err)
+	})
+
+	t.Run("Principal in two tenants", func(t *testing.T) {
+		_, err := UnmarshalConfig([]byte(`tenants: {a: {principals: [alice]}, b: {principals: [alice]}}`))
+		assertError(t, "Principal alice is assigned to both tenant", err)
+	})
+
+	t.Run("Invalid host pattern", func(t *testing.T) {
+		_, err := UnmarshalConfig([]byte(`tenants: {a: {principals: [alice], hostDenyList: ["[a-"]}}`))
+		assertError(t, "Tenant a: Invalid host pattern", err)
+	})
+}
@@ -1,22 +1,30 @@
 package main
 
 import (
+	"context"
 	_ "embed"
 	"fmt"
 	"github.com/juggernaut/webhook-sentry/proxy"
 	"log"
 	"os"
+	"os/signal"
 	"sync"
+	"syscall"
 )
 
 //go:embed banner.txt
 var banner string
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "dlq" {
+		os.Exit(runDLQ(os.Args[2:], os.Stdout, os.Stderr))
+	}
 	var config *proxy.ProxyConfig
+	var configFile string
 	var err error
 	if len(os.Args) > 1 {
-		config, err = proxy.UnmarshalConfigFromFile(os.Args[1])
+		configFile = os.Args[1]
+		config, err = proxy.UnmarshalConfigFromFile(configFile)
 		if err != nil {
 			log.Fatalf("Failed to unmarshal config from file %s: %s\n", os.Args[1], err)
 		}
@@ -34,9 +42,16 @@ func main() {
 
 	fmt.Print(banner)
 
-	proxyServers := proxy.CreateProxyServers(config)
+	p := proxy.NewProxy(config, configFile)
+	if config.AdminAddress != "" {
+		proxy.StartAdminServer(config.AdminAddress, p)
+	}
+	reloadOnHangup(p)
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, os.Interrupt)
+
 	wg := &sync.WaitGroup{}
-	for i, proxyServer := range proxyServers {
+	for i, proxyServer := range p.Servers {
 		wg.Add(1)
 		listenerConfig := config.Listeners[i]
 		if listenerConfig.Type == proxy.HTTP {
@@ -45,5 +60,25 @@ func main() {
 			proxy.StartTLSServer(listenerConfig.Address, listenerConfig.CertFile, listenerConfig.KeyFile, proxyServer, wg)
 		}
 	}
+
+	sig := <-stop
+	shutdownTimeout := p.ShutdownTimeout()
+	log.Printf("Received %s, draining connections for up to %s\n", sig, shutdownTimeout)
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := p.Shutdown(ctx); err != nil {
+		log.Printf("Closed connections that were still open after %s\n", shutdownTimeout)
+	}
 	wg.Wait()
 }
+
+func reloadOnHangup(p *proxy.Proxy) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	go func() {
+		for range hangup {
+			// Errors are logged by Reload, and the current config stays in effect
+			p.Reload()
+		}
+	}()
+}